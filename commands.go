@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	config "library/configs"
+	"library/internal/database"
+	"library/internal/events"
+	"library/internal/kafka"
+	"library/internal/subscribers"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// runCommand выполняет служебную команду вместо запуска сервера и возвращает код завершения.
+//
+//	library replay-dlq      вернуть события из dead letter топика в основной топик
+//	library replay-events   перечитать топик событий и доставить вебхукам события, которых они еще не получали
+func runCommand(cfg config.Config, args []string) int {
+	switch args[0] {
+	case "replay-dlq":
+		return replayDeadLetters(cfg, args[1:])
+	case "replay-events":
+		return replayEvents(cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, available commands: replay-dlq, replay-events\n", args[0])
+		return 2
+	}
+}
+
+// replayDeadLetters возвращает в основной топик события, которые еще не возвращались из dead letter топика
+func replayDeadLetters(cfg config.Config, args []string) int {
+	flags := flag.NewFlagSet("replay-dlq", flag.ContinueOnError)
+	group := flags.String("group", cfg.KafkaConsumerGroup+"-dlq-replay", "consumer group that stores the replay position")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	producer, err := kafka.NewKafkaProducer(cfg.KafkaBrokers, cfg.KafkaTopic)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect to Kafka:", err)
+		return 1
+	}
+	defer producer.Close()
+
+	replayed, err := kafka.ReplayDeadLetters(cfg.KafkaBrokers, *group, producer.DeadLetterQueue(cfg.KafkaDeadLetterTopic), cfg.KafkaTopic)
+	fmt.Printf("replayed %d events from %s\n", replayed, cfg.KafkaDeadLetterTopic)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// replayEvents перечитывает топик событий с заданного смещения или времени и ставит в очередь доставки
+// вебхукам события, которых они еще не получали. Письма при этом не отправляются
+func replayEvents(cfg config.Config, args []string) int {
+	flags := flag.NewFlagSet("replay-events", flag.ContinueOnError)
+	offset := flags.Int64("offset", -1, "offset in every partition to replay from")
+	since := flags.String("since", "", "replay events published at or after this time (RFC 3339)")
+	partition := flags.Int("partition", -1, "replay only this partition (default: all partitions)")
+	allowWebhooks := flags.Bool("allow-webhooks", false, "confirm that replayed events are sent to partner webhook endpoints")
+	dryRun := flags.Bool("dry-run", false, "only count the events that would be replayed, without running handlers")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	start, err := parseReplayStart(*offset, *since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// События уходят партнерам, поэтому без пробного запуска команда требует явного подтверждения
+	if !*dryRun && !*allowWebhooks {
+		fmt.Fprintln(os.Stderr, "replayed events are sent to partner webhook endpoints, pass -allow-webhooks to run the replay or -dry-run to count events")
+		return 2
+	}
+	var partitions []int32
+	if *partition >= 0 {
+		partitions = []int32{int32(*partition)}
+	}
+
+	counts := map[string]int{}
+	handler := func(envelope events.Envelope) error {
+		counts[envelope.Type]++
+		return nil
+	}
+	if !*dryRun {
+		if err := database.ConnectWithRetry(3, time.Second); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to connect to database:", err)
+			return 1
+		}
+
+		replay := subscribers.Replay(database.DB)
+		handler = func(envelope events.Envelope) error {
+			counts[envelope.Type]++
+			return replay(envelope)
+		}
+	}
+
+	result, err := kafka.ReplayEvents(cfg.KafkaBrokers, cfg.KafkaTopic, partitions, start, handler)
+	if *dryRun {
+		fmt.Printf("dry run: %d events would be replayed to webhooks\n", result.Events)
+	} else {
+		fmt.Printf("replayed %d events to webhooks, %d failed\n", result.Events, result.Failed)
+	}
+	for _, eventType := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Printf("  %-26s %d\n", eventType, counts[eventType])
+	}
+	if result.Skipped > 0 {
+		fmt.Printf("skipped %d messages that could not be decoded\n", result.Skipped)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay failed:", err)
+		return 1
+	}
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseReplayStart позиция начала повторного чтения: нужно задать ровно одно из offset и since
+func parseReplayStart(offset int64, since string) (kafka.ReplayStart, error) {
+	switch {
+	case offset >= 0 && since != "":
+		return kafka.ReplayStart{}, errors.New("use either -offset or -since, not both")
+	case offset >= 0:
+		return kafka.ReplayStart{Offset: offset}, nil
+	case since != "":
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return kafka.ReplayStart{}, fmt.Errorf("invalid -since: %w", err)
+		}
+		return kafka.ReplayStart{Time: t}, nil
+	}
+	return kafka.ReplayStart{}, errors.New("either -offset or -since is required")
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -10,6 +13,87 @@ import (
 type Config struct {
 	ServerPort string
 	DBDSN      string
+	// AdminTwoFactorRequired делает 2FA обязательной для роли admin
+	AdminTwoFactorRequired bool
+	// TOTPIssuer имя сервиса, которое показывается в приложении-аутентификаторе
+	TOTPIssuer string
+
+	// Вход через OpenID Connect включается, если задан OIDCIssuer
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       string
+	// OIDCRoleClaim claim ID токена с группами пользователя, например "groups" или "realm_access.roles"
+	OIDCRoleClaim string
+	// OIDCRoleMapping сопоставление групп ролям вида "library-admins=admin,library-staff=librarian"
+	OIDCRoleMapping string
+	OIDCDefaultRole string
+	// OIDCPostLoginRedirect адрес, на который пользователь перенаправляется после входа
+	OIDCPostLoginRedirect string
+
+	// MailTransport способ доставки писем: smtp, file (.eml файлы в MailDir), log или memory
+	MailTransport string
+	MailFrom      string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPUsername  string
+	SMTPPassword  string
+	// SMTPMode шифрование соединения: tls, starttls или none
+	SMTPMode string
+	MailDir  string
+	// EmailTemplateDir каталог с шаблонами писем, которые заменяют встроенные
+	EmailTemplateDir string
+	// MailConcurrency сколько писем рассылки отправляется одновременно
+	MailConcurrency int
+	// EmailMaxAttempts после стольких неудачных попыток письмо получает статус dead
+	EmailMaxAttempts int
+	// EmailRetryDelay пауза перед первым повтором, каждая следующая вдвое длиннее
+	EmailRetryDelay time.Duration
+	// EmailOutboxInterval как часто воркер проверяет очередь писем
+	EmailOutboxInterval time.Duration
+
+	// DigestCheckInterval как часто проверяется, не пора ли отправить ежедневные и еженедельные дайджесты
+	DigestCheckInterval time.Duration
+
+	// EventBus шина событий: kafka или memory (события обрабатываются внутри процесса, для одного узла и тестов)
+	EventBus string
+	// EventOutboxInterval как часто relay публикует события из outbox в шину событий
+	EventOutboxInterval time.Duration
+	// EventOutboxRetention сколько хранятся отправленные события в outbox, 0 – хранить всегда
+	EventOutboxRetention time.Duration
+	// KafkaBrokers адреса брокеров Kafka
+	KafkaBrokers []string
+	// KafkaTopic топик событий каталога
+	KafkaTopic string
+	// KafkaConsumerGroup consumer group, экземпляры приложения в одной группе делят партиции между собой
+	KafkaConsumerGroup string
+	// KafkaInitialOffset с какой позиции новая группа начинает чтение: newest или oldest
+	KafkaInitialOffset string
+	// KafkaMaxAttempts сколько раз обрабатывается событие, прежде чем оно попадет в dead letter топик
+	KafkaMaxAttempts int
+	// KafkaRetryDelay пауза перед первым повтором обработки, каждая следующая вдвое длиннее
+	KafkaRetryDelay time.Duration
+	// KafkaDeadLetterTopic топик для событий, которые не удалось обработать
+	KafkaDeadLetterTopic string
+	// KafkaDedupWindow сколько помнить id обработанных событий, чтобы не обрабатывать повторно доставленные
+	KafkaDedupWindow time.Duration
+
+	// WebhookMaxAttempts после стольких неудачных попыток доставка вебхуку получает статус failed
+	WebhookMaxAttempts int
+	// WebhookRetryDelay пауза перед первым повтором доставки, каждая следующая вдвое длиннее
+	WebhookRetryDelay time.Duration
+	// WebhookDisableAfter после стольких неудачных доставок подряд вебхук отключается
+	WebhookDisableAfter int
+	// WebhookTimeout таймаут запроса к вебхуку
+	WebhookTimeout time.Duration
+	// WebhookInterval как часто воркер проверяет очередь доставок вебхукам
+	WebhookInterval time.Duration
+
+	// StreamBufferSize сколько последних событий каталога хранится для продолжения потока после переподключения
+	StreamBufferSize int
+	// StreamHeartbeatInterval как часто в поток событий каталога отправляется комментарий, чтобы соединение не закрылось
+	StreamHeartbeatInterval time.Duration
 }
 
 func LoadConfig() Config {
@@ -22,6 +106,59 @@ func LoadConfig() Config {
 	config := Config{
 		ServerPort: getEnv("SERVER_PORT", "8080"),
 		DBDSN:      getEnv("DB_DSN", "localhost"),
+
+		AdminTwoFactorRequired: getEnvBool("ADMIN_2FA_REQUIRED", false),
+		TOTPIssuer:             getEnv("TOTP_ISSUER", "Library"),
+
+		OIDCIssuer:            getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:          getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:      getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:       getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:            getEnv("OIDC_SCOPES", "openid email profile"),
+		OIDCRoleClaim:         getEnv("OIDC_ROLE_CLAIM", ""),
+		OIDCRoleMapping:       getEnv("OIDC_ROLE_MAPPING", ""),
+		OIDCDefaultRole:       getEnv("OIDC_DEFAULT_ROLE", "reader"),
+		OIDCPostLoginRedirect: getEnv("OIDC_POST_LOGIN_REDIRECT", ""),
+
+		MailTransport: getEnv("MAIL_TRANSPORT", "smtp"),
+		MailFrom:      getEnv("MAIL_FROM", getEnv("SMTP_Name", "")),
+		SMTPHost:      getEnv("SMTP_HOST", "smtp.mail.ru"),
+		SMTPPort:      getEnvInt("SMTP_PORT", 465),
+		SMTPUsername:  getEnv("SMTP_Name", ""),
+		SMTPPassword:  getEnv("SMTP_Password", ""),
+		SMTPMode:      getEnv("SMTP_MODE", "tls"),
+		MailDir:       getEnv("MAIL_DIR", "./mail"),
+
+		EmailTemplateDir: getEnv("EMAIL_TEMPLATE_DIR", ""),
+
+		MailConcurrency:     getEnvInt("MAIL_CONCURRENCY", 4),
+		EmailMaxAttempts:    getEnvInt("EMAIL_MAX_ATTEMPTS", 8),
+		EmailRetryDelay:     getEnvDuration("EMAIL_RETRY_DELAY", time.Minute),
+		EmailOutboxInterval: getEnvDuration("EMAIL_OUTBOX_INTERVAL", 10*time.Second),
+
+		DigestCheckInterval: getEnvDuration("DIGEST_CHECK_INTERVAL", 10*time.Minute),
+
+		EventBus:             getEnv("EVENT_BUS", "kafka"),
+		EventOutboxInterval:  getEnvDuration("EVENT_OUTBOX_INTERVAL", time.Second),
+		EventOutboxRetention: getEnvDurationAllowZero("EVENT_OUTBOX_RETENTION", 7*24*time.Hour),
+		KafkaBrokers:         getEnvList("KAFKA_BROKERS", []string{"kafka:9092"}),
+		KafkaTopic:           getEnv("KAFKA_TOPIC", "library-events"),
+		KafkaConsumerGroup:   getEnv("KAFKA_CONSUMER_GROUP", "library"),
+		KafkaInitialOffset:   getEnv("KAFKA_INITIAL_OFFSET", "newest"),
+
+		KafkaMaxAttempts:     getEnvInt("KAFKA_MAX_ATTEMPTS", 5),
+		KafkaRetryDelay:      getEnvDuration("KAFKA_RETRY_DELAY", time.Second),
+		KafkaDeadLetterTopic: getEnv("KAFKA_DLQ_TOPIC", "library-events.dlq"),
+		KafkaDedupWindow:     getEnvDuration("KAFKA_DEDUP_WINDOW", 7*24*time.Hour),
+
+		WebhookMaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookRetryDelay:   getEnvDuration("WEBHOOK_RETRY_DELAY", 30*time.Second),
+		WebhookDisableAfter: getEnvInt("WEBHOOK_DISABLE_AFTER", 20),
+		WebhookTimeout:      getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookInterval:     getEnvDuration("WEBHOOK_INTERVAL", 5*time.Second),
+
+		StreamBufferSize:        getEnvInt("STREAM_BUFFER_SIZE", 1000),
+		StreamHeartbeatInterval: getEnvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
 	}
 
 	return config
@@ -35,3 +172,57 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// getEnvList получает список значений через запятую из переменной окружения или возвращает значение по умолчанию
+func getEnvList(key string, defaultValue []string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values
+}
+
+// getEnvBool получает булево значение переменной окружения или возвращает значение по умолчанию
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(getEnv(key, strconv.FormatBool(defaultValue)))
+	if err != nil {
+		log.Printf("Invalid value of %s, using %t", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvInt получает целое значение переменной окружения или возвращает значение по умолчанию
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		log.Printf("Invalid value of %s, using %d", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDuration получает длительность вида "10m" из переменной окружения или возвращает значение по умолчанию
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil || value <= 0 {
+		log.Printf("Invalid value of %s, using %s", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDurationAllowZero как getEnvDuration, но допускает 0, которым отключается соответствующая функция
+func getEnvDurationAllowZero(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil || value < 0 {
+		log.Printf("Invalid value of %s, using %s", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
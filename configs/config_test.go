@@ -0,0 +1,25 @@
+package config_test
+
+import (
+	config "library/configs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventOutboxRetention(t *testing.T) {
+	// 0 отключает удаление отправленных событий и не заменяется значением по умолчанию
+	t.Setenv("EVENT_OUTBOX_RETENTION", "0")
+	assert.Equal(t, time.Duration(0), config.LoadConfig().EventOutboxRetention)
+
+	t.Setenv("EVENT_OUTBOX_RETENTION", "24h")
+	assert.Equal(t, 24*time.Hour, config.LoadConfig().EventOutboxRetention)
+
+	// Некорректные и отрицательные значения заменяются значением по умолчанию
+	t.Setenv("EVENT_OUTBOX_RETENTION", "-1h")
+	assert.Equal(t, 7*24*time.Hour, config.LoadConfig().EventOutboxRetention)
+
+	t.Setenv("EVENT_OUTBOX_RETENTION", "week")
+	assert.Equal(t, 7*24*time.Hour, config.LoadConfig().EventOutboxRetention)
+}
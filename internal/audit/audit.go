@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"library/internal/models"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RequestIDHeader заголовок с идентификатором запроса
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey ключ, под которым middleware сохраняет идентификатор запроса в gin.Context
+const requestIDKey = "request_id"
+
+// exportBatchSize сколько записей читается из базы за раз при экспорте
+const exportBatchSize = 500
+
+// ErrNotObject снимок сущности должен сериализоваться в JSON объект
+var ErrNotObject = errors.New("audit snapshot is not a JSON object")
+
+// SetRequestID сохраняет идентификатор запроса в контексте
+func SetRequestID(c *gin.Context, id string) {
+	c.Set(requestIDKey, id)
+}
+
+// GetRequestID возвращает идентификатор запроса, сохраненный middleware
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// Meta кто и откуда выполнил запрос
+type Meta struct {
+	Actor     string
+	IP        string
+	RequestID string
+}
+
+// Entry запись журнала аудита в ответах API и в экспорте
+type Entry struct {
+	ID         uint            `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before" swaggertype:"object"`
+	After      json.RawMessage `json:"after" swaggertype:"object"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"request_id"`
+}
+
+// NewEntry запись журнала для ответа API
+func NewEntry(log models.AuditLog) Entry {
+	return Entry{
+		ID:         log.ID,
+		CreatedAt:  log.CreatedAt,
+		Actor:      log.Actor,
+		Action:     log.Action,
+		EntityType: log.EntityType,
+		EntityID:   log.EntityID,
+		Before:     rawJSON(log.Before),
+		After:      rawJSON(log.After),
+		IP:         log.IP,
+		RequestID:  log.RequestID,
+	}
+}
+
+// Filter условия выборки записей журнала. Пустые поля не ограничивают выборку
+type Filter struct {
+	Actor      string
+	EntityType string
+	EntityID   string
+	From       time.Time
+	To         time.Time
+}
+
+// Record сохраняет запись журнала. Тип сущности берется из action до точки ("book.delete" – "book").
+// before и after – снимки сущности до и после изменения (nil для создания и удаления), в запись попадают
+// только различающиеся поля. Вызывается в транзакции изменения, чтобы запись не терялась и не появлялась без него
+func Record(tx *gorm.DB, meta Meta, action string, entityID any, before, after any) error {
+	beforeJSON, afterJSON, err := Diff(before, after)
+	if err != nil {
+		return fmt.Errorf("audit %s: %w", action, err)
+	}
+	entityType, _, _ := strings.Cut(action, ".")
+	return tx.Create(&models.AuditLog{
+		Actor:      meta.Actor,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   fmt.Sprint(entityID),
+		Before:     beforeJSON,
+		After:      afterJSON,
+		IP:         meta.IP,
+		RequestID:  meta.RequestID,
+	}).Error
+}
+
+// Diff возвращает в JSON поля снимков before и after, значения которых различаются.
+// Если один из снимков nil, другой возвращается целиком, а для nil возвращается пустая строка
+func Diff(before, after any) (string, string, error) {
+	beforeFields, err := fields(before)
+	if err != nil {
+		return "", "", err
+	}
+	afterFields, err := fields(after)
+	if err != nil {
+		return "", "", err
+	}
+	if beforeFields != nil && afterFields != nil {
+		for name, value := range beforeFields {
+			if other, ok := afterFields[name]; ok && reflect.DeepEqual(value, other) {
+				delete(beforeFields, name)
+				delete(afterFields, name)
+			}
+		}
+	}
+
+	beforeJSON, err := encode(beforeFields)
+	if err != nil {
+		return "", "", err
+	}
+	afterJSON, err := encode(afterFields)
+	if err != nil {
+		return "", "", err
+	}
+	return beforeJSON, afterJSON, nil
+}
+
+// Query выборка записей журнала по filter в порядке создания
+func Query(db *gorm.DB, filter Filter) *gorm.DB {
+	query := db.Model(&models.AuditLog{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.EntityType != "" {
+		query = query.Where("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		query = query.Where("entity_id = ?", filter.EntityID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	return query.Order("id")
+}
+
+// Export записывает в w записи журнала по filter в формате JSON Lines, читая их из базы частями
+func Export(db *gorm.DB, filter Filter, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	var logs []models.AuditLog
+	var writeErr error
+	result := Query(db, filter).FindInBatches(&logs, exportBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, log := range logs {
+			if writeErr = encoder.Encode(NewEntry(log)); writeErr != nil {
+				return writeErr
+			}
+		}
+		return nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return result.Error
+}
+
+// fields снимок сущности в виде JSON объекта
+func fields(snapshot any) (map[string]any, error) {
+	if snapshot == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]any
+	if err := json.Unmarshal(data, &result); err != nil || result == nil {
+		return nil, ErrNotObject
+	}
+	return result, nil
+}
+
+func encode(fields map[string]any) (string, error) {
+	if fields == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(fields)
+	return string(data), err
+}
+
+// rawJSON значение для ответа API: пустой снимок возвращается как null
+func rawJSON(value string) json.RawMessage {
+	if value == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(value)
+}
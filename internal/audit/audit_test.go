@@ -0,0 +1,88 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"library/internal/audit"
+	"library/internal/database"
+	"library/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type book struct {
+	ID     uint     `json:"id"`
+	Title  string   `json:"title"`
+	Author string   `json:"author"`
+	Genres []string `json:"genres"`
+}
+
+func TestDiff(t *testing.T) {
+	before, after, err := audit.Diff(
+		book{ID: 1, Title: "Старое", Author: "Автор", Genres: []string{"Детектив"}},
+		book{ID: 1, Title: "Новое", Author: "Автор", Genres: []string{"Детектив", "Роман"}},
+	)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"title": "Старое", "genres": ["Детектив"]}`, before)
+	assert.JSONEq(t, `{"title": "Новое", "genres": ["Детектив", "Роман"]}`, after)
+
+	// При создании и удалении сохраняется весь снимок
+	before, after, err = audit.Diff(nil, book{ID: 2, Title: "Книга"})
+	require.NoError(t, err)
+	assert.Empty(t, before)
+	assert.JSONEq(t, `{"id": 2, "title": "Книга", "author": "", "genres": null}`, after)
+
+	_, _, err = audit.Diff([]string{"not", "an", "object"}, nil)
+	assert.ErrorIs(t, err, audit.ErrNotObject)
+}
+
+func TestRecordQueryAndExport(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	admin := audit.Meta{Actor: "user:1", IP: "10.0.0.1", RequestID: "req-1"}
+	require.NoError(t, audit.Record(db, admin, "book.update", 7, book{ID: 7, Title: "Старое"}, book{ID: 7, Title: "Новое"}))
+	require.NoError(t, audit.Record(db, admin, "book.delete", 8, book{ID: 8, Title: "Удаленная"}, nil))
+	require.NoError(t, audit.Record(db, audit.Meta{Actor: "apikey:3"}, "webhook.create", 1, nil, map[string]string{"url": "https://partner.example.com"}))
+
+	var log models.AuditLog
+	require.NoError(t, db.Where("action = ?", "book.update").First(&log).Error)
+	assert.Equal(t, "book", log.EntityType)
+	assert.Equal(t, "7", log.EntityID)
+	assert.Equal(t, "10.0.0.1", log.IP)
+	assert.Equal(t, "req-1", log.RequestID)
+	assert.JSONEq(t, `{"title": "Старое"}`, log.Before)
+
+	var logs []models.AuditLog
+	require.NoError(t, audit.Query(db, audit.Filter{Actor: "user:1", EntityType: "book", EntityID: "8"}).Find(&logs).Error)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "book.delete", logs[0].Action)
+		assert.Empty(t, logs[0].After)
+	}
+
+	var count int64
+	require.NoError(t, audit.Query(db, audit.Filter{From: time.Now().Add(time.Hour)}).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, audit.Query(db, audit.Filter{To: time.Now().Add(time.Hour)}).Count(&count).Error)
+	assert.Equal(t, int64(3), count)
+
+	var buf bytes.Buffer
+	require.NoError(t, audit.Export(db, audit.Filter{EntityType: "book"}, &buf))
+	var entries []audit.Entry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry audit.Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "book.update", entries[0].Action)
+		assert.JSONEq(t, `{"title": "Новое"}`, string(entries[0].After))
+		assert.Equal(t, "null", string(entries[1].After))
+	}
+}
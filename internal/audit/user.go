@@ -0,0 +1,29 @@
+package audit
+
+import "library/internal/models"
+
+// UserSnapshot поля пользователя, которые попадают в журнал аудита. Пароль и секреты не записываются
+type UserSnapshot struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Role        string `json:"role"`
+	Mailing     bool   `json:"mailing"`
+	Frequency   string `json:"mailing_frequency"`
+	Locale      string `json:"locale"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+}
+
+// NewUserSnapshot снимок пользователя для журнала аудита
+func NewUserSnapshot(user models.User) UserSnapshot {
+	return UserSnapshot{
+		ID:          user.ID,
+		Name:        user.Name,
+		Email:       user.Email,
+		Role:        user.Role,
+		Mailing:     user.Mailing,
+		Frequency:   user.MailingFrequency,
+		Locale:      user.Locale,
+		TOTPEnabled: user.TOTPEnabled,
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"library/internal/models"
+	"library/logger"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// APIKeyPrefix отличает API ключи от JWT в заголовке Authorization
+	APIKeyPrefix = "lib_"
+	// apiKeyTouchInterval как часто обновляется время последнего использования ключа
+	apiKeyTouchInterval = time.Minute
+)
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// GenerateAPIKey создает новый API ключ. Ключ показывается пользователю один раз, в базе хранится его хэш
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// IsAPIKey проверяет, похожа ли строка на API ключ
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// AuthenticateAPIKey проверяет API ключ и возвращает claims с разрешениями ключа
+func AuthenticateAPIKey(db *gorm.DB, key string) (*MyClaims, error) {
+	var apiKey models.APIKey
+	if err := db.Where("key_hash = ?", HashToken(key)).First(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if err := db.Model(&apiKey).UpdateColumn("last_used_at", time.Now()).Error; err != nil {
+			logger.ErrorLog.Println("Failed to update last usage of api key", apiKey.ID, "\tError:", err)
+		}
+	}
+
+	return &MyClaims{
+		APIKeyID: apiKey.ID,
+		Scopes:   SplitScopes(apiKey.Scopes),
+	}, nil
+}
+
+// SplitScopes разбирает список разрешений API ключа
+func SplitScopes(scopes string) []string {
+	result := []string{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"library/logger"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cookieSameSite режим SameSite для cookie из COOKIE_SAMESITE (lax, strict или none), по умолчанию lax.
+// Lax не отправляет cookie в POST запросах с чужих сайтов, но сохраняет вход при переходе по ссылке из письма
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// cookieSecure отправлять cookie только по HTTPS. SameSite=None браузеры принимают только с Secure
+func cookieSecure() bool {
+	secure, _ := strconv.ParseBool(os.Getenv("COOKIE_SECURE"))
+	return secure || cookieSameSite() == http.SameSiteNoneMode
+}
+
+// SetCookie устанавливает cookie с общими для приложения domain, SameSite и Secure
+func SetCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	c.SetSameSite(cookieSameSite())
+	c.SetCookie(name, value, maxAge, "/", os.Getenv("domain"), cookieSecure(), httpOnly)
+}
+
+// SetJWTCookie сохраняет JWT в cookie
+func SetJWTCookie(c *gin.Context, jwtToken string) {
+	timeSec, err := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
+	if err != nil {
+		logger.ErrorLog.Println("Failed get `JWTCoo_expires_time_sec` in .env when setting auth cookies\tError:", err)
+	}
+	SetCookie(c, "jwt", jwtToken, timeSec, true)
+}
+
+// ClearAuthCookies удаляет JWT и refresh токен из cookie
+func ClearAuthCookies(c *gin.Context) {
+	SetCookie(c, "refreshToken", "", -1, true)
+	SetCookie(c, "jwt", "", -1, true)
+}
+
+func setAuthCookies(c *gin.Context, jwtToken, refreshToken string) {
+	SetJWTCookie(c, jwtToken)
+	SetCookie(c, "refreshToken", refreshToken, int(sessionLifetime.Seconds()), true)
+}
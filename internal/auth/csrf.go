@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CSRFCookieName cookie с CSRF токеном. Она доступна JavaScript, чтобы клиент мог отправить токен в заголовке
+	CSRFCookieName = "csrf_token"
+	// CSRFHeaderName заголовок, в котором клиент возвращает CSRF токен
+	CSRFHeaderName = "X-CSRF-Token"
+	// CSRFFormField поле HTML формы с CSRF токеном
+	CSRFFormField = "csrf_token"
+	// csrfTokenKey ключ, под которым middleware сохраняет CSRF токен в gin.Context
+	csrfTokenKey = "csrf_token"
+)
+
+// GenerateCSRFToken генерирует случайный CSRF токен
+func GenerateCSRFToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// SetCSRFCookie сохраняет CSRF токен в cookie и в контексте запроса
+func SetCSRFCookie(c *gin.Context, token string) {
+	SetCookie(c, CSRFCookieName, token, int(sessionLifetime.Seconds()), false)
+	c.Set(csrfTokenKey, token)
+}
+
+// GetCSRFToken возвращает CSRF токен текущего запроса
+func GetCSRFToken(c *gin.Context) string {
+	if token := c.GetString(csrfTokenKey); token != "" {
+		return token
+	}
+	token, _ := c.Cookie(CSRFCookieName)
+	return token
+}
@@ -3,7 +3,6 @@ package auth
 import (
 	"fmt"
 	"library/internal/models"
-	"library/logger"
 	"os"
 	"strconv"
 	"time"
@@ -11,18 +10,30 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"gorm.io/gorm"
 )
 
-var jwtSecret []byte
-
 type MyClaims struct {
-	Role    string `json:"role"`
-	Mailing bool   `json:"mailing"`
+	Role      string `json:"role"`
+	Mailing   bool   `json:"mailing"`
+	SessionID uint   `json:"sid,omitempty"`
 	jwt.RegisteredClaims
+
+	// Заполняются только при аутентификации по API ключу и не попадают в JWT
+	APIKeyID uint     `json:"-"`
+	Scopes   []string `json:"-"`
+}
+
+// IsAPIKey сообщает, что запрос аутентифицирован API ключом, а не пользователем
+func (c *MyClaims) IsAPIKey() bool {
+	return c.APIKeyID != 0
 }
 
 func GenerateJWT(user models.User) (string, error) {
+	return GenerateSessionJWT(user, 0)
+}
+
+// GenerateSessionJWT создает JWT, привязанный к сессии пользователя
+func GenerateSessionJWT(user models.User, sessionID uint) (string, error) {
 	timeSec, err := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
 	if err != nil {
 		return "", err
@@ -30,24 +41,37 @@ func GenerateJWT(user models.User) (string, error) {
 	expirationTime := time.Now().Add(time.Duration(timeSec) * time.Second)
 
 	claims := &MyClaims{
-		Role:    user.Role,
-		Mailing: user.Mailing,
+		Role:      user.Role,
+		Mailing:   user.Mailing,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   fmt.Sprintf("%d", user.ID),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(os.Getenv("jwtSecret")))
+	return currentKeySet().sign(claims)
+}
+
+// ParseJWT проверяет подпись и срок действия JWT и возвращает его claims.
+// Это единственное место, где проверяются токены, выданные GenerateJWT
+func ParseJWT(tokenString string) (*MyClaims, error) {
+	set := currentKeySet()
+	token, err := jwt.ParseWithClaims(tokenString, &MyClaims{}, set.keyFunc, jwt.WithValidMethods(set.validMethods()))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*MyClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid claims")
+	}
+	return claims, nil
 }
 
 func ValidateJWT(tokenString string) (jwt.MapClaims, error) {
-	jwtSecret = []byte(os.Getenv("jwtSecret"))
+	set := currentKeySet()
 	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, set.keyFunc, jwt.WithValidMethods(set.validMethods()))
 	if err != nil || !token.Valid {
 		return nil, err
 	}
@@ -58,42 +82,20 @@ func GenerateRefreshToken() string {
 	return uuid.New().String()
 }
 
-func UpdateJWTToken(c *gin.Context, db *gorm.DB) (string, error) {
-	refreshToken, err := c.Cookie("refreshToken")
-	if err != nil || refreshToken == "" {
-		logger.InfoLog.Println("Error when trying to update JWT token\tError:", err)
-		return "", fmt.Errorf("refresh token not found")
-	}
-
-	var user models.User
-
-	if err = db.Where("refresh_token = ?", refreshToken).First(&user).Error; err != nil {
-		logger.InfoLog.Println("Error when trying to find refresher token in db\tError:", err)
-		return "", fmt.Errorf("invalid refresh token")
-	}
+// claimsKey ключ, под которым middleware сохраняет claims пользователя в gin.Context
+const claimsKey = "claims"
 
-	if user.ExpiresAt.Before(time.Now()) {
-		return "", fmt.Errorf("refresh token expired")
-	}
-
-	refreshToken = GenerateRefreshToken()
-	user.RefreshToken = refreshToken
-	user.ExpiresAt = time.Now().Add(720 * time.Hour)
-	c.SetCookie("refreshToken", refreshToken, 2592000, "/", os.Getenv("domain"), false, true)
-	if err = db.Save(user).Error; err != nil {
-		logger.ErrorLog.Println("Faile to update save user with update refresh token and expired time id DB\tError:", err)
-		return "", fmt.Errorf("failed to update refrest token")
-	}
+// SetClaims сохраняет claims аутентифицированного пользователя в контексте запроса
+func SetClaims(c *gin.Context, claims *MyClaims) {
+	c.Set(claimsKey, claims)
+}
 
-	jwtToken, err := GenerateJWT(user)
-	if err != nil {
-		logger.ErrorLog.Println("Failed to generate new JWT token\tError:", err)
-		return "", err
-	}
-	timeSec, err := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
-	if err != nil {
-		logger.ErrorLog.Println("Failed get `JWTCoo_expires_time_sec` in .env when login user\tError:", err)
+// GetClaims возвращает claims, сохраненные middleware аутентификации
+func GetClaims(c *gin.Context) (*MyClaims, bool) {
+	value, exists := c.Get(claimsKey)
+	if !exists {
+		return nil, false
 	}
-	c.SetCookie("jwt", jwtToken, timeSec, "/", os.Getenv("domain"), false, true)
-	return jwtToken, nil
+	claims, ok := value.(*MyClaims)
+	return claims, ok
 }
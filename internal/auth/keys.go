@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey ключ, которым подписываются и проверяются JWT
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet набор ключей JWT. Токены подписываются активным ключом, а проверяются любым ключом из набора,
+// поэтому при ротации уже выданные токены остаются действительными, пока старый ключ лежит в каталоге
+type KeySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+	// hmacSecret используется для токенов HS256 в режиме без асимметричных ключей. После включения RS256/EdDSA
+	// токены HS256 принимаются только до hmacUntil, если переходный период явно задан JWT_ACCEPT_HS256_UNTIL
+	hmacSecret []byte
+	hmacOnly   bool
+	hmacUntil  time.Time
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+)
+
+// JWK публичный ключ в формате RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS набор публичных ключей для /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeys загружает ключи из каталога JWT_KEYS_DIR. Каждый файл <kid>.pem содержит приватный ключ
+// RSA (RS256) или Ed25519 (EdDSA) в формате PKCS#8 или PKCS#1. Активный ключ задается JWT_ACTIVE_KID,
+// по умолчанию берется последний по имени. Без JWT_KEYS_DIR токены подписываются HS256 секретом jwtSecret.
+// С JWT_KEYS_DIR токены HS256 не принимаются, если JWT_ACCEPT_HS256_UNTIL (RFC3339) не продлевает их прием
+// на время перехода
+func LoadKeys() error {
+	var hmacUntil time.Time
+	if value := os.Getenv("JWT_ACCEPT_HS256_UNTIL"); value != "" {
+		var err error
+		if hmacUntil, err = time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("invalid JWT_ACCEPT_HS256_UNTIL: %w", err)
+		}
+	}
+	set, err := loadKeySet(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_ACTIVE_KID"), os.Getenv("jwtSecret"), hmacUntil)
+	if err != nil {
+		return err
+	}
+	SetKeySet(set)
+	return nil
+}
+
+// SetKeySet заменяет текущий набор ключей
+func SetKeySet(set *KeySet) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	keySet = set
+}
+
+// currentKeySet возвращает загруженный набор ключей. Если LoadKeys не вызывался, используется HS256 с jwtSecret
+func currentKeySet() *KeySet {
+	keySetMu.RLock()
+	set := keySet
+	keySetMu.RUnlock()
+	if set != nil {
+		return set
+	}
+	return &KeySet{hmacSecret: []byte(os.Getenv("jwtSecret")), hmacOnly: true}
+}
+
+func loadKeySet(dir, activeKid, hmacSecret string, hmacUntil time.Time) (*KeySet, error) {
+	if dir == "" {
+		return &KeySet{hmacSecret: []byte(hmacSecret), hmacOnly: true}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.pem keys found in %s", dir)
+	}
+	sort.Strings(files)
+
+	set := &KeySet{keys: map[string]*signingKey{}}
+	if hmacSecret != "" && !hmacUntil.IsZero() {
+		set.hmacSecret = []byte(hmacSecret)
+		set.hmacUntil = hmacUntil
+	}
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		key, err := loadSigningKey(file, kid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", file, err)
+		}
+		set.keys[kid] = key
+		if activeKid == "" {
+			set.active = key
+		}
+	}
+	if activeKid != "" {
+		active, ok := set.keys[activeKid]
+		if !ok {
+			return nil, fmt.Errorf("active key %q not found in %s", activeKid, dir)
+		}
+		set.active = active
+	}
+	return set, nil
+}
+
+func loadSigningKey(file, kid string) (*signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+
+	var private interface{}
+	private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newSigningKey(kid, private)
+}
+
+func newSigningKey(kid string, private interface{}) (*signingKey, error) {
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: key, public: key.Public()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+}
+
+// NewKeySet создает набор ключей из уже загруженных приватных ключей, подписывая токены ключом activeKid
+func NewKeySet(keys map[string]crypto.Signer, activeKid string) (*KeySet, error) {
+	set := &KeySet{keys: map[string]*signingKey{}}
+	for kid, private := range keys {
+		key, err := newSigningKey(kid, private)
+		if err != nil {
+			return nil, err
+		}
+		set.keys[kid] = key
+	}
+	active, ok := set.keys[activeKid]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found", activeKid)
+	}
+	set.active = active
+	return set, nil
+}
+
+// sign подписывает claims активным ключом
+func (s *KeySet) sign(claims jwt.Claims) (string, error) {
+	if s.hmacOnly {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.hmacSecret)
+	}
+	token := jwt.NewWithClaims(s.active.method, claims)
+	token.Header["kid"] = s.active.kid
+	return token.SignedString(s.active.private)
+}
+
+// keyFunc выбирает ключ проверки по заголовкам kid и alg
+func (s *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if s.acceptsHMAC() {
+			return s.hmacSecret, nil
+		}
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	if s.hmacOnly {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+	return key.public, nil
+}
+
+// validMethods алгоритмы, которые принимает верификатор
+func (s *KeySet) validMethods() []string {
+	methods := []string{}
+	if s.acceptsHMAC() {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, key := range s.keys {
+		if !slices.Contains(methods, key.method.Alg()) {
+			methods = append(methods, key.method.Alg())
+		}
+	}
+	return methods
+}
+
+// acceptsHMAC принимаются ли сейчас токены HS256
+func (s *KeySet) acceptsHMAC() bool {
+	return s.hmacOnly || (s.hmacSecret != nil && time.Now().Before(s.hmacUntil))
+}
+
+// JWKS возвращает публичные ключи набора. HS256 секрет никогда не публикуется
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	kids := make([]string, 0, len(s.keys))
+	for kid := range s.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	for _, kid := range kids {
+		key := s.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// CurrentJWKS возвращает публичные ключи текущего набора
+func CurrentJWKS() JWKS {
+	return currentKeySet().JWKS()
+}
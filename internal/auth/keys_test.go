@@ -0,0 +1,122 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"library/internal/auth"
+	"library/internal/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func writeKey(t *testing.T, dir, kid string, key interface{}) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kid+".pem"), pemBytes, 0600))
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer auth.SetKeySet(nil)
+	t.Setenv("JWTCoo_expires_time_sec", "60")
+	t.Setenv("jwtSecret", "")
+
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writeKey(t, dir, "2025-01", rsaKey)
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	require.NoError(t, auth.LoadKeys())
+
+	user := models.User{Model: gorm.Model{ID: 7}, Role: "reader"}
+	oldToken, err := auth.GenerateJWT(user)
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(oldToken, &auth.MyClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", parsed.Method.Alg())
+	assert.Equal(t, "2025-01", parsed.Header["kid"])
+
+	// Новый ключ становится активным, старый остается для проверки уже выданных токенов
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeKey(t, dir, "2025-06", edKey)
+	t.Setenv("JWT_ACTIVE_KID", "2025-06")
+	require.NoError(t, auth.LoadKeys())
+
+	newToken, err := auth.GenerateJWT(user)
+	require.NoError(t, err)
+	parsed, _, err = jwt.NewParser().ParseUnverified(newToken, &auth.MyClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", parsed.Method.Alg())
+
+	for _, token := range []string{oldToken, newToken} {
+		claims, err := auth.ParseJWT(token)
+		require.NoError(t, err)
+		assert.Equal(t, "7", claims.Subject)
+	}
+
+	jwks := auth.CurrentJWKS()
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "RSA", jwks.Keys[0].Kty)
+	assert.Equal(t, "OKP", jwks.Keys[1].Kty)
+
+	// HS256 токен с пустым секретом не принимается, когда включены асимметричные ключи
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.MyClaims{Role: "admin"}).SignedString([]byte(""))
+	require.NoError(t, err)
+	_, err = auth.ParseJWT(forged)
+	assert.Error(t, err)
+
+	// После удаления старого ключа его токены перестают проверяться
+	require.NoError(t, os.Remove(filepath.Join(dir, "2025-01.pem")))
+	require.NoError(t, auth.LoadKeys())
+	_, err = auth.ParseJWT(oldToken)
+	assert.Error(t, err)
+	_, err = auth.ParseJWT(newToken)
+	assert.NoError(t, err)
+}
+
+func TestHS256Transition(t *testing.T) {
+	defer auth.SetKeySet(nil)
+	t.Setenv("JWTCoo_expires_time_sec", "60")
+	t.Setenv("jwtSecret", "old-shared-secret")
+
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeKey(t, dir, "2025-01", edKey)
+	t.Setenv("JWT_KEYS_DIR", dir)
+
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.MyClaims{Role: "admin"}).SignedString([]byte("old-shared-secret"))
+	require.NoError(t, err)
+
+	// По умолчанию jwtSecret остается только ключом ссылок отписки, и токены HS256 отклоняются
+	require.NoError(t, auth.LoadKeys())
+	_, err = auth.ParseJWT(legacy)
+	assert.Error(t, err)
+
+	// В явно заданный переходный период старые токены принимаются
+	t.Setenv("JWT_ACCEPT_HS256_UNTIL", time.Now().Add(time.Hour).Format(time.RFC3339))
+	require.NoError(t, auth.LoadKeys())
+	_, err = auth.ParseJWT(legacy)
+	assert.NoError(t, err)
+
+	// После его окончания – снова нет
+	t.Setenv("JWT_ACCEPT_HS256_UNTIL", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	require.NoError(t, auth.LoadKeys())
+	_, err = auth.ParseJWT(legacy)
+	assert.Error(t, err)
+
+	t.Setenv("JWT_ACCEPT_HS256_UNTIL", "tomorrow")
+	assert.Error(t, auth.LoadKeys())
+}
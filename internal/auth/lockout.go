@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"library/internal/cache"
+	"strings"
+	"time"
+)
+
+// Параметры защиты входа от перебора паролей
+const (
+	// loginFailureWindow время, в течение которого учитываются неудачные попытки входа
+	loginFailureWindow = 15 * time.Minute
+	// accountBackoffAfter после этого числа неудачных попыток между попытками появляется задержка
+	accountBackoffAfter = 3
+	// accountBackoffBase задержка после первой попытки сверх accountBackoffAfter, дальше она удваивается
+	accountBackoffBase = time.Second
+	// accountLockAfter после этого числа неудачных попыток аккаунт временно блокируется
+	accountLockAfter = 10
+	// ipLockAfter после этого числа неудачных попыток с одного IP он временно блокируется
+	ipLockAfter = 50
+	// loginLockDuration длительность временной блокировки аккаунта или IP
+	loginLockDuration = 15 * time.Minute
+)
+
+func accountFailuresKey(email string) string { return "login_fail:account:" + normalizeEmail(email) }
+func accountBlockKey(email string) string    { return "login_block:account:" + normalizeEmail(email) }
+func ipFailuresKey(ip string) string         { return "login_fail:ip:" + ip }
+func ipBlockKey(ip string) string            { return "login_block:ip:" + ip }
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// LoginRetryAfter возвращает, сколько нужно подождать до следующей попытки входа для аккаунта и IP.
+// Ноль означает, что попытка разрешена
+func LoginRetryAfter(email, ip string) (time.Duration, error) {
+	accountWait, err := cache.TTL(accountBlockKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := cache.TTL(ipBlockKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	return max(accountWait, ipWait), nil
+}
+
+// RegisterLoginFailure учитывает неудачную попытку входа и при необходимости задерживает или блокирует
+// следующие попытки. Возвращает true, если именно эта попытка привела к блокировке аккаунта
+func RegisterLoginFailure(email, ip string) (bool, error) {
+	ipFailures, err := cache.Increment(ipFailuresKey(ip), loginFailureWindow)
+	if err != nil {
+		return false, err
+	}
+	if ipFailures >= ipLockAfter {
+		if err := cache.SetWithTTL(ipBlockKey(ip), "locked", loginLockDuration); err != nil {
+			return false, err
+		}
+	}
+
+	accountFailures, err := cache.Increment(accountFailuresKey(email), loginFailureWindow)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case accountFailures >= accountLockAfter:
+		if err := cache.SetWithTTL(accountBlockKey(email), "locked", loginLockDuration); err != nil {
+			return false, err
+		}
+		return accountFailures == accountLockAfter, nil
+	case accountFailures >= accountBackoffAfter:
+		backoff := accountBackoffBase << (accountFailures - accountBackoffAfter)
+		if err := cache.SetWithTTL(accountBlockKey(email), "backoff", backoff); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// ResetLoginFailures сбрасывает счетчик неудачных попыток аккаунта после успешного входа
+func ResetLoginFailures(email string) error {
+	return cache.Delete(accountFailuresKey(email), accountBlockKey(email))
+}
+
+// UnlockAccount снимает блокировку аккаунта, установленную из-за неудачных попыток входа
+func UnlockAccount(email string) error {
+	return ResetLoginFailures(email)
+}
+
+// LoginLockDuration длительность временной блокировки аккаунта
+func LoginLockDuration() time.Duration {
+	return loginLockDuration
+}
@@ -0,0 +1,57 @@
+package auth_test
+
+import (
+	"library/internal/auth"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockout(t *testing.T) {
+	email, ip := "lockout@example.com", "10.0.0.1"
+	defer auth.UnlockAccount(email)
+
+	// Первые неудачные попытки не задерживают следующие
+	for i := 0; i < 2; i++ {
+		locked, err := auth.RegisterLoginFailure(email, ip)
+		require.NoError(t, err)
+		assert.False(t, locked)
+	}
+	wait, err := auth.LoginRetryAfter(email, ip)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// Дальше появляется растущая задержка
+	locked, err := auth.RegisterLoginFailure(email, ip)
+	require.NoError(t, err)
+	assert.False(t, locked)
+	wait, err = auth.LoginRetryAfter(email, ip)
+	require.NoError(t, err)
+	assert.Greater(t, wait.Nanoseconds(), int64(0))
+
+	// Десятая попытка блокирует аккаунт
+	for i := 3; i < 9; i++ {
+		locked, err = auth.RegisterLoginFailure(email, ip)
+		require.NoError(t, err)
+		assert.False(t, locked)
+	}
+	locked, err = auth.RegisterLoginFailure(email, ip)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	wait, err = auth.LoginRetryAfter(email, ip)
+	require.NoError(t, err)
+	assert.Greater(t, wait, auth.LoginLockDuration()-auth.LoginLockDuration()/10)
+
+	// Другой аккаунт с того же IP не блокируется
+	wait, err = auth.LoginRetryAfter("other@example.com", ip)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// Администратор снимает блокировку
+	require.NoError(t, auth.UnlockAccount(email))
+	wait, err = auth.LoginRetryAfter(email, ip)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// sessionLifetime время жизни сессии без использования refresh токена
+	sessionLifetime = 720 * time.Hour
+	// refreshReuseGrace время, в течение которого повторное предъявление только что
+	// ротированного токена считается гонкой параллельных запросов, а не кражей
+	refreshReuseGrace = 10 * time.Second
+	// sessionStatusTTL сколько проверка JWT доверяет закэшированному статусу сессии. После отзыва кэш
+	// сбрасывается, а TTL ограничивает задержку, если сбросить его не удалось
+	sessionStatusTTL = 30 * time.Second
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrInvalidRefreshToken  = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected")
+	ErrSessionRevoked       = errors.New("session is revoked")
+
+	// errRefreshTokenRotated токен успел ротировать другой запрос
+	errRefreshTokenRotated = errors.New("refresh token already rotated")
+)
+
+// HashToken возвращает sha256 хэш токена, который хранится в базе данных вместо самого токена
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// TokenPair токены, которые выдаются клиентам без cookie
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type" example:"Bearer"`
+	ExpiresIn    int    `json:"expires_in" example:"1500"`
+}
+
+func newTokenPair(accessToken, refreshToken string) TokenPair {
+	timeSec, _ := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    timeSec,
+	}
+}
+
+// CreateSession создает новую сессию пользователя, выдает refresh и JWT токены и сохраняет их в cookie
+func CreateSession(c *gin.Context, db *gorm.DB, user models.User, deviceLabel string) (models.Session, TokenPair, error) {
+	session := models.Session{
+		UserID:      user.ID,
+		DeviceLabel: deviceLabel,
+		IP:          c.ClientIP(),
+		UserAgent:   truncate(c.Request.UserAgent(), 255),
+		LastUsedAt:  time.Now(),
+		ExpiresAt:   time.Now().Add(sessionLifetime),
+	}
+	refreshToken := GenerateRefreshToken()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.RefreshToken{SessionID: session.ID, TokenHash: HashToken(refreshToken)}).Error
+	})
+	if err != nil {
+		return session, TokenPair{}, err
+	}
+
+	jwtToken, err := GenerateSessionJWT(user, session.ID)
+	if err != nil {
+		return session, TokenPair{}, err
+	}
+	setAuthCookies(c, jwtToken, refreshToken)
+	return session, newTokenPair(jwtToken, refreshToken), nil
+}
+
+// UpdateJWTToken ротирует refresh токен из cookie и выдает новый JWT
+func UpdateJWTToken(c *gin.Context, db *gorm.DB) (string, error) {
+	refreshToken, err := c.Cookie("refreshToken")
+	if err != nil || refreshToken == "" {
+		logger.InfoLog.Println("Error when trying to update JWT token\tError:", err)
+		return "", ErrRefreshTokenNotFound
+	}
+
+	tokens, err := RotateRefreshToken(c, db, refreshToken)
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// RotateRefreshToken заменяет refresh токен новым и выдает новый JWT, сохраняя оба в cookie.
+// Повторное использование уже ротированного токена отзывает всю сессию
+func RotateRefreshToken(c *gin.Context, db *gorm.DB, refreshToken string) (TokenPair, error) {
+	var storedToken models.RefreshToken
+	if err := db.Where("token_hash = ?", HashToken(refreshToken)).First(&storedToken).Error; err != nil {
+		logger.InfoLog.Println("Error when trying to find refresh token in db\tError:", err)
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	var session models.Session
+	if err := db.First(&session, storedToken.SessionID).Error; err != nil {
+		logger.InfoLog.Println("Error when trying to find session of refresh token\tError:", err)
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	if session.RevokedAt != nil {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	if session.ExpiresAt.Before(time.Now()) {
+		return TokenPair{}, ErrRefreshTokenExpired
+	}
+
+	if storedToken.RotatedAt != nil {
+		return TokenPair{}, handleTokenReuse(db, session, storedToken)
+	}
+
+	var user models.User
+	if err := db.First(&user, session.UserID).Error; err != nil {
+		logger.InfoLog.Println("Error when trying to find user of session\tError:", err)
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	refreshToken = GenerateRefreshToken()
+	// Старый токен помечается ротированным в той же транзакции, в которой выдается новый,
+	// поэтому при сбое сессия не остается без действующего refresh токена
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Условие rotated_at IS NULL не дает двум параллельным запросам ротировать один и тот же токен
+		result := tx.Model(&models.RefreshToken{}).Where("id = ? AND rotated_at IS NULL", storedToken.ID).Update("rotated_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenRotated
+		}
+		if err := tx.Create(&models.RefreshToken{SessionID: session.ID, TokenHash: HashToken(refreshToken)}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&session).Updates(models.Session{
+			LastUsedAt: now,
+			ExpiresAt:  now.Add(sessionLifetime),
+			IP:         c.ClientIP(),
+			UserAgent:  truncate(c.Request.UserAgent(), 255),
+		}).Error
+	})
+	if errors.Is(err, errRefreshTokenRotated) {
+		storedToken.RotatedAt = &now
+		return TokenPair{}, handleTokenReuse(db, session, storedToken)
+	}
+	if err != nil {
+		logger.ErrorLog.Println("Failed to save rotated refresh token in DB\tError:", err)
+		return TokenPair{}, fmt.Errorf("failed to update refresh token")
+	}
+
+	jwtToken, err := GenerateSessionJWT(user, session.ID)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to generate new JWT token\tError:", err)
+		return TokenPair{}, err
+	}
+	setAuthCookies(c, jwtToken, refreshToken)
+	return newTokenPair(jwtToken, refreshToken), nil
+}
+
+// handleTokenReuse отзывает сессию, если ротированный токен предъявлен повторно
+func handleTokenReuse(db *gorm.DB, session models.Session, token models.RefreshToken) error {
+	if time.Since(*token.RotatedAt) < refreshReuseGrace {
+		logger.InfoLog.Printf("Refresh token of session %d was rotated by a concurrent request", session.ID)
+		return ErrInvalidRefreshToken
+	}
+
+	logger.InfoLog.Printf("Reuse of rotated refresh token detected, revoking session %d of user %d", session.ID, session.UserID)
+	if err := RevokeSession(db, session.ID); err != nil {
+		logger.ErrorLog.Println("Failed to revoke session after refresh token reuse\tError:", err)
+	} else {
+		ForgetSessionStatus(session.ID)
+	}
+	return ErrRefreshTokenReused
+}
+
+// RevokeSession отзывает сессию вместе со всеми её refresh токенами
+func RevokeSession(db *gorm.DB, sessionID uint) error {
+	return db.Model(&models.Session{}).Where("id = ? AND revoked_at IS NULL", sessionID).Update("revoked_at", time.Now()).Error
+}
+
+func sessionStatusKey(sessionID uint) string {
+	return "session_status:" + strconv.FormatUint(uint64(sessionID), 10)
+}
+
+// CheckSession возвращает ErrSessionRevoked, если сессия, для которой выдан JWT, отозвана или удалена.
+// Статус сессии кэшируется в Redis на sessionStatusTTL, чтобы не обращаться к базе на каждый запрос
+func CheckSession(db *gorm.DB, sessionID uint) error {
+	status, ok, err := cache.GetString(sessionStatusKey(sessionID))
+	if err != nil {
+		logger.ErrorLog.Println("Failed to get cached status of session", sessionID, "\tError:", err)
+	}
+	if !ok {
+		var session models.Session
+		err := db.Select("id", "revoked_at").First(&session, sessionID).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = "revoked"
+		case err != nil:
+			return err
+		case session.RevokedAt != nil:
+			status = "revoked"
+		default:
+			status = "active"
+		}
+		if err := cache.SetWithTTL(sessionStatusKey(sessionID), status, sessionStatusTTL); err != nil {
+			logger.ErrorLog.Println("Failed to cache status of session", sessionID, "\tError:", err)
+		}
+	}
+	if status != "active" {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// ForgetSessionStatus сбрасывает закэшированный статус сессии. Вызывается после фиксации транзакции с отзывом,
+// иначе параллельный запрос успеет снова закэшировать сессию как активную
+func ForgetSessionStatus(sessionID uint) {
+	if err := cache.Delete(sessionStatusKey(sessionID)); err != nil {
+		logger.ErrorLog.Println("Failed to reset cached status of session", sessionID, "\tError:", err)
+	}
+}
+
+// SessionByRefreshToken возвращает сессию, которой принадлежит refresh токен
+func SessionByRefreshToken(db *gorm.DB, refreshToken string) (models.Session, error) {
+	var session models.Session
+	var storedToken models.RefreshToken
+	if err := db.Where("token_hash = ?", HashToken(refreshToken)).First(&storedToken).Error; err != nil {
+		return session, err
+	}
+	err := db.First(&session, storedToken.SessionID).Error
+	return session, err
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
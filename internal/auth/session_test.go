@@ -0,0 +1,124 @@
+package auth_test
+
+import (
+	"errors"
+	"library/internal/auth"
+	"library/internal/database"
+	"library/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// refreshWith выполняет ротацию refresh токена и возвращает новый токен из cookie ответа
+func refreshWith(refreshToken string) (string, error) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.AddCookie(&http.Cookie{Name: "refreshToken", Value: refreshToken})
+
+	_, err := auth.UpdateJWTToken(c, database.TestDB)
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "refreshToken" {
+			return cookie.Value, err
+		}
+	}
+	return "", err
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	t.Setenv("JWTCoo_expires_time_sec", "60")
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Test", Email: "test@example.com", Role: "reader"}
+	assert.NoError(t, db.Create(&user).Error)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/login", nil)
+	laptop, _, err := auth.CreateSession(c, db, user, "Laptop")
+	assert.NoError(t, err)
+	var laptopToken string
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "refreshToken" {
+			laptopToken = cookie.Value
+		}
+	}
+	assert.NotEmpty(t, laptopToken)
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/login", nil)
+	phone, _, err := auth.CreateSession(c, db, user, "Phone")
+	assert.NoError(t, err)
+
+	// Вход с телефона не разлогинивает ноутбук, а токен хранится только в виде хэша
+	var stored models.RefreshToken
+	assert.NoError(t, db.Where("session_id = ?", laptop.ID).First(&stored).Error)
+	assert.Equal(t, auth.HashToken(laptopToken), stored.TokenHash)
+
+	rotated, err := refreshWith(laptopToken)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rotated)
+	assert.NotEqual(t, laptopToken, rotated)
+
+	rotated, err = refreshWith(rotated)
+	assert.NoError(t, err)
+
+	// Повторное использование старого токена после окна гонки отзывает всю сессию
+	assert.NoError(t, db.Model(&models.RefreshToken{}).Where("session_id = ?", laptop.ID).
+		Where("rotated_at IS NOT NULL").Update("rotated_at", time.Now().Add(-time.Minute)).Error)
+	_, err = refreshWith(laptopToken)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenReused)
+
+	_, err = refreshWith(rotated)
+	assert.ErrorIs(t, err, auth.ErrInvalidRefreshToken)
+
+	var revoked models.Session
+	assert.NoError(t, db.First(&revoked, laptop.ID).Error)
+	assert.NotNil(t, revoked.RevokedAt)
+
+	var other models.Session
+	assert.NoError(t, db.First(&other, phone.ID).Error)
+	assert.Nil(t, other.RevokedAt)
+}
+
+func TestRefreshTokenRotationIsAtomic(t *testing.T) {
+	t.Setenv("JWTCoo_expires_time_sec", "60")
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Test", Email: "test@example.com", Role: "reader"}
+	assert.NoError(t, db.Create(&user).Error)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/login", nil)
+	_, tokens, err := auth.CreateSession(c, db, user, "Laptop")
+	assert.NoError(t, err)
+
+	// Если новый токен не удалось сохранить, старый не помечается ротированным и продолжает работать
+	assert.NoError(t, db.Callback().Create().Before("gorm:create").Register("fail_refresh_tokens", func(tx *gorm.DB) {
+		if tx.Statement.Table == "refresh_tokens" {
+			tx.AddError(errors.New("disk full"))
+		}
+	}))
+	_, err = refreshWith(tokens.RefreshToken)
+	assert.Error(t, err)
+	var stored models.RefreshToken
+	assert.NoError(t, db.Where("token_hash = ?", auth.HashToken(tokens.RefreshToken)).First(&stored).Error)
+	assert.Nil(t, stored.RotatedAt)
+
+	assert.NoError(t, db.Callback().Create().Remove("fail_refresh_tokens"))
+	rotated, err := refreshWith(tokens.RefreshToken)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rotated)
+}
@@ -0,0 +1,127 @@
+package auth_test
+
+import (
+	"library/internal/auth"
+	"library/internal/database"
+	"library/internal/models"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Тестовые значения из приложения B RFC 6238 (последние 6 цифр), секрет "12345678901234567890"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := auth.TOTPCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "time %d", unix)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(auth.ProvisioningURI("Library", "admin@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Library:admin@example.com", uri.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	assert.Equal(t, "Library", uri.Query().Get("issuer"))
+}
+
+func TestTwoFactorFlow(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Admin", Email: "admin@example.com", Role: "admin"}
+	require.NoError(t, db.Create(&user).Error)
+
+	setup, err := auth.BeginTOTPSetup(db, &user)
+	require.NoError(t, err)
+	assert.Contains(t, setup.OTPAuthURI, setup.Secret)
+
+	// Неверный код не включает 2FA
+	_, err = auth.EnableTOTP(db, &user, "000000")
+	assert.ErrorIs(t, err, auth.ErrInvalidTwoFactorCode)
+
+	code, err := auth.TOTPCode(setup.Secret, time.Now())
+	require.NoError(t, err)
+	recoveryCodes, err := auth.EnableTOTP(db, &user, code)
+	require.NoError(t, err)
+	assert.Len(t, recoveryCodes, 10)
+	require.NoError(t, db.First(&user, user.ID).Error)
+	assert.True(t, user.TOTPEnabled)
+
+	// Коды восстановления хранятся только в виде хэшей
+	var stored []models.RecoveryCode
+	require.NoError(t, db.Where("user_id = ?", user.ID).Find(&stored).Error)
+	assert.Len(t, stored, 10)
+	for _, record := range stored {
+		assert.NotContains(t, recoveryCodes, record.CodeHash)
+	}
+
+	// Один и тот же TOTP код нельзя использовать повторно
+	assert.ErrorIs(t, auth.VerifySecondFactor(db, &user, code), auth.ErrInvalidTwoFactorCode)
+
+	// Код восстановления одноразовый
+	assert.NoError(t, auth.VerifySecondFactor(db, &user, recoveryCodes[0]))
+	assert.ErrorIs(t, auth.VerifySecondFactor(db, &user, recoveryCodes[0]), auth.ErrInvalidTwoFactorCode)
+
+	// Отключить обязательную 2FA нельзя
+	auth.SetTwoFactorPolicy("Library", "admin")
+	defer auth.SetTwoFactorPolicy("Library")
+	assert.True(t, auth.NeedsTwoFactor(user))
+	assert.ErrorIs(t, auth.DisableTOTP(db, &user, recoveryCodes[1]), auth.ErrTwoFactorMandatory)
+}
+
+func TestTwoFactorLoginToken(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Admin", Email: "admin@example.com", Role: "admin"}
+	require.NoError(t, db.Create(&user).Error)
+
+	token, err := auth.StartTwoFactorLogin(user)
+	require.NoError(t, err)
+
+	found, err := auth.TwoFactorLoginUser(db, token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// После исчерпания попыток токен больше не принимается
+	for i := 0; i < 4; i++ {
+		_, err = auth.TwoFactorLoginUser(db, token)
+		require.NoError(t, err)
+	}
+	_, err = auth.TwoFactorLoginUser(db, token)
+	assert.ErrorIs(t, err, auth.ErrInvalidTwoFactorToken)
+
+	_, err = auth.TwoFactorLoginUser(db, "unknown")
+	assert.ErrorIs(t, err, auth.ErrInvalidTwoFactorToken)
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	token, expiresAt, err := auth.IssueTwoFactorEnrollment(1)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), expiresAt, time.Minute)
+
+	// Токен выдан другому пользователю
+	assert.ErrorIs(t, auth.RedeemTwoFactorEnrollment(token, 2), auth.ErrInvalidEnrollmentToken)
+
+	require.NoError(t, auth.RedeemTwoFactorEnrollment(token, 1))
+	// Токен одноразовый
+	assert.ErrorIs(t, auth.RedeemTwoFactorEnrollment(token, 1), auth.ErrInvalidEnrollmentToken)
+	assert.ErrorIs(t, auth.RedeemTwoFactorEnrollment("unknown", 1), auth.ErrInvalidEnrollmentToken)
+}
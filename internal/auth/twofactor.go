@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"library/internal/cache"
+	"library/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// twoFactorTokenTTL время, за которое нужно ввести второй фактор после пароля
+	twoFactorTokenTTL = 5 * time.Minute
+	// twoFactorMaxAttempts количество попыток ввести код для одного входа по паролю
+	twoFactorMaxAttempts = 5
+	// twoFactorEnrollmentTTL время действия токена подключения 2FA, выданного администратором
+	twoFactorEnrollmentTTL = 24 * time.Hour
+)
+
+var (
+	ErrInvalidTwoFactorCode    = errors.New("invalid two-factor code")
+	ErrInvalidTwoFactorToken   = errors.New("invalid or expired two-factor token")
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotSetUp       = errors.New("two-factor authentication setup was not started")
+	ErrTwoFactorMandatory      = errors.New("two-factor authentication is mandatory for this role")
+	ErrInvalidEnrollmentToken  = errors.New("invalid or expired two-factor enrollment token")
+)
+
+// twoFactorPolicy настройки 2FA, задаются при старте приложения из конфигурации
+var twoFactorPolicy = struct {
+	sync.RWMutex
+	issuer        string
+	requiredRoles []string
+}{issuer: "Library"}
+
+// SetTwoFactorPolicy задает имя сервиса в приложении-аутентификаторе и роли, для которых 2FA обязательна
+func SetTwoFactorPolicy(issuer string, requiredRoles ...string) {
+	twoFactorPolicy.Lock()
+	defer twoFactorPolicy.Unlock()
+	if issuer != "" {
+		twoFactorPolicy.issuer = issuer
+	}
+	twoFactorPolicy.requiredRoles = requiredRoles
+}
+
+// TwoFactorRequired проверяет, обязательна ли 2FA для роли
+func TwoFactorRequired(role string) bool {
+	twoFactorPolicy.RLock()
+	defer twoFactorPolicy.RUnlock()
+	return slices.Contains(twoFactorPolicy.requiredRoles, role)
+}
+
+// NeedsTwoFactor проверяет, нужен ли пользователю второй фактор при входе
+func NeedsTwoFactor(user models.User) bool {
+	return user.TOTPEnabled || TwoFactorRequired(user.Role)
+}
+
+func twoFactorIssuer() string {
+	twoFactorPolicy.RLock()
+	defer twoFactorPolicy.RUnlock()
+	return twoFactorPolicy.issuer
+}
+
+func twoFactorTokenKey(token string) string      { return "2fa_pending:" + HashToken(token) }
+func twoFactorAttemptsKey(token string) string   { return "2fa_attempts:" + HashToken(token) }
+func twoFactorEnrollmentKey(token string) string { return "2fa_enrollment:" + HashToken(token) }
+
+// TOTPSetup данные для подключения приложения-аутентификатора
+type TOTPSetup struct {
+	Secret     string `json:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"`
+	OTPAuthURI string `json:"otpauth_uri" example:"otpauth://totp/Library:Laminano@mail.ru?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Library"`
+}
+
+// BeginTOTPSetup генерирует новый секрет TOTP. 2FA включается только после подтверждения кодом в EnableTOTP
+func BeginTOTPSetup(db *gorm.DB, user *models.User) (TOTPSetup, error) {
+	if user.TOTPEnabled {
+		return TOTPSetup{}, ErrTwoFactorAlreadyEnabled
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	if err := db.Model(user).Update("totp_secret", secret).Error; err != nil {
+		return TOTPSetup{}, err
+	}
+	return TOTPSetup{Secret: secret, OTPAuthURI: ProvisioningURI(twoFactorIssuer(), user.Email, secret)}, nil
+}
+
+// EnableTOTP включает 2FA, если код соответствует секрету из BeginTOTPSetup, и возвращает коды восстановления
+func EnableTOTP(db *gorm.DB, user *models.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+	if err := checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP отключает 2FA после проверки текущего кода или кода восстановления
+func DisableTOTP(db *gorm.DB, user *models.User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+	if TwoFactorRequired(user.Role) {
+		return ErrTwoFactorMandatory
+	}
+	if err := VerifySecondFactor(db, user, code); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": ""}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes заменяет коды восстановления новыми после проверки второго фактора
+func RegenerateRecoveryCodes(db *gorm.DB, user *models.User, code string) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err := VerifySecondFactor(db, user, code); err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(db, user.ID)
+}
+
+// VerifySecondFactor проверяет код TOTP или одноразовый код восстановления
+func VerifySecondFactor(db *gorm.DB, user *models.User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return checkTOTP(user, code)
+	}
+
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// checkTOTP проверяет код TOTP и не дает использовать один и тот же код дважды
+func checkTOTP(user *models.User, code string) error {
+	step, ok := validateTOTP(user.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	fresh, err := cache.SetIfAbsent(fmt.Sprintf("totp_used:%d:%d", user.ID, step), "1", totpPeriod*(2*totpSkew+1))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]models.RecoveryCode, 0, len(codes))
+	for _, code := range codes {
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: HashToken(normalizeRecoveryCode(code))})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// StartTwoFactorLogin выдает временный токен, который обменивается на сессию после ввода второго фактора
+func StartTwoFactorLogin(user models.User) (string, error) {
+	token, err := newTwoFactorToken()
+	if err != nil {
+		return "", err
+	}
+	if err := cache.SetWithTTL(twoFactorTokenKey(token), strconv.FormatUint(uint64(user.ID), 10), twoFactorTokenTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// TwoFactorLoginUser возвращает пользователя, прошедшего первый шаг входа с этим токеном.
+// После twoFactorMaxAttempts попыток токен становится недействительным
+func TwoFactorLoginUser(db *gorm.DB, token string) (models.User, error) {
+	var user models.User
+	userID, ok, err := cache.GetString(twoFactorTokenKey(token))
+	if err != nil {
+		return user, err
+	}
+	if !ok {
+		return user, ErrInvalidTwoFactorToken
+	}
+
+	attempts, err := cache.Increment(twoFactorAttemptsKey(token), twoFactorTokenTTL)
+	if err != nil {
+		return user, err
+	}
+	if attempts > twoFactorMaxAttempts {
+		FinishTwoFactorLogin(token)
+		return user, ErrInvalidTwoFactorToken
+	}
+
+	if err := db.First(&user, userID).Error; err != nil {
+		return user, ErrInvalidTwoFactorToken
+	}
+	return user, nil
+}
+
+// IssueTwoFactorEnrollment выдает одноразовый токен, с которым пользователь, для роли которого 2FA обязательна,
+// может получить секрет TOTP после входа по паролю. Одного пароля для подключения 2FA недостаточно
+func IssueTwoFactorEnrollment(userID uint) (string, time.Time, error) {
+	token, err := newTwoFactorToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := cache.SetWithTTL(twoFactorEnrollmentKey(token), strconv.FormatUint(uint64(userID), 10), twoFactorEnrollmentTTL); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Now().Add(twoFactorEnrollmentTTL), nil
+}
+
+// RedeemTwoFactorEnrollment погашает токен подключения 2FA, выданный пользователю userID
+func RedeemTwoFactorEnrollment(token string, userID uint) error {
+	owner, ok, err := cache.GetString(twoFactorEnrollmentKey(token))
+	if err != nil {
+		return err
+	}
+	if !ok || owner != strconv.FormatUint(uint64(userID), 10) {
+		return ErrInvalidEnrollmentToken
+	}
+	return cache.Delete(twoFactorEnrollmentKey(token))
+}
+
+func newTwoFactorToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// FinishTwoFactorLogin удаляет временный токен входа
+func FinishTwoFactorLogin(token string) error {
+	return cache.Delete(twoFactorTokenKey(token), twoFactorAttemptsKey(token))
+}
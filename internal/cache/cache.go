@@ -28,12 +28,70 @@ func GetClient() *redis.Client {
 	return rdb
 }
 
+// ClearCache удаляет закэшированные списки книг. Остальные ключи (например, разрешения ролей) не трогаются
 func ClearCache() {
-    if err := rdb.FlushDB(Ctx).Err(); err != nil {
-        logger.ErrorLog.Println("Failed to flush Redis database:", err)
-    } else {
-        logger.InfoLog.Println("Redis cache cleared successfully")
-    }
+	if rdb == nil {
+		return
+	}
+	iter := rdb.Scan(Ctx, 0, "books:*", 0).Iterator()
+	var keys []string
+	for iter.Next(Ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		logger.ErrorLog.Println("Failed to scan books cache keys:", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := rdb.Del(Ctx, keys...).Err(); err != nil {
+		logger.ErrorLog.Println("Failed to clear books cache:", err)
+	} else {
+		logger.InfoLog.Println("Books cache cleared successfully")
+	}
+}
+
+// GetRolePermissions возвращает закэшированный список разрешений роли
+func GetRolePermissions(role string) ([]string, bool) {
+	if rdb == nil {
+		return nil, false
+	}
+	cachedData, err := rdb.Get(Ctx, "role_permissions:"+role).Result()
+	if err != nil {
+		return nil, false
+	}
+	var permissions []string
+	if err := json.Unmarshal([]byte(cachedData), &permissions); err != nil {
+		logger.ErrorLog.Println("Failed to unmarshal cached permissions of role", role, "\tError:", err)
+		return nil, false
+	}
+	return permissions, true
+}
+
+// SetRolePermissions кэширует список разрешений роли
+func SetRolePermissions(role string, permissions []string, ttl time.Duration) {
+	if rdb == nil {
+		return
+	}
+	permissionsJSON, err := json.Marshal(permissions)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to marshal permissions of role", role, "\tError:", err)
+		return
+	}
+	if err := rdb.Set(Ctx, "role_permissions:"+role, permissionsJSON, ttl).Err(); err != nil {
+		logger.ErrorLog.Println("Failed to cache permissions of role", role, "\tError:", err)
+	}
+}
+
+// DeleteRolePermissions сбрасывает кэш разрешений роли после её изменения
+func DeleteRolePermissions(role string) {
+	if rdb == nil {
+		return
+	}
+	if err := rdb.Del(Ctx, "role_permissions:"+role).Err(); err != nil {
+		logger.ErrorLog.Println("Failed to delete cached permissions of role", role, "\tError:", err)
+	}
 }
 
 func CheckCacheGetBooks(page, limit, sort string, db *gorm.DB) (models.ResponseGetBooks, error) {
@@ -52,7 +110,11 @@ func CheckCacheGetBooks(page, limit, sort string, db *gorm.DB) (models.ResponseG
 		return response, err
 	}
 
-	cachedData, err := rdb.Get(Ctx, cacheKey).Result()
+	var cachedData string
+	err = redis.Nil
+	if rdb != nil {
+		cachedData, err = rdb.Get(Ctx, cacheKey).Result()
+	}
 	if err != nil {
 		logger.InfoLog.Println("No cache found when /getBooks by the key =", cacheKey)
 		if err := db.Preload("Genres", func(db *gorm.DB) *gorm.DB {
@@ -83,6 +145,9 @@ func CheckCacheGetBooks(page, limit, sort string, db *gorm.DB) (models.ResponseG
 		if err != nil {
 			return response, err
 		}
+		if rdb == nil {
+			return response, nil
+		}
 		if err := rdb.Set(Ctx, cacheKey, booksJSON, 5*time.Minute).Err(); err != nil {
 			return response, err
 		}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"library/logger"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Счетчики и флаги с временем жизни. Если Redis не инициализирован (например, в тестах),
+// значения хранятся в памяти процесса
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+var (
+	memoryMu    sync.Mutex
+	memoryStore = map[string]memoryEntry{}
+)
+
+// memoryGet возвращает значение из памяти, удаляя его, если время жизни истекло. Вызывается под memoryMu
+func memoryGet(key string) (memoryEntry, bool) {
+	entry, ok := memoryStore[key]
+	if !ok {
+		return entry, false
+	}
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		delete(memoryStore, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+// Increment увеличивает счетчик на единицу. Время жизни задается только при создании счетчика
+func Increment(key string, ttl time.Duration) (int64, error) {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		entry, ok := memoryGet(key)
+		if !ok {
+			entry = memoryEntry{value: "0", expiresAt: time.Now().Add(ttl)}
+		}
+		count, _ := strconv.ParseInt(entry.value, 10, 64)
+		count++
+		entry.value = strconv.FormatInt(count, 10)
+		memoryStore[key] = entry
+		return count, nil
+	}
+
+	count, err := rdb.Incr(Ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		if err := rdb.Expire(Ctx, key, ttl).Err(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// SetWithTTL сохраняет значение с временем жизни
+func SetWithTTL(key, value string, ttl time.Duration) error {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		memoryStore[key] = memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+		return nil
+	}
+	return rdb.Set(Ctx, key, value, ttl).Err()
+}
+
+// SetIfAbsent сохраняет значение, только если ключа еще нет. Возвращает true, если значение сохранено
+func SetIfAbsent(key, value string, ttl time.Duration) (bool, error) {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		if _, ok := memoryGet(key); ok {
+			return false, nil
+		}
+		memoryStore[key] = memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+		return true, nil
+	}
+	return rdb.SetNX(Ctx, key, value, ttl).Result()
+}
+
+// GetString возвращает значение ключа и признак его наличия
+func GetString(key string) (string, bool, error) {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		entry, ok := memoryGet(key)
+		return entry.value, ok, nil
+	}
+	value, err := rdb.Get(Ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// TTL возвращает оставшееся время жизни ключа или 0, если ключа нет
+func TTL(key string) (time.Duration, error) {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		entry, ok := memoryGet(key)
+		if !ok {
+			return 0, nil
+		}
+		return time.Until(entry.expiresAt), nil
+	}
+	ttl, err := rdb.PTTL(Ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Delete удаляет ключи
+func Delete(keys ...string) error {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		for _, key := range keys {
+			delete(memoryStore, key)
+		}
+		return nil
+	}
+	return rdb.Del(Ctx, keys...).Err()
+}
+
+// releaseLockScript удаляет блокировку, только если ее значение совпадает с токеном владельца
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RunLocked выполняет fn, если ни один другой экземпляр приложения не держит блокировку key.
+// В блокировке хранится случайный токен: если fn выполнялась дольше ttl и блокировку успел захватить
+// другой экземпляр, освобождение не удалит чужую блокировку
+func RunLocked(key string, ttl time.Duration, fn func()) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		logger.ErrorLog.Println("Failed to generate token for lock", key, "\tError:", err)
+		return
+	}
+	token := hex.EncodeToString(raw)
+
+	locked, err := SetIfAbsent(key, token, ttl)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to acquire lock", key, "\tError:", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer func() {
+		if err := releaseLock(key, token); err != nil {
+			logger.ErrorLog.Println("Failed to release lock", key, "\tError:", err)
+		}
+	}()
+	fn()
+}
+
+// releaseLock удаляет блокировку key, если она все еще принадлежит владельцу token
+func releaseLock(key, token string) error {
+	if rdb == nil {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		if entry, ok := memoryGet(key); ok && entry.value == token {
+			delete(memoryStore, key)
+		}
+		return nil
+	}
+	return releaseLockScript.Run(Ctx, rdb, []string{key}, token).Err()
+}
@@ -0,0 +1,35 @@
+package cache_test
+
+import (
+	"library/internal/cache"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLocked(t *testing.T) {
+	key := "test_lock"
+	defer cache.Delete(key)
+
+	// Пока блокировка занята, fn не выполняется, после выполнения блокировка освобождается
+	ran := 0
+	cache.RunLocked(key, time.Minute, func() {
+		ran++
+		cache.RunLocked(key, time.Minute, func() { ran++ })
+	})
+	assert.Equal(t, 1, ran)
+	_, held, err := cache.GetString(key)
+	require.NoError(t, err)
+	assert.False(t, held)
+
+	// Блокировка истекла и ее захватил другой экземпляр: освобождение не удаляет чужую блокировку
+	cache.RunLocked(key, time.Minute, func() {
+		require.NoError(t, cache.SetWithTTL(key, "other-owner", time.Minute))
+	})
+	owner, held, err := cache.GetString(key)
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, "other-owner", owner)
+}
@@ -55,6 +55,21 @@ func CreateTrgmIndexes(db *gorm.DB) error {
 	return nil
 }
 
+// ProtectAuditLog запрещает изменять и удалять записи журнала аудита, в том числе в обход приложения
+func ProtectAuditLog(db *gorm.DB) error {
+	if err := db.Exec(`CREATE OR REPLACE FUNCTION audit_logs_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_logs is append-only';
+END;
+$$ LANGUAGE plpgsql;`).Error; err != nil {
+		return err
+	}
+	if err := db.Exec("DROP TRIGGER IF EXISTS audit_logs_append_only ON audit_logs;").Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE TRIGGER audit_logs_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_logs FOR EACH STATEMENT EXECUTE FUNCTION audit_logs_append_only();").Error
+}
+
 // Поиск книг
 func SearchBooks(db *gorm.DB, searchString string, similarity float64, offset, limit int) ([]models.Book, int, error) {
 	var books []models.Book
@@ -81,7 +96,10 @@ func InitTestDB() {
 	if err != nil {
 		panic(fmt.Sprintf("Failed to open database: %v", err))
 	}
-	if err := db.AutoMigrate(&models.Book{}, &models.Genre{}, models.User{}); err != nil {
+	if err := db.AutoMigrate(&models.Book{}, &models.Genre{}, models.User{}, &models.Role{}, &models.Permission{},
+		&models.Session{}, &models.RefreshToken{}, &models.APIKey{}, &models.RecoveryCode{},
+		&models.ExternalIdentity{}, &models.GenreSubscription{}, &models.AuthorSubscription{},
+		&models.DigestItem{}, &models.OutboxEmail{}, &models.OutboxEvent{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.WebhookDeliveryAttempt{}, &models.AuditLog{}); err != nil {
 		panic(fmt.Sprintf("Failed to migrate database : %v", err))
 	}
 
@@ -4,9 +4,21 @@ import "library/internal/models"
 
 // Migrate создает таблицы на основе моделей
 func Migrate() error {
-	err := DB.AutoMigrate(&models.Book{}, &models.Genre{}, &models.User{})
+	err := DB.AutoMigrate(&models.Book{}, &models.Genre{}, &models.User{}, &models.Role{}, &models.Permission{},
+		&models.Session{}, &models.RefreshToken{}, &models.APIKey{}, &models.RecoveryCode{},
+		&models.ExternalIdentity{}, &models.GenreSubscription{}, &models.AuthorSubscription{},
+		&models.DigestItem{}, &models.OutboxEmail{}, &models.OutboxEvent{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.WebhookDeliveryAttempt{}, &models.AuditLog{})
 	if err != nil {
 		return err
 	}
+
+	// Refresh токены раньше хранились прямо в users, теперь они в отдельной таблице сессий
+	for _, column := range []string{"refresh_token", "expires_at"} {
+		if DB.Migrator().HasColumn(&models.User{}, column) {
+			if err := DB.Migrator().DropColumn(&models.User{}, column); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
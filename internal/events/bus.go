@@ -0,0 +1,142 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"library/logger"
+	"sync"
+	"time"
+)
+
+// Handler обрабатывает событие. Ошибка означает, что обработку нужно повторить
+type Handler func(envelope Envelope) error
+
+// Bus шина событий: публикует события и доставляет их обработчику
+type Bus interface {
+	Publisher
+	// Consume доставляет события handler, пока не отменен ctx или шина не закрыта. Экземпляры приложения
+	// делят события между собой: каждое событие обрабатывается одним экземпляром
+	Consume(ctx context.Context, handler Handler) error
+	// Subscribe доставляет handler события, опубликованные после подписки, пока не отменен ctx или шина не закрыта.
+	// Каждый экземпляр приложения получает все события; ошибки handler только пишутся в лог, повторов нет
+	Subscribe(ctx context.Context, handler Handler) error
+	Close() error
+}
+
+var ErrBusClosed = errors.New("event bus is closed")
+
+const (
+	// memoryBusBuffer сколько событий шина в памяти хранит до обработки
+	memoryBusBuffer = 1024
+	// memoryBusAttempts сколько раз шина в памяти пытается обработать событие
+	memoryBusAttempts = 5
+	// memoryBusRetryDelay пауза перед первым повтором обработки, каждая следующая вдвое длиннее
+	memoryBusRetryDelay = time.Second
+)
+
+// MemoryBus шина событий внутри процесса для развертывания на одном узле и тестов.
+// События, которые еще не обработаны, теряются при остановке приложения
+type MemoryBus struct {
+	queue      chan Envelope
+	closed     chan struct{}
+	closeOnce  sync.Once
+	retryDelay time.Duration
+
+	mu          sync.RWMutex
+	subscribers map[*Handler]struct{}
+}
+
+// NewMemoryBus создает шину событий в памяти
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		queue:       make(chan Envelope, memoryBusBuffer),
+		closed:      make(chan struct{}),
+		retryDelay:  memoryBusRetryDelay,
+		subscribers: map[*Handler]struct{}{},
+	}
+}
+
+// Publish передает событие подписчикам и ставит его в очередь. Если очередь заполнена, ждет, пока обработчик ее разберет
+func (b *MemoryBus) Publish(envelope Envelope) error {
+	select {
+	case <-b.closed:
+		return ErrBusClosed
+	default:
+	}
+
+	b.mu.RLock()
+	for handler := range b.subscribers {
+		if err := (*handler)(envelope); err != nil {
+			logger.ErrorLog.Printf("Subscriber failed to handle event %s %s\tError: %v", envelope.Type, envelope.ID, err)
+		}
+	}
+	b.mu.RUnlock()
+
+	select {
+	case b.queue <- envelope:
+		return nil
+	case <-b.closed:
+		return ErrBusClosed
+	}
+}
+
+// Consume обрабатывает события в порядке публикации. Событие, которое не удалось обработать
+// за несколько попыток, пропускается
+func (b *MemoryBus) Consume(ctx context.Context, handler Handler) error {
+	for {
+		select {
+		case envelope := <-b.queue:
+			b.deliver(ctx, envelope, handler)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.closed:
+			return nil
+		}
+	}
+}
+
+// Subscribe передает handler каждое опубликованное событие в момент публикации, поэтому handler должен быть быстрым
+func (b *MemoryBus) Subscribe(ctx context.Context, handler Handler) error {
+	b.mu.Lock()
+	b.subscribers[&handler] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, &handler)
+		b.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.closed:
+		return nil
+	}
+}
+
+func (b *MemoryBus) deliver(ctx context.Context, envelope Envelope, handler Handler) {
+	delay := b.retryDelay
+	for attempts := 1; ; attempts++ {
+		err := handler(envelope)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrUnprocessable) || attempts >= memoryBusAttempts {
+			logger.ErrorLog.Printf("Event %s %s dropped after %d attempts\tError: %v", envelope.Type, envelope.ID, attempts, err)
+			return
+		}
+		logger.ErrorLog.Printf("Failed to handle event %s %s (attempt %d), retrying in %s\tError: %v", envelope.Type, envelope.ID, attempts, delay, err)
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close останавливает доставку событий
+func (b *MemoryBus) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
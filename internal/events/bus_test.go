@@ -0,0 +1,82 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"library/internal/events"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBus(t *testing.T) {
+	bus := events.NewMemoryBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan events.Envelope, 3)
+	done := make(chan error)
+	go func() {
+		done <- bus.Consume(ctx, func(envelope events.Envelope) error {
+			received <- envelope
+			if envelope.Key == "book:2" {
+				return fmt.Errorf("%w: broken payload", events.ErrUnprocessable)
+			}
+			return nil
+		})
+	}()
+
+	for id := uint(1); id <= 3; id++ {
+		envelope, err := events.New(events.BookDeleted, "", id, events.BookDeletedPayload{ID: id})
+		require.NoError(t, err)
+		require.NoError(t, bus.Publish(envelope))
+	}
+
+	// События доставляются по порядку, событие, которое невозможно обработать, не повторяется
+	for _, key := range []string{"book:1", "book:2", "book:3"} {
+		select {
+		case envelope := <-received:
+			assert.Equal(t, key, envelope.Key)
+		case <-time.After(time.Second):
+			t.Fatal("event was not delivered")
+		}
+	}
+
+	require.NoError(t, bus.Close())
+	assert.NoError(t, <-done)
+	assert.ErrorIs(t, bus.Publish(events.Envelope{}), events.ErrBusClosed)
+}
+
+func TestMemoryBusSubscribe(t *testing.T) {
+	bus := events.NewMemoryBus()
+	defer bus.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Подписчик получает события, даже если их никто не обрабатывает через Consume
+	received := make(chan events.Envelope, 1)
+	done := make(chan error)
+	go func() {
+		done <- bus.Subscribe(ctx, func(envelope events.Envelope) error {
+			received <- envelope
+			return errors.New("ignored")
+		})
+	}()
+
+	envelope, err := events.New(events.BookDeleted, "", 1, events.BookDeletedPayload{ID: 1})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		require.NoError(t, bus.Publish(envelope))
+		select {
+		case got := <-received:
+			return got.ID == envelope.ID
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
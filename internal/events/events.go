@@ -0,0 +1,227 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"library/internal/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Типы событий каталога
+const (
+	BookAdded                = "BookAdded"
+	BookUpdated              = "BookUpdated"
+	BookDeleted              = "BookDeleted"
+	GenreCreated             = "GenreCreated"
+	UserRegistered           = "UserRegistered"
+	UserRoleChanged          = "UserRoleChanged"
+	MailingPreferenceChanged = "MailingPreferenceChanged"
+)
+
+// versions текущая версия схемы payload каждого типа. При несовместимом изменении payload версия увеличивается,
+// а потребители, которые не знают новую версию, пропускают такие события
+var versions = map[string]int{
+	BookAdded:                1,
+	BookUpdated:              1,
+	BookDeleted:              1,
+	GenreCreated:             1,
+	UserRegistered:           1,
+	UserRoleChanged:          1,
+	MailingPreferenceChanged: 1,
+}
+
+// entityTypes тип сущности, к которой относится событие. Он входит в ключ, чтобы события книги и жанра
+// с одинаковым id не попадали под один ключ
+var entityTypes = map[string]string{
+	BookAdded:                "book",
+	BookUpdated:              "book",
+	BookDeleted:              "book",
+	GenreCreated:             "genre",
+	UserRegistered:           "user",
+	UserRoleChanged:          "user",
+	MailingPreferenceChanged: "user",
+}
+
+var (
+	ErrUnknownEventType   = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+	ErrNoPublisher        = errors.New("event publisher is not configured")
+	// ErrUnprocessable событие невозможно обработать, и повторные попытки не помогут
+	ErrUnprocessable = errors.New("unprocessable event")
+)
+
+// Envelope конверт события. Key содержит тип и id сущности ("book:1"): события одной сущности попадают
+// в одну партицию Kafka и обрабатываются по порядку
+type Envelope struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor,omitempty"` // "user:<id>" или "apikey:<id>", пусто для системных событий
+	Key        string          `json:"key"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// GenrePayload жанр в событиях
+type GenrePayload struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// BookPayload payload событий BookAdded и BookUpdated
+type BookPayload struct {
+	ID            uint           `json:"id"`
+	Title         string         `json:"title"`
+	Author        string         `json:"author"`
+	PublishedYear string         `json:"published_year"`
+	Description   string         `json:"description"`
+	Genres        []GenrePayload `json:"genres"`
+}
+
+// NewBookPayload payload события о книге
+func NewBookPayload(book models.Book) BookPayload {
+	return BookPayload{
+		ID:            book.ID,
+		Title:         book.Title,
+		Author:        book.Author,
+		PublishedYear: book.PublishedYear,
+		Description:   book.Description,
+		Genres:        newGenrePayloads(book.Genres),
+	}
+}
+
+func newGenrePayloads(genres []models.Genre) []GenrePayload {
+	payloads := make([]GenrePayload, 0, len(genres))
+	for _, genre := range genres {
+		payloads = append(payloads, GenrePayload{ID: genre.ID, Name: genre.Name})
+	}
+	return payloads
+}
+
+// Book книга из payload события
+func (p BookPayload) Book() models.Book {
+	book := models.Book{Title: p.Title, Author: p.Author, PublishedYear: p.PublishedYear, Description: p.Description}
+	book.ID = p.ID
+	for _, genre := range p.Genres {
+		g := models.Genre{Name: genre.Name}
+		g.ID = genre.ID
+		book.Genres = append(book.Genres, g)
+	}
+	return book
+}
+
+// BookDeletedPayload payload события BookDeleted. Genres нет в событиях, опубликованных до их добавления
+type BookDeletedPayload struct {
+	ID     uint           `json:"id"`
+	Title  string         `json:"title"`
+	Genres []GenrePayload `json:"genres,omitempty"`
+}
+
+// NewBookDeletedPayload payload события об удалении книги
+func NewBookDeletedPayload(book models.Book) BookDeletedPayload {
+	return BookDeletedPayload{ID: book.ID, Title: book.Title, Genres: newGenrePayloads(book.Genres)}
+}
+
+// UserRegisteredPayload payload события UserRegistered. Email не передается, чтобы не распространять
+// персональные данные по всем потребителям
+type UserRegisteredPayload struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Mailing bool   `json:"mailing"`
+	Locale  string `json:"locale"`
+}
+
+// UserRoleChangedPayload payload события UserRoleChanged
+type UserRoleChangedPayload struct {
+	UserID       uint   `json:"user_id"`
+	Role         string `json:"role"`
+	PreviousRole string `json:"previous_role"`
+}
+
+// NewUserRegisteredPayload payload события о регистрации пользователя
+func NewUserRegisteredPayload(user models.User) UserRegisteredPayload {
+	return UserRegisteredPayload{ID: user.ID, Name: user.Name, Role: user.Role, Mailing: user.Mailing, Locale: user.Locale}
+}
+
+// MailingPreferencePayload payload события MailingPreferenceChanged: все настройки рассылки пользователя после изменения
+type MailingPreferencePayload struct {
+	UserID    uint     `json:"user_id"`
+	Mailing   bool     `json:"mailing"`
+	Frequency string   `json:"frequency"`
+	Locale    string   `json:"locale"`
+	GenreIDs  []uint   `json:"genre_ids"`
+	Authors   []string `json:"authors"`
+}
+
+// New создает конверт события текущей версии с payload в JSON
+func New(eventType, actor string, entityID uint, payload interface{}) (Envelope, error) {
+	version, ok := versions[eventType]
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		ID:         uuid.NewString(),
+		Type:       eventType,
+		Version:    version,
+		OccurredAt: time.Now().UTC(),
+		Actor:      actor,
+		Key:        entityTypes[eventType] + ":" + strconv.FormatUint(uint64(entityID), 10),
+		Payload:    data,
+	}, nil
+}
+
+// Decode разбирает конверт события и проверяет, что его тип и версия известны
+func Decode(data []byte) (Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return envelope, err
+	}
+	version, ok := versions[envelope.Type]
+	if !ok {
+		return envelope, fmt.Errorf("%w: %q", ErrUnknownEventType, envelope.Type)
+	}
+	if envelope.Version < 1 || envelope.Version > version {
+		return envelope, fmt.Errorf("%w: %s v%d", ErrUnsupportedVersion, envelope.Type, envelope.Version)
+	}
+	return envelope, nil
+}
+
+// DecodePayload разбирает payload события в структуру
+func (e Envelope) DecodePayload(payload interface{}) error {
+	return json.Unmarshal(e.Payload, payload)
+}
+
+// Publisher отправляет события потребителям
+type Publisher interface {
+	Publish(envelope Envelope) error
+}
+
+// publisherState куда отправляются события, задается при старте приложения
+var publisherState = struct {
+	sync.RWMutex
+	publisher Publisher
+}{}
+
+// SetPublisher задает, куда отправляются события
+func SetPublisher(publisher Publisher) {
+	publisherState.Lock()
+	defer publisherState.Unlock()
+	publisherState.publisher = publisher
+}
+
+// currentPublisher возвращает настроенный Publisher или nil
+func currentPublisher() Publisher {
+	publisherState.RLock()
+	defer publisherState.RUnlock()
+	return publisherState.publisher
+}
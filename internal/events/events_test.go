@@ -0,0 +1,162 @@
+package events_test
+
+import (
+	"encoding/json"
+	"errors"
+	"library/internal/database"
+	"library/internal/events"
+	"library/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type recordingPublisher struct {
+	published []events.Envelope
+	fail      map[string]bool // ключи, публикация которых завершается ошибкой
+}
+
+func (p *recordingPublisher) Publish(envelope events.Envelope) error {
+	if p.fail[envelope.Key] {
+		return errors.New("broker is unavailable")
+	}
+	p.published = append(p.published, envelope)
+	return nil
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	book := models.Book{Title: "Golang Basics", Author: "John Doe", Genres: []models.Genre{{Name: "Программирование"}}}
+	book.ID = 42
+	book.Genres[0].ID = 7
+
+	envelope, err := events.New(events.BookAdded, "user:1", book.ID, events.NewBookPayload(book))
+	require.NoError(t, err)
+	assert.NotEmpty(t, envelope.ID)
+	assert.Equal(t, 1, envelope.Version)
+	assert.Equal(t, "book:42", envelope.Key)
+
+	data, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	decoded, err := events.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, envelope.ID, decoded.ID)
+	assert.Equal(t, "user:1", decoded.Actor)
+
+	var payload events.BookPayload
+	require.NoError(t, decoded.DecodePayload(&payload))
+	assert.Equal(t, book.ID, payload.Book().ID)
+	assert.Equal(t, "Программирование", payload.Book().Genres[0].Name)
+	assert.Equal(t, uint(7), payload.Book().Genres[0].ID)
+}
+
+func TestDecodeRejectsUnknownEvents(t *testing.T) {
+	_, err := events.Decode([]byte(`{"id":"1","type":"BookAdded","version":2,"key":"1","payload":{}}`))
+	assert.ErrorIs(t, err, events.ErrUnsupportedVersion)
+
+	_, err = events.Decode([]byte(`{"id":"1","type":"BookAdded","version":0,"key":"1","payload":{}}`))
+	assert.ErrorIs(t, err, events.ErrUnsupportedVersion)
+
+	_, err = events.Decode([]byte(`{"id":"1","type":"BookBurned","version":1,"key":"1","payload":{}}`))
+	assert.ErrorIs(t, err, events.ErrUnknownEventType)
+
+	_, err = events.Decode([]byte(`"{\"event\":\"BookAdded\"}"`))
+	assert.Error(t, err)
+
+	_, err = events.New("BookBurned", "", 1, nil)
+	assert.ErrorIs(t, err, events.ErrUnknownEventType)
+}
+
+func TestRelay(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		if err := events.Enqueue(tx, events.BookAdded, "", 3, events.BookPayload{ID: 3}); err != nil {
+			return err
+		}
+		if err := events.Enqueue(tx, events.GenreCreated, "apikey:5", 3, events.GenrePayload{ID: 3, Name: "Детектив"}); err != nil {
+			return err
+		}
+		return events.Enqueue(tx, events.BookDeleted, "", 3, events.BookDeletedPayload{ID: 3})
+	}))
+	require.NoError(t, events.Enqueue(db, events.BookDeleted, "", 4, events.BookDeletedPayload{ID: 4}))
+
+	// Откаченная транзакция не оставляет событий
+	assert.Error(t, db.Transaction(func(tx *gorm.DB) error {
+		if err := events.Enqueue(tx, events.BookDeleted, "", 5, events.BookDeletedPayload{ID: 5}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}))
+
+	events.SetPublisher(nil)
+	_, err := events.Relay(db, time.Now())
+	assert.ErrorIs(t, err, events.ErrNoPublisher)
+
+	// Неудачная публикация задерживает следующие события той же сущности, но не другие,
+	// в том числе события жанра с тем же id
+	publisher := &recordingPublisher{fail: map[string]bool{"book:3": true}}
+	events.SetPublisher(publisher)
+	defer events.SetPublisher(nil)
+
+	now := time.Now()
+	published, err := events.Relay(db, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, published)
+	require.Len(t, publisher.published, 2)
+	assert.Equal(t, "genre:3", publisher.published[0].Key)
+	assert.Equal(t, "apikey:5", publisher.published[0].Actor)
+	assert.JSONEq(t, `{"id":3,"name":"Детектив"}`, string(publisher.published[0].Payload))
+	assert.Equal(t, "book:4", publisher.published[1].Key)
+
+	var failed models.OutboxEvent
+	require.NoError(t, db.Where("type = ?", events.BookAdded).First(&failed).Error)
+	assert.Equal(t, models.EventPending, failed.Status)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.NotEmpty(t, failed.LastError)
+	assert.True(t, failed.NextAttemptAt.After(now))
+
+	// До истечения паузы событие не публикуется повторно
+	publisher.fail = nil
+	published, err = events.Relay(db, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, published)
+
+	published, err = events.Relay(db, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, published)
+	require.Len(t, publisher.published, 4)
+	assert.Equal(t, events.BookAdded, publisher.published[2].Type)
+	assert.Equal(t, events.BookDeleted, publisher.published[3].Type)
+	assert.Equal(t, "book:3", publisher.published[3].Key)
+
+	var pending int64
+	require.NoError(t, db.Model(&models.OutboxEvent{}).Where("status = ?", models.EventPending).Count(&pending).Error)
+	assert.Zero(t, pending)
+}
+
+func TestCleanupSent(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	for id := uint(1); id <= 3; id++ {
+		require.NoError(t, events.Enqueue(db, events.BookDeleted, "", id, events.BookDeletedPayload{ID: id}))
+	}
+	old, recent := time.Now().Add(-48*time.Hour), time.Now()
+	require.NoError(t, db.Model(&models.OutboxEvent{}).Where("key = ?", "book:1").Updates(map[string]interface{}{"status": models.EventSent, "sent_at": old}).Error)
+	require.NoError(t, db.Model(&models.OutboxEvent{}).Where("key = ?", "book:2").Updates(map[string]interface{}{"status": models.EventSent, "sent_at": recent}).Error)
+
+	// Удаляются только отправленные события старше границы, неотправленные остаются
+	deleted, err := events.CleanupSent(db, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	var keys []string
+	require.NoError(t, db.Model(&models.OutboxEvent{}).Order("id").Pluck("key", &keys).Error)
+	assert.Equal(t, []string{"book:2", "book:3"}, keys)
+}
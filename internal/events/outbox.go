@@ -0,0 +1,166 @@
+package events
+
+import (
+	"encoding/json"
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// relayBatchSize сколько событий relay берет из outbox за один проход
+	relayBatchSize = 100
+	// relayLockTTL время, на которое экземпляр приложения захватывает outbox событий
+	relayLockTTL = 5 * time.Minute
+	// relayRetryDelay пауза перед повторной публикацией, удваивается после каждой неудачи
+	relayRetryDelay = time.Second
+	// maxRelayRetryDelay верхняя граница паузы между попытками
+	maxRelayRetryDelay = 5 * time.Minute
+	// cleanupInterval как часто relay удаляет старые отправленные события
+	cleanupInterval = time.Hour
+	// cleanupBatchSize сколько отправленных событий удаляется за один запрос
+	cleanupBatchSize = 1000
+)
+
+// Enqueue сохраняет событие в outbox. tx должна быть транзакцией изменения, которое вызвало событие:
+// тогда событие сохраняется тогда и только тогда, когда сохраняется само изменение
+func Enqueue(tx *gorm.DB, eventType, actor string, entityID uint, payload interface{}) error {
+	envelope, err := New(eventType, actor, entityID, payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.OutboxEvent{
+		EventID:       envelope.ID,
+		Type:          envelope.Type,
+		Version:       envelope.Version,
+		Key:           envelope.Key,
+		Actor:         envelope.Actor,
+		Payload:       string(envelope.Payload),
+		OccurredAt:    envelope.OccurredAt,
+		Status:        models.EventPending,
+		NextAttemptAt: envelope.OccurredAt,
+	}).Error
+}
+
+// envelopeFromOutbox конверт события, сохраненного в outbox
+func envelopeFromOutbox(event models.OutboxEvent) Envelope {
+	return Envelope{
+		ID:         event.EventID,
+		Type:       event.Type,
+		Version:    event.Version,
+		OccurredAt: event.OccurredAt,
+		Actor:      event.Actor,
+		Key:        event.Key,
+		Payload:    json.RawMessage(event.Payload),
+	}
+}
+
+// RunRelay периодически публикует события из outbox. Пока Publisher не настроен, события копятся в outbox.
+// Раз в час удаляются события, отправленные раньше чем retention назад; при retention <= 0 они хранятся всегда
+func RunRelay(db *gorm.DB, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastCleanup time.Time
+	for now := range ticker.C {
+		if currentPublisher() == nil {
+			continue
+		}
+		cache.RunLocked("event_outbox_lock", relayLockTTL, func() {
+			if _, err := Relay(db, time.Now()); err != nil {
+				logger.ErrorLog.Println("Failed to relay events\tError:", err)
+			}
+			if retention > 0 && now.Sub(lastCleanup) >= cleanupInterval {
+				lastCleanup = now
+				deleted, err := CleanupSent(db, now.Add(-retention))
+				if err != nil {
+					logger.ErrorLog.Println("Failed to delete sent events from outbox\tError:", err)
+				} else if deleted > 0 {
+					logger.InfoLog.Println("Deleted", deleted, "sent events from outbox")
+				}
+			}
+		})
+	}
+}
+
+// CleanupSent удаляет из outbox события, отправленные раньше before, и возвращает их количество.
+// Неотправленные события не удаляются. Удаление идет частями, чтобы не блокировать таблицу надолго
+func CleanupSent(db *gorm.DB, before time.Time) (int64, error) {
+	var total int64
+	for {
+		batch := db.Model(&models.OutboxEvent{}).Select("id").
+			Where("status = ? AND sent_at < ?", models.EventSent, before).Limit(cleanupBatchSize)
+		result := db.Where("id IN (?)", batch).Delete(&models.OutboxEvent{})
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+		if result.RowsAffected < cleanupBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// Relay публикует неотправленные события в порядке их создания и возвращает количество опубликованных.
+// Если событие не удалось опубликовать, оно откладывается с растущей паузой, а следующие события
+// с тем же ключом ждут его, чтобы сохранить порядок событий одной сущности
+func Relay(db *gorm.DB, now time.Time) (int, error) {
+	publisher := currentPublisher()
+	if publisher == nil {
+		return 0, ErrNoPublisher
+	}
+
+	var pending []models.OutboxEvent
+	if err := db.Where("status = ?", models.EventPending).Order("id").Limit(relayBatchSize).Find(&pending).Error; err != nil {
+		return 0, err
+	}
+
+	published := 0
+	blocked := make(map[string]bool)
+	for _, event := range pending {
+		if blocked[event.Key] {
+			continue
+		}
+		if event.NextAttemptAt.After(now) {
+			blocked[event.Key] = true
+			continue
+		}
+
+		if err := publisher.Publish(envelopeFromOutbox(event)); err != nil {
+			blocked[event.Key] = true
+			logger.ErrorLog.Printf("Failed to publish event %s %s (attempt %d)\tError: %v", event.Type, event.EventID, event.Attempts+1, err)
+			if err := db.Model(&event).Updates(map[string]interface{}{
+				"attempts":        event.Attempts + 1,
+				"last_error":      err.Error(),
+				"next_attempt_at": now.Add(retryDelay(event.Attempts + 1)),
+			}).Error; err != nil {
+				logger.ErrorLog.Println("Failed to save publish attempt of event", event.EventID, "\tError:", err)
+			}
+			continue
+		}
+
+		if err := db.Model(&event).Updates(map[string]interface{}{
+			"status":     models.EventSent,
+			"attempts":   event.Attempts + 1,
+			"last_error": "",
+			"sent_at":    now,
+		}).Error; err != nil {
+			// Событие будет опубликовано повторно, потребители должны быть к этому готовы
+			logger.ErrorLog.Println("Failed to mark event", event.EventID, "as sent\tError:", err)
+		}
+		published++
+	}
+	return published, nil
+}
+
+// retryDelay пауза перед следующей попыткой после attempts неудачных
+func retryDelay(attempts int) time.Duration {
+	delay := relayRetryDelay
+	for i := 1; i < attempts && delay < maxRelayRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRelayRetryDelay)
+}
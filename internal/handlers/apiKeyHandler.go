@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/auth"
+	"library/internal/models"
+	"library/internal/rbac"
+	"library/logger"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateAPIKeyRequest структура запроса для создания API ключа
+// @Schema example={"name": "import script", "scopes": ["book:read", "book:write"], "expires_in_days": 90}
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required" example:"import script"`
+	Scopes        []string `json:"scopes" binding:"required,min=1" example:"book:read,book:write"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0" example:"90"` // 0 - ключ без срока действия
+}
+
+// RevokeAPIKeyRequest структура запроса для отзыва API ключа
+// @Schema example={"id": 1}
+type RevokeAPIKeyRequest struct {
+	ID uint `json:"id" binding:"required" example:"1"`
+}
+
+// APIKeyResponse информация об API ключе без самого ключа
+type APIKeyResponse struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Scopes      []string   `json:"scopes"`
+	CreatedByID uint       `json:"created_by_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// CreateAPIKeyResponse ответ на создание API ключа. Ключ показывается только один раз
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
+
+func newAPIKeyResponse(apiKey models.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:          apiKey.ID,
+		Name:        apiKey.Name,
+		Prefix:      apiKey.Prefix,
+		Scopes:      auth.SplitScopes(apiKey.Scopes),
+		CreatedByID: apiKey.CreatedByID,
+		CreatedAt:   apiKey.CreatedAt,
+		LastUsedAt:  apiKey.LastUsedAt,
+		ExpiresAt:   apiKey.ExpiresAt,
+		RevokedAt:   apiKey.RevokedAt,
+	}
+}
+
+// CreateAPIKey
+// @Summary      Create API key
+// @Description  Creates a long-lived API key limited to the given permissions.
+// @Description  The key is returned only once and must be sent as "Authorization: Bearer <key>".
+// @Description  Requires the "apikey:manage" permission; scopes cannot exceed the caller's own permissions.
+// @Tags         apikey
+// @Accept       json
+// @Produce      json
+// @Param        key  body  CreateAPIKeyRequest  true  "API key"  example({"name": "import script", "scopes": ["book:read", "book:write"], "expires_in_days": 90})
+// @Success      201  {object}  CreateAPIKeyResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /createApiKey [post]
+func CreateAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+			return
+		}
+
+		var request CreateAPIKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		callerPermissions := claims.Scopes
+		if !claims.IsAPIKey() {
+			var err error
+			callerPermissions, err = rbac.RolePermissions(db, claims.Role)
+			if err != nil {
+				logger.ErrorLog.Println("Failed to get permissions of role", claims.Role, "\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+				return
+			}
+		}
+		for _, scope := range request.Scopes {
+			if _, known := rbac.Permissions[scope]; !known {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission: " + scope})
+				return
+			}
+			if !slices.Contains(callerPermissions, scope) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "You cannot grant a permission you do not have: " + scope})
+				return
+			}
+		}
+
+		key, err := auth.GenerateAPIKey()
+		if err != nil {
+			logger.ErrorLog.Println("Failed to generate api key\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+			return
+		}
+
+		apiKey := models.APIKey{
+			Name:    request.Name,
+			Prefix:  key[:len(auth.APIKeyPrefix)+8],
+			KeyHash: auth.HashToken(key),
+			Scopes:  strings.Join(request.Scopes, ","),
+		}
+		if !claims.IsAPIKey() {
+			userID, _ := strconv.ParseUint(claims.Subject, 10, 64)
+			apiKey.CreatedByID = uint(userID)
+		}
+		if request.ExpiresInDays > 0 {
+			expiresAt := time.Now().AddDate(0, 0, request.ExpiresInDays)
+			apiKey.ExpiresAt = &expiresAt
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&apiKey).Error; err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "apikey.create", apiKey.ID, nil, newAPIKeyResponse(apiKey))
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to save api key\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+		logger.InfoLog.Printf("API key %d (%s) created with scopes %s", apiKey.ID, apiKey.Prefix, apiKey.Scopes)
+
+		c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKeyResponse: newAPIKeyResponse(apiKey), Key: key})
+	}
+}
+
+// GetAPIKeys
+// @Summary      Get API keys
+// @Description  Returns all API keys without the keys themselves
+// @Description  Requires the "apikey:manage" permission.
+// @Tags         apikey
+// @Accept       json
+// @Produce      json
+// @Success      200  {array}   APIKeyResponse
+// @Failure      500  {object}  map[string]string
+// @Router       /getApiKeys [get]
+func GetAPIKeys(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var apiKeys []models.APIKey
+		if err := db.Order("id").Find(&apiKeys).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get api keys\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+			return
+		}
+
+		response := make([]APIKeyResponse, 0, len(apiKeys))
+		for _, apiKey := range apiKeys {
+			response = append(response, newAPIKeyResponse(apiKey))
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RevokeAPIKey
+// @Summary      Revoke API key
+// @Description  Revokes the API key; requests with it are rejected immediately
+// @Description  Requires the "apikey:manage" permission.
+// @Tags         apikey
+// @Accept       json
+// @Produce      json
+// @Param        key  body  RevokeAPIKeyRequest  true  "API key"  example({"id": 1})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /revokeApiKey [post]
+func RevokeAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request RevokeAPIKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var apiKey models.APIKey
+		if err := db.First(&apiKey, request.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API key"})
+			return
+		}
+
+		if apiKey.RevokedAt == nil {
+			before := newAPIKeyResponse(apiKey)
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&apiKey).Update("revoked_at", time.Now()).Error; err != nil {
+					return err
+				}
+				return audit.Record(tx, auditMeta(c), "apikey.revoke", apiKey.ID, before, newAPIKeyResponse(apiKey))
+			})
+			if err != nil {
+				logger.ErrorLog.Println("Failed to revoke api key", apiKey.ID, "\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+				return
+			}
+			logger.InfoLog.Printf("API key %d (%s) revoked", apiKey.ID, apiKey.Prefix)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully", "id": apiKey.ID})
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"library/internal/audit"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AuditLogResponse страница журнала аудита
+type AuditLogResponse struct {
+	Page         int           `json:"page"`
+	Limit        int           `json:"limit"`
+	TotalEntries int64         `json:"total_entries"`
+	Entries      []audit.Entry `json:"entries"`
+}
+
+// auditMeta кто и откуда выполнил запрос
+func auditMeta(c *gin.Context) audit.Meta {
+	return audit.Meta{Actor: eventActor(c), IP: c.ClientIP(), RequestID: audit.GetRequestID(c)}
+}
+
+// bindAuditFilter разбирает фильтр журнала из параметров запроса. При ошибке отвечает 400 и возвращает false
+func bindAuditFilter(c *gin.Context) (audit.Filter, bool) {
+	filter := audit.Filter{
+		Actor:      c.Query("actor"),
+		EntityType: c.Query("entity_type"),
+		EntityID:   c.Query("entity_id"),
+	}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if value := c.Query(param.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param.name + ", expected RFC3339 time"})
+				return filter, false
+			}
+			*param.value = parsed
+		}
+	}
+	return filter, true
+}
+
+// GetAuditLog
+// @Summary      Get audit log
+// @Description  Returns who changed what and when: the actor, the action, the entity, the changed fields before and
+// @Description  after the change, the client IP and the request ID. Entries are returned oldest first.
+// @Description  Requires the "audit:read" permission.
+// @Tags         audit
+// @Produce      json
+// @Param        actor        query  string  false  "Filter by actor, e.g. user:1 or apikey:2"
+// @Param        entity_type  query  string  false  "Filter by entity type, e.g. book, user, role, webhook"
+// @Param        entity_id    query  string  false  "Filter by entity ID"
+// @Param        from         query  string  false  "Only entries created at or after this RFC3339 time"
+// @Param        to           query  string  false  "Only entries created before this RFC3339 time"
+// @Param        page         query  int     false  "Page number for pagination (default: 1)"
+// @Param        limit        query  int     false  "Number of entries per page (default: 50)"
+// @Success      200  {object}  AuditLogResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getAuditLog [get]
+func GetAuditLog(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		filter, ok := bindAuditFilter(c)
+		if !ok {
+			return
+		}
+
+		var total int64
+		if err := audit.Query(db, filter).Count(&total).Error; err != nil {
+			logger.ErrorLog.Println("Failed to count audit log entries\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get audit log"})
+			return
+		}
+		var logs []models.AuditLog
+		if err := audit.Query(db, filter).Offset((page - 1) * limit).Limit(limit).Find(&logs).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get audit log\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get audit log"})
+			return
+		}
+
+		response := AuditLogResponse{Page: page, Limit: limit, TotalEntries: total, Entries: []audit.Entry{}}
+		for _, log := range logs {
+			response.Entries = append(response.Entries, audit.NewEntry(log))
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// ExportAuditLog
+// @Summary      Export audit log
+// @Description  Downloads the audit log entries matching the filter as JSON Lines, one entry per line, oldest first.
+// @Description  Requires the "audit:read" permission.
+// @Tags         audit
+// @Produce      application/x-ndjson
+// @Param        actor        query  string  false  "Filter by actor, e.g. user:1 or apikey:2"
+// @Param        entity_type  query  string  false  "Filter by entity type, e.g. book, user, role, webhook"
+// @Param        entity_id    query  string  false  "Filter by entity ID"
+// @Param        from         query  string  false  "Only entries created at or after this RFC3339 time"
+// @Param        to           query  string  false  "Only entries created before this RFC3339 time"
+// @Success      200  {string}  string  "audit log entries in JSON Lines"
+// @Failure      400  {object}  map[string]string
+// @Router       /exportAuditLog [get]
+func ExportAuditLog(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, ok := bindAuditFilter(c)
+		if !ok {
+			return
+		}
+
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="audit-log.jsonl"`)
+		c.Status(http.StatusOK)
+		// Заголовки уже отправлены, поэтому об ошибке посреди выгрузки можно только записать в лог
+		if err := audit.Export(db, filter, c.Writer); err != nil {
+			logger.ErrorLog.Println("Failed to export audit log\tError:", err)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package handlers
 
 import (
-	"encoding/json"
 	"errors"
+	"library/internal/audit"
 	"library/internal/cache"
 	"library/internal/database"
-	"library/internal/kafka"
+	"library/internal/events"
 	"library/internal/models"
 	"library/logger"
 	"math"
@@ -58,6 +58,15 @@ func Welcome(c *gin.Context) {
 	})
 }
 
+// bookSortColumns колонки, по которым можно отсортировать список книг, по значению параметра sort
+var bookSortColumns = map[string]string{
+	"id":             "id",
+	"title":          "title",
+	"author":         "author",
+	"published_year": "published_year",
+	"year":           "published_year",
+}
+
 // GetBooks возвращает отсортированный или неотсортированный список книг с пагинацией
 // @Summary Get list of books
 // @Description Retrieve all books, optionally sorted by a specific field
@@ -74,7 +83,13 @@ func GetBooks(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var response models.ResponseGetBooks
 
-		response, err := cache.CheckCacheGetBooks(c.DefaultQuery("page", "1"), c.DefaultQuery("limit", "10"), c.DefaultQuery("sort", "id"), db)
+		// Поле сортировки подставляется в ORDER BY, поэтому допускаются только известные колонки
+		sort, ok := bookSortColumns[c.DefaultQuery("sort", "id")]
+		if !ok {
+			sort = "id"
+		}
+
+		response, err := cache.CheckCacheGetBooks(c.DefaultQuery("page", "1"), c.DefaultQuery("limit", "10"), sort, db)
 		if err != nil {
 			logger.ErrorLog.Println("Failed check cache, when /getBooks\tError:", err)
 		}
@@ -143,7 +158,7 @@ func GetBook(db *gorm.DB) gin.HandlerFunc {
 // @Success      201  {object}  map[string]string
 // @Failure      400  {object}  map[string]string
 // @Router       /addBook [post]
-func AddBook(db *gorm.DB, producer *kafka.KafkaProducer) gin.HandlerFunc {
+func AddBook(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		logger.InfoLog.Println("Starting add book")
 		// Структура для запроса
@@ -158,66 +173,43 @@ func AddBook(db *gorm.DB, producer *kafka.KafkaProducer) gin.HandlerFunc {
 			logger.InfoLog.Println("Succesfulle to decoding request")
 		}
 
-		// Поиск или создание жанров
-		var genres []models.Genre
-		for _, genreName := range request.Genre {
-			genreName = strings.ToLower(genreName)
-			genreName = strings.ToUpper(string(genreName[0:2])) + genreName[2:]
-			var genre models.Genre
-			// Попытка найти жанр
-			if err := db.Where("name = ?", genreName).First(&genre).Error; err != nil {
-				// Если жанр не найден, создаем новый
-				logger.InfoLog.Println(`Trying to find a genre "` + genreName + `"`)
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					logger.InfoLog.Println("No existing genre was found when creating the book")
-					genre = models.Genre{Name: genreName}
-					if err := db.Create(&genre).Error; err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create genre"})
-						logger.ErrorLog.Println("Failed to create genre when creating the book: " + err.Error())
-						return
-					} else {
-						logger.InfoLog.Println(`Genre "` + genreName + `" was created`)
-					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve genre"})
-					logger.ErrorLog.Println("Failed to retrieve genre: " + err.Error())
-					return
-				}
+		actor := eventActor(c)
+		var book models.Book
+		failure := "Failed to add book"
+		// Книга, новые жанры и события сохраняются в одной транзакции
+		err := db.Transaction(func(tx *gorm.DB) error {
+			genres, createdGenres, err := findOrCreateGenres(tx, request.Genre)
+			if err != nil {
+				failure = "Failed to create genre"
+				return err
 			}
-			genres = append(genres, genre)
-		}
 
-		// Создание экземпляра книги на основе данных запроса
-		book := models.Book{
-			Title:         request.Title,
-			Author:        request.Author,
-			PublishedYear: request.Published_year,
-			Genres:        genres,
-			Description:   request.Description,
-		}
+			// Создание экземпляра книги на основе данных запроса
+			book = models.Book{
+				Title:         request.Title,
+				Author:        request.Author,
+				PublishedYear: request.Published_year,
+				Genres:        genres,
+				Description:   request.Description,
+			}
+			if err := tx.Create(&book).Error; err != nil {
+				return err
+			}
 
-		// Сохранение книги в базе данных
-		if err := db.Create(&book).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add book"})
-			logger.ErrorLog.Println("Failed to add book " + err.Error())
+			if err := enqueueGenresCreated(tx, actor, createdGenres); err != nil {
+				return err
+			}
+			if err := events.Enqueue(tx, events.BookAdded, actor, book.ID, events.NewBookPayload(book)); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "book.create", book.ID, nil, events.NewBookPayload(book))
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
+			logger.ErrorLog.Println(failure+"\tError:", err)
 			return
-		} else {
-			logger.InfoLog.Println(`Book "` + book.Title + `" created in database`)
-		}
-		if producer == nil {
-			logger.ErrorLog.Panicln("Kafka producer is nil!")
-		}
-		event := map[string]interface{}{
-			"event": "BookAdded",
-			"data":  book,
-		}
-		eventBytes, _ := json.Marshal(event)
-		logger.InfoLog.Println("JSON sent to Kafka: ", string(eventBytes))
-		if err := producer.SendMessage(string(eventBytes)); err != nil {
-			logger.ErrorLog.Println("Failed to send event to Kafka: " + err.Error())
-		} else {
-			logger.InfoLog.Println("Sending the event to kafka was successful")
 		}
+		logger.InfoLog.Println(`Book "` + book.Title + `" created in database`)
 
 		cache.ClearCache()
 		// Успешный ответ
@@ -258,7 +250,7 @@ func DeleteBook(db *gorm.DB) gin.HandlerFunc {
 
 		// Пытаемся найти книгу
 		var book models.Book
-		result := db.First(&book, request.ID)
+		result := db.Preload("Genres").First(&book, request.ID)
 		if result.Error != nil {
 			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 				// Если книга не найдена
@@ -270,8 +262,17 @@ func DeleteBook(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Удаляем книгу
-		if err := db.Delete(&book).Error; err != nil {
+		// Удаляем книгу вместе с событием об удалении и записью в журнале аудита
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&book).Error; err != nil {
+				return err
+			}
+			if err := events.Enqueue(tx, events.BookDeleted, eventActor(c), book.ID, events.NewBookDeletedPayload(book)); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "book.delete", book.ID, events.NewBookPayload(book), nil)
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book", "details": err.Error()})
 			return
 		}
@@ -318,31 +319,7 @@ func ModifyingBook(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		var genres []models.Genre
-		if len(request.Genre) != 0 {
-			// Поиск или создание жанров
-			for _, genreName := range request.Genre {
-				genreName = strings.ToLower(genreName)
-				genreName = strings.ToUpper(string(genreName[0:2])) + genreName[2:] // Заглавная первая буква
-				var genre models.Genre
-
-				// Попытка найти жанр
-				if err := db.Where("name = ?", genreName).First(&genre).Error; err != nil {
-					if errors.Is(err, gorm.ErrRecordNotFound) {
-						genre = models.Genre{Name: genreName}
-						if err := db.Create(&genre).Error; err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create genre"})
-							return
-						}
-					} else {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve genre"})
-						return
-					}
-				}
-				genres = append(genres, genre)
-			}
-		}
-
+		before := events.NewBookPayload(book)
 		if request.Title != "" {
 			book.Title = request.Title
 		}
@@ -356,17 +333,44 @@ func ModifyingBook(db *gorm.DB) gin.HandlerFunc {
 			book.Description = request.Description
 		}
 
-		if len(request.Genre) > 0 {
-			if err := db.Model(&book).Association("Genres").Clear(); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear genres"})
-				return
+		actor := eventActor(c)
+		failure := ""
+		// Изменения книги, новые жанры и события сохраняются в одной транзакции
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var createdGenres []models.Genre
+			if len(request.Genre) > 0 {
+				genres, created, err := findOrCreateGenres(tx, request.Genre)
+				if err != nil {
+					failure = "Failed to create genre"
+					return err
+				}
+				if err := tx.Model(&book).Association("Genres").Clear(); err != nil {
+					failure = "Failed to clear genres"
+					return err
+				}
+				book.Genres = genres
+				createdGenres = created
 			}
-			book.Genres = genres
-		}
 
-		// Сохранение измененной книги
-		if err := db.Save(&book).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			// Сохранение измененной книги
+			if err := tx.Save(&book).Error; err != nil {
+				failure = err.Error()
+				return err
+			}
+			if err := enqueueGenresCreated(tx, actor, createdGenres); err != nil {
+				return err
+			}
+			if err := events.Enqueue(tx, events.BookUpdated, actor, book.ID, events.NewBookPayload(book)); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "book.update", book.ID, before, events.NewBookPayload(book))
+		})
+		if err != nil {
+			if failure == "" {
+				failure = "Failed to change book"
+			}
+			logger.ErrorLog.Println("Failed to change book", book.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
 			return
 		}
 		cache.ClearCache()
@@ -379,6 +383,31 @@ func ModifyingBook(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// findOrCreateGenres находит жанры по названиям и создает недостающие. created содержит только новые жанры
+func findOrCreateGenres(tx *gorm.DB, names []string) (genres, created []models.Genre, err error) {
+	for _, genreName := range names {
+		genreName = strings.ToLower(genreName)
+		genreName = strings.ToUpper(string(genreName[0:2])) + genreName[2:] // Заглавная первая буква
+		var genre models.Genre
+
+		// Попытка найти жанр
+		if err := tx.Where("name = ?", genreName).First(&genre).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil, err
+			}
+			// Если жанр не найден, создаем новый
+			genre = models.Genre{Name: genreName}
+			if err := tx.Create(&genre).Error; err != nil {
+				return nil, nil, err
+			}
+			logger.InfoLog.Println(`Genre "` + genreName + `" was created`)
+			created = append(created, genre)
+		}
+		genres = append(genres, genre)
+	}
+	return genres, created, nil
+}
+
 // SearchBooks возвращает информацию о книгах со схожим названием или описанием
 // @Summary      Outputs an array of books
 // @Description  Returns an array of books that are similar in name or description to the request
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/mailing"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RetryEmailRequest структура запроса для повторной отправки письма
+// @Schema example={"id": 1}
+type RetryEmailRequest struct {
+	ID uint `json:"id" binding:"required" example:"1"`
+}
+
+// OutboxEmailResponse письмо в очереди отправки без текста письма
+type OutboxEmailResponse struct {
+	ID            uint       `json:"id"`
+	UserID        uint       `json:"user_id"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at"`
+}
+
+// OutboxEmailsResponse страница очереди отправки
+type OutboxEmailsResponse struct {
+	Page        int                   `json:"page"`
+	Limit       int                   `json:"limit"`
+	TotalEmails int64                 `json:"total_emails"`
+	Emails      []OutboxEmailResponse `json:"emails"`
+}
+
+// GetOutboxEmails
+// @Summary      List emails in the outbox
+// @Description  Returns queued, sent and dead emails with their delivery status, newest first.
+// @Description  Requires the "mailing:send" permission.
+// @Tags         mailing
+// @Produce      json
+// @Param        status  query  string  false  "Filter by status: pending, sent or dead"
+// @Param        page    query  int     false  "Page number for pagination (default: 1)"
+// @Param        limit   query  int     false  "Number of emails per page (default: 20)"
+// @Success      200  {object}  OutboxEmailsResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getOutboxEmails [get]
+func GetOutboxEmails(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit < 1 || limit > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		query := db.Model(&models.OutboxEmail{})
+		switch status := c.Query("status"); status {
+		case "":
+		case models.EmailPending, models.EmailSent, models.EmailDead:
+			query = query.Where("status = ?", status)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of: pending, sent, dead"})
+			return
+		}
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			logger.ErrorLog.Println("Failed to count outbox emails\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get emails"})
+			return
+		}
+		var emails []models.OutboxEmail
+		if err := query.Omit("html_body").Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&emails).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get outbox emails\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get emails"})
+			return
+		}
+
+		response := OutboxEmailsResponse{Page: page, Limit: limit, TotalEmails: total, Emails: []OutboxEmailResponse{}}
+		for _, email := range emails {
+			response.Emails = append(response.Emails, OutboxEmailResponse{
+				ID:            email.ID,
+				UserID:        email.UserID,
+				Recipient:     email.Recipient,
+				Subject:       email.Subject,
+				Status:        email.Status,
+				Attempts:      email.Attempts,
+				NextAttemptAt: email.NextAttemptAt,
+				LastError:     email.LastError,
+				CreatedAt:     email.CreatedAt,
+				SentAt:        email.SentAt,
+			})
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RetryOutboxEmail
+// @Summary      Retry an email
+// @Description  Puts a pending or dead email back into the outbox with a reset attempt counter.
+// @Description  Requires the "mailing:send" permission.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Param        email  body  RetryEmailRequest  true  "Email ID"  example({"id": 1})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /retryOutboxEmail [post]
+func RetryOutboxEmail(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request RetryEmailRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var before models.OutboxEmail
+			if err := tx.Select("id", "status", "attempts").First(&before, request.ID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err := mailing.RetryEmail(tx, request.ID); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "email.retry", request.ID,
+				gin.H{"status": before.Status, "attempts": before.Attempts},
+				gin.H{"status": models.EmailPending, "attempts": 0})
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, mailing.ErrEmailNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+			case errors.Is(err, mailing.ErrEmailAlreadySent):
+				c.JSON(http.StatusConflict, gin.H{"error": "Email already sent"})
+			default:
+				logger.ErrorLog.Println("Failed to retry email", request.ID, "\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry email"})
+			}
+			return
+		}
+		logger.InfoLog.Println("Email", request.ID, "queued for retry")
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email queued for retry"})
+	}
+}
+
+// RetryDeadOutboxEmails
+// @Summary      Retry all dead emails
+// @Description  Puts every dead email back into the outbox with a reset attempt counter.
+// @Description  Requires the "mailing:send" permission.
+// @Tags         mailing
+// @Produce      json
+// @Success      200  {object}  map[string]int64
+// @Failure      500  {object}  map[string]string
+// @Router       /retryDeadOutboxEmails [post]
+func RetryDeadOutboxEmails(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var retried int64
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if retried, err = mailing.RetryDeadEmails(tx); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "email.retry_dead", "", nil, gin.H{"retried": retried})
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to retry dead emails\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry emails"})
+			return
+		}
+		logger.InfoLog.Println("Dead emails queued for retry:", retried)
+
+		c.JSON(http.StatusOK, gin.H{"retried": retried})
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/mailing"
+	"library/logger"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EmailPreviewResponse письмо, сформированное из шаблона
+type EmailPreviewResponse struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// PreviewEmailTemplate
+// @Summary      Preview an email template
+// @Description  Renders an email template with sample data. With format=html returns the HTML version as a page.
+// @Description  Templates: new_book, digest, account_locked. Locales: ru, en (others fall back to ru).
+// @Description  Requires the "mailing:send" permission.
+// @Tags         mailing
+// @Produce      json
+// @Produce      html
+// @Param        name    query  string  true   "Template name"
+// @Param        locale  query  string  false  "Locale (default: ru)"
+// @Param        format  query  string  false  "json (default) or html"
+// @Success      200  {object}  EmailPreviewResponse
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /previewEmailTemplate [get]
+func PreviewEmailTemplate(c *gin.Context) {
+	name := c.Query("name")
+	data, err := mailing.SampleData(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown template"})
+		return
+	}
+
+	content, err := mailing.Render(name, c.DefaultQuery("locale", mailing.DefaultLocale), data)
+	if err != nil {
+		if errors.Is(err, mailing.ErrUnknownTemplate) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown template"})
+			return
+		}
+		logger.ErrorLog.Println("Failed to render email template", name, "\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render template"})
+		return
+	}
+
+	if c.Query("format") == "html" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(content.HTML))
+		return
+	}
+	c.JSON(http.StatusOK, EmailPreviewResponse{Subject: content.Subject, HTML: content.HTML, Text: content.Text})
+}
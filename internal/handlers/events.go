@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"library/internal/audit"
+	"library/internal/auth"
+	"library/internal/events"
+	"library/internal/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// eventActor кто выполнил действие: пользователь или API ключ из claims запроса
+func eventActor(c *gin.Context) string {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		return ""
+	}
+	if claims.IsAPIKey() {
+		return "apikey:" + strconv.FormatUint(uint64(claims.APIKeyID), 10)
+	}
+	return "user:" + claims.Subject
+}
+
+// enqueueGenresCreated сохраняет в outbox GenreCreated для каждого нового жанра
+func enqueueGenresCreated(tx *gorm.DB, actor string, genres []models.Genre) error {
+	for _, genre := range genres {
+		if err := events.Enqueue(tx, events.GenreCreated, actor, genre.ID, events.GenrePayload{ID: genre.ID, Name: genre.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mailingPreferences текущие настройки рассылки пользователя
+func mailingPreferences(tx *gorm.DB, userID uint) (events.MailingPreferencePayload, error) {
+	var user models.User
+	if err := tx.First(&user, userID).Error; err != nil {
+		return events.MailingPreferencePayload{}, err
+	}
+	payload := events.MailingPreferencePayload{
+		UserID:    user.ID,
+		Mailing:   user.Mailing,
+		Frequency: user.MailingFrequency,
+		Locale:    user.Locale,
+		GenreIDs:  []uint{},
+		Authors:   []string{},
+	}
+	if err := tx.Model(&models.GenreSubscription{}).Where("user_id = ?", userID).Order("genre_id").Pluck("genre_id", &payload.GenreIDs).Error; err != nil {
+		return payload, err
+	}
+	if err := tx.Model(&models.AuthorSubscription{}).Where("user_id = ?", userID).Order("author").Pluck("author", &payload.Authors).Error; err != nil {
+		return payload, err
+	}
+	return payload, nil
+}
+
+// changeMailingPreferences выполняет change и сохраняет в outbox MailingPreferenceChanged с новыми настройками
+// рассылки пользователя, а в журнал аудита – настройки до и после изменения
+func changeMailingPreferences(tx *gorm.DB, meta audit.Meta, action string, userID uint, change func() error) error {
+	before, err := mailingPreferences(tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	after, err := mailingPreferences(tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := events.Enqueue(tx, events.MailingPreferenceChanged, meta.Actor, userID, after); err != nil {
+		return err
+	}
+	return audit.Record(tx, meta, action, userID, before, after)
+}
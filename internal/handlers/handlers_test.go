@@ -1,19 +1,32 @@
 package handlers_test
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"library/internal/audit"
+	"library/internal/auth"
 	"library/internal/database"
+	"library/internal/events"
 	"library/internal/handlers"
+	"library/internal/mailing"
 	"library/internal/models"
+	"library/internal/stream"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWelcomeHandler(t *testing.T) {
@@ -442,11 +455,13 @@ func TestGetBooks(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	var responseBooks []models.Book
-	err = json.Unmarshal(recorder.Body.Bytes(), &responseBooks)
+	var response models.ResponseGetBooks
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	assert.Equal(t, 3, response.TotalBooks)
+	responseBooks := response.Books
 
-	assert.Len(t, responseBooks, 3)
+	require.Len(t, responseBooks, 3)
 	assert.Equal(t, book1.Author, responseBooks[0].Author)
 	assert.Equal(t, book1.PublishedYear, responseBooks[0].PublishedYear)
 	assert.Equal(t, book1.Title, responseBooks[0].Title)
@@ -470,11 +485,12 @@ func TestGetBooks(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	responseBooks = []models.Book{}
-	err = json.Unmarshal(recorder.Body.Bytes(), &responseBooks)
+	response = models.ResponseGetBooks{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	responseBooks = response.Books
 
-	assert.Len(t, responseBooks, 3)
+	require.Len(t, responseBooks, 3)
 	assert.Equal(t, book1.Author, responseBooks[0].Author)
 	assert.Equal(t, book1.PublishedYear, responseBooks[0].PublishedYear)
 	assert.Equal(t, book1.Title, responseBooks[0].Title)
@@ -495,11 +511,12 @@ func TestGetBooks(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	responseBooks = []models.Book{}
-	err = json.Unmarshal(recorder.Body.Bytes(), &responseBooks)
+	response = models.ResponseGetBooks{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	responseBooks = response.Books
 
-	assert.Len(t, responseBooks, 3)
+	require.Len(t, responseBooks, 3)
 	assert.Equal(t, book1.Author, responseBooks[2].Author)
 	assert.Equal(t, book1.PublishedYear, responseBooks[2].PublishedYear)
 	assert.Equal(t, book1.Title, responseBooks[2].Title)
@@ -520,11 +537,12 @@ func TestGetBooks(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	responseBooks = []models.Book{}
-	err = json.Unmarshal(recorder.Body.Bytes(), &responseBooks)
+	response = models.ResponseGetBooks{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	responseBooks = response.Books
 
-	assert.Len(t, responseBooks, 3)
+	require.Len(t, responseBooks, 3)
 	assert.Equal(t, book1.Author, responseBooks[1].Author)
 	assert.Equal(t, book1.PublishedYear, responseBooks[1].PublishedYear)
 	assert.Equal(t, book1.Title, responseBooks[1].Title)
@@ -537,6 +555,7 @@ func TestGetBooks(t *testing.T) {
 	assert.Equal(t, book3.PublishedYear, responseBooks[2].PublishedYear)
 	assert.Equal(t, book3.Title, responseBooks[2].Title)
 
+	// Неизвестное поле сортировки заменяется сортировкой по id
 	req, err = http.NewRequest(http.MethodGet, "/getBooks?sort=zxc", nil)
 	assert.NoError(t, err)
 
@@ -545,11 +564,12 @@ func TestGetBooks(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	responseBooks = []models.Book{}
-	err = json.Unmarshal(recorder.Body.Bytes(), &responseBooks)
+	response = models.ResponseGetBooks{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	responseBooks = response.Books
 
-	assert.Len(t, responseBooks, 3)
+	require.Len(t, responseBooks, 3)
 	assert.Equal(t, book1.Author, responseBooks[0].Author)
 	assert.Equal(t, book1.PublishedYear, responseBooks[0].PublishedYear)
 	assert.Equal(t, book1.Title, responseBooks[0].Title)
@@ -716,3 +736,499 @@ func TestModifyingBook(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 
 }
+
+func TestSubscriptions(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Reader", Email: "reader@example.com", Role: "reader", Mailing: true}
+	assert.NoError(t, db.Create(&user).Error)
+	genre := models.Genre{Name: "Детектив"}
+	assert.NoError(t, db.Create(&genre).Error)
+
+	router := gin.Default()
+	router.Use(func(c *gin.Context) {
+		auth.SetClaims(c, &auth.MyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: fmt.Sprint(user.ID)}})
+	})
+	router.GET("/getSubscriptions", handlers.GetSubscriptions(db))
+	router.POST("/addSubscription", handlers.AddSubscription(db))
+	router.POST("/removeSubscription", handlers.RemoveSubscription(db))
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/addSubscription", gin.H{"genre_id": genre.ID}).Code)
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/addSubscription", gin.H{"author": "  Агата   Кристи "}).Code)
+	// Повторная подписка не создает дубликат
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/addSubscription", gin.H{"genre_id": genre.ID}).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/addSubscription", gin.H{"genre_id": 999}).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/addSubscription", gin.H{"genre_id": genre.ID, "author": "Агата Кристи"}).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/addSubscription", gin.H{}).Code)
+
+	recorder := send(http.MethodGet, "/getSubscriptions", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var subscriptions handlers.SubscriptionsResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &subscriptions))
+	assert.True(t, subscriptions.Mailing)
+	assert.Equal(t, []handlers.GenreSubscriptionResponse{{ID: genre.ID, Name: "Детектив"}}, subscriptions.Genres)
+	assert.Equal(t, []string{"агата кристи"}, subscriptions.Authors)
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/removeSubscription", gin.H{"author": "Агата Кристи"}).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/removeSubscription", gin.H{"author": "Агата Кристи"}).Code)
+}
+
+func TestUnsubscribeMailingLink(t *testing.T) {
+	t.Setenv("UNSUBSCRIBE_SECRET", "test-secret")
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Reader", Email: "reader@example.com", Role: "reader", Mailing: true}
+	assert.NoError(t, db.Create(&user).Error)
+
+	router := gin.Default()
+	router.Use(func(c *gin.Context) {
+		auth.SetClaims(c, &auth.MyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: fmt.Sprint(user.ID)}})
+	})
+	router.GET("/unsubMailing", handlers.UnsubscribeMailingLink(db))
+
+	req, err := http.NewRequest(http.MethodGet, "/unsubMailing", nil)
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	// Старая ссылка ведет на страницу подтверждения и сама не отписывает
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, "/unsubscribe?token="+url.QueryEscape(mailing.UnsubscribeToken(user)), recorder.Header().Get("Location"))
+	assert.NoError(t, db.First(&user, user.ID).Error)
+	assert.True(t, user.Mailing)
+}
+
+func TestOutboxEmails(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	sent := time.Now()
+	emails := []models.OutboxEmail{
+		{Recipient: "sent@example.com", Subject: "Hello", HTMLBody: "<p>Body</p>", Status: models.EmailSent, Attempts: 1, SentAt: &sent},
+		{Recipient: "dead@example.com", Subject: "Hello", HTMLBody: "<p>Body</p>", Status: models.EmailDead, Attempts: 8, LastError: "550 mailbox unavailable"},
+	}
+	assert.NoError(t, db.Create(&emails).Error)
+
+	router := gin.Default()
+	router.GET("/getOutboxEmails", handlers.GetOutboxEmails(db))
+	router.POST("/retryOutboxEmail", handlers.RetryOutboxEmail(db))
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := send(http.MethodGet, "/getOutboxEmails?status=dead", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response handlers.OutboxEmailsResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, int64(1), response.TotalEmails)
+	if assert.Len(t, response.Emails, 1) {
+		assert.Equal(t, "dead@example.com", response.Emails[0].Recipient)
+		assert.Equal(t, "550 mailbox unavailable", response.Emails[0].LastError)
+	}
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/getOutboxEmails?status=lost", nil).Code)
+
+	assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/retryOutboxEmail", gin.H{"id": emails[0].ID}).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/retryOutboxEmail", gin.H{"id": 999}).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/retryOutboxEmail", gin.H{"id": emails[1].ID}).Code)
+
+	var retried models.OutboxEmail
+	assert.NoError(t, db.First(&retried, emails[1].ID).Error)
+	assert.Equal(t, models.EmailPending, retried.Status)
+	assert.Equal(t, 0, retried.Attempts)
+}
+
+func TestPreviewEmailTemplate(t *testing.T) {
+	router := gin.Default()
+	router.GET("/previewEmailTemplate", handlers.PreviewEmailTemplate)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := get("/previewEmailTemplate?name=digest&locale=en")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var preview handlers.EmailPreviewResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &preview))
+	assert.Equal(t, "New books in the library", preview.Subject)
+	assert.Contains(t, preview.HTML, "Concurrency in Go")
+	assert.Contains(t, preview.Text, "Concurrency in Go")
+
+	recorder = get("/previewEmailTemplate?name=account_locked&format=html")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, recorder.Body.String(), "203.0.113.7")
+
+	assert.Equal(t, http.StatusNotFound, get("/previewEmailTemplate?name=unknown").Code)
+}
+
+type recordingPublisher struct {
+	published []events.Envelope
+}
+
+func (p *recordingPublisher) Publish(envelope events.Envelope) error {
+	p.published = append(p.published, envelope)
+	return nil
+}
+
+func TestCatalogEvents(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	publisher := &recordingPublisher{}
+	events.SetPublisher(publisher)
+	defer events.SetPublisher(nil)
+
+	genre := models.Genre{Name: "Детектив"}
+	assert.NoError(t, db.Create(&genre).Error)
+	book := models.Book{Title: "Test title", Author: "Test author", Genres: []models.Genre{genre}}
+	assert.NoError(t, db.Create(&book).Error)
+	user := models.User{Name: "Admin", Email: "admin@example.com", Role: "admin", Mailing: true}
+	assert.NoError(t, db.Create(&user).Error)
+
+	router := gin.Default()
+	router.Use(func(c *gin.Context) {
+		auth.SetClaims(c, &auth.MyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: fmt.Sprint(user.ID)}})
+	})
+	router.POST("/addBook", handlers.AddBook(db))
+	router.POST("/modifyingBook", handlers.ModifyingBook(db))
+	router.DELETE("/deleteBook", handlers.DeleteBook(db))
+	router.POST("/setMailingFrequency", handlers.SetMailingFrequency(db))
+
+	send := func(method, path string, body interface{}) int {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/addBook", handlers.AddBookRequest{Title: "New title", Author: "New author", Genre: []string{"Детектив"}, Published_year: "2024"}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/modifyingBook", handlers.ModifyingBookRequest{Id: book.ID, Genre: []string{"детектив", "Фантастика"}}))
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/deleteBook", handlers.DeleteBookRequest{ID: book.ID}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/setMailingFrequency", gin.H{"frequency": "weekly"}))
+
+	_, err := events.Relay(db, time.Now())
+	assert.NoError(t, err)
+
+	var types []string
+	for _, envelope := range publisher.published {
+		types = append(types, envelope.Type)
+		assert.Equal(t, "user:"+fmt.Sprint(user.ID), envelope.Actor)
+	}
+	assert.Equal(t, []string{events.BookAdded, events.GenreCreated, events.BookUpdated, events.BookDeleted, events.MailingPreferenceChanged}, types)
+
+	var added models.Book
+	assert.NoError(t, db.Where("title = ?", "New title").First(&added).Error)
+	assert.Equal(t, fmt.Sprint("book:", added.ID), publisher.published[0].Key)
+	var addedPayload events.BookPayload
+	assert.NoError(t, publisher.published[0].DecodePayload(&addedPayload))
+	assert.Equal(t, []events.GenrePayload{{ID: genre.ID, Name: "Детектив"}}, addedPayload.Genres)
+
+	var created models.Genre
+	assert.NoError(t, db.Where("name = ?", "Фантастика").First(&created).Error)
+	assert.Equal(t, fmt.Sprint("genre:", created.ID), publisher.published[1].Key)
+	assert.Equal(t, fmt.Sprint("book:", book.ID), publisher.published[2].Key)
+	assert.Equal(t, fmt.Sprint("book:", book.ID), publisher.published[3].Key)
+
+	var updated events.BookPayload
+	assert.NoError(t, publisher.published[2].DecodePayload(&updated))
+	assert.Len(t, updated.Genres, 2)
+
+	var preferences events.MailingPreferencePayload
+	assert.NoError(t, publisher.published[4].DecodePayload(&preferences))
+	assert.Equal(t, events.MailingPreferencePayload{UserID: user.ID, Mailing: true, Frequency: "weekly", Locale: "ru", GenreIDs: []uint{}, Authors: []string{}}, preferences)
+}
+
+func TestWebhooks(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	router := gin.Default()
+	router.Use(func(c *gin.Context) {
+		auth.SetClaims(c, &auth.MyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}})
+	})
+	router.POST("/createWebhook", handlers.CreateWebhook(db))
+	router.GET("/getWebhooks", handlers.GetWebhooks(db))
+	router.POST("/updateWebhook", handlers.UpdateWebhook(db))
+	router.DELETE("/deleteWebhook", handlers.DeleteWebhook(db))
+	router.GET("/getWebhookDeliveries", handlers.GetWebhookDeliveries(db))
+	router.GET("/getWebhookDeliveryAttempts", handlers.GetWebhookDeliveryAttempts(db))
+	router.POST("/retryWebhookDelivery", handlers.RetryWebhookDelivery(db))
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/createWebhook", gin.H{"url": "ftp://partner.example.com", "event_types": []string{"BookAdded"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/createWebhook", gin.H{"url": "https://partner.example.com", "event_types": []string{"UserRegistered"}}).Code)
+
+	recorder := send(http.MethodPost, "/createWebhook", gin.H{"url": "https://partner.example.com/hook", "event_types": []string{"BookAdded", "BookUpdated"}})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var created handlers.CreateWebhookResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+	assert.Contains(t, created.Secret, "whsec_")
+	assert.Equal(t, []string{"BookAdded", "BookUpdated"}, created.EventTypes)
+	assert.True(t, created.Active)
+	assert.Equal(t, uint(1), created.CreatedByID)
+
+	// Секрет не возвращается в списке вебхуков
+	recorder = send(http.MethodGet, "/getWebhooks", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), created.Secret)
+
+	// Включение отключенного вебхука сбрасывает счетчик неудач
+	disabledAt := time.Now()
+	assert.NoError(t, db.Model(&models.Webhook{}).Where("id = ?", created.ID).
+		Updates(map[string]interface{}{"active": false, "consecutive_failures": 20, "disabled_at": disabledAt}).Error)
+	recorder = send(http.MethodPost, "/updateWebhook", gin.H{"id": created.ID, "active": true, "event_types": []string{"BookDeleted"}})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var webhook models.Webhook
+	assert.NoError(t, db.First(&webhook, created.ID).Error)
+	assert.True(t, webhook.Active)
+	assert.Equal(t, 0, webhook.ConsecutiveFailures)
+	assert.Nil(t, webhook.DisabledAt)
+	assert.Equal(t, "BookDeleted", webhook.EventTypes)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/updateWebhook", gin.H{"id": 999, "active": true}).Code)
+
+	deliveries := []models.WebhookDelivery{
+		{WebhookID: webhook.ID, EventID: "e1", EventType: events.BookDeleted, Payload: "{}", Status: models.DeliveryDelivered, Attempts: 1},
+		{WebhookID: webhook.ID, EventID: "e2", EventType: events.BookDeleted, Payload: "{}", Status: models.DeliveryFailed, Attempts: 8, LastStatusCode: 500, LastError: "unexpected response status 500"},
+	}
+	assert.NoError(t, db.Create(&deliveries).Error)
+
+	recorder = send(http.MethodGet, fmt.Sprintf("/getWebhookDeliveries?webhook_id=%d&status=failed", webhook.ID), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response handlers.WebhookDeliveriesResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, int64(1), response.TotalDeliveries)
+	if assert.Len(t, response.Deliveries, 1) {
+		assert.Equal(t, "e2", response.Deliveries[0].EventID)
+		assert.Equal(t, 500, response.Deliveries[0].LastStatusCode)
+	}
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/getWebhookDeliveries?status=lost", nil).Code)
+
+	attempts := []models.WebhookDeliveryAttempt{
+		{DeliveryID: deliveries[1].ID, AttemptedAt: time.Now().Add(-time.Minute), StatusCode: 503, LatencyMs: 120, ResponseExcerpt: "maintenance", Error: "unexpected response status 503: maintenance"},
+		{DeliveryID: deliveries[1].ID, AttemptedAt: time.Now(), StatusCode: 500, LatencyMs: 80, Error: "unexpected response status 500"},
+	}
+	assert.NoError(t, db.Create(&attempts).Error)
+	recorder = send(http.MethodGet, fmt.Sprintf("/getWebhookDeliveryAttempts?delivery_id=%d", deliveries[1].ID), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var attemptsResponse []handlers.WebhookDeliveryAttemptResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &attemptsResponse))
+	if assert.Len(t, attemptsResponse, 2) {
+		assert.Equal(t, 503, attemptsResponse[0].StatusCode)
+		assert.Equal(t, "maintenance", attemptsResponse[0].ResponseExcerpt)
+		assert.Equal(t, int64(80), attemptsResponse[1].LatencyMs)
+	}
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/getWebhookDeliveryAttempts?delivery_id=999", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/getWebhookDeliveryAttempts", nil).Code)
+
+	assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/retryWebhookDelivery", gin.H{"id": deliveries[0].ID}).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/retryWebhookDelivery", gin.H{"id": 999}).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/retryWebhookDelivery", gin.H{"id": deliveries[1].ID}).Code)
+
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/deleteWebhook", gin.H{"id": webhook.ID}).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "/deleteWebhook", gin.H{"id": webhook.ID}).Code)
+}
+
+func TestStreamCatalog(t *testing.T) {
+	hub := stream.NewHub(10)
+	router := gin.New()
+	router.GET("/streamCatalog", handlers.StreamCatalog(hub, 50*time.Millisecond))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	newEvent := func(id, genreID uint) events.Envelope {
+		envelope, err := events.New(events.BookAdded, "", id, events.BookPayload{ID: id, Title: "Книга", Genres: []events.GenrePayload{{ID: genreID}}})
+		assert.NoError(t, err)
+		return envelope
+	}
+	first := newEvent(1, 1)
+	assert.NoError(t, hub.Handle(first))
+
+	resp, err := http.Get(server.URL + "/streamCatalog?genre_id=abc")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	// Клиент продолжает чтение после first и получает только книги жанра 2
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/streamCatalog?genre_id=2", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", first.ID)
+	resp, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	second, third := newEvent(2, 1), newEvent(3, 2)
+	assert.NoError(t, hub.Handle(second))
+	assert.NoError(t, hub.Handle(third))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 20 {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+		if slices.Contains(lines, ": heartbeat") && slices.Contains(lines, "id: "+third.ID) {
+			break
+		}
+	}
+	assert.Contains(t, lines, "event: added")
+	assert.Contains(t, lines, "data: "+string(third.Payload))
+	assert.NotContains(t, lines, "id: "+second.ID)
+}
+
+func TestAuditLog(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Reader", Email: "reader@example.com", Role: "reader", Mailing: true, Password: "secret-hash"}
+	assert.NoError(t, db.Create(&user).Error)
+	assert.NoError(t, db.Create(&models.Role{Name: "librarian"}).Error)
+
+	router := gin.Default()
+	router.Use(func(c *gin.Context) {
+		auth.SetClaims(c, &auth.MyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}})
+		audit.SetRequestID(c, "req-1")
+	})
+	router.POST("/addBook", handlers.AddBook(db))
+	router.POST("/modifyingBook", handlers.ModifyingBook(db))
+	router.DELETE("/deleteBook", handlers.DeleteBook(db))
+	router.POST("/setUserRole", handlers.SetUserRole(db))
+	router.GET("/getAuditLog", handlers.GetAuditLog(db))
+	router.GET("/exportAuditLog", handlers.ExportAuditLog(db))
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(data))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.10:1234"
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/addBook", gin.H{"title": "Старое название", "author": "Автор", "published_year": "2020", "genre": []string{"Роман"}}).Code)
+	var book models.Book
+	assert.NoError(t, db.First(&book).Error)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/modifyingBook", gin.H{"id": book.ID, "title": "Новое название"}).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/deleteBook", gin.H{"id": book.ID}).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/setUserRole", gin.H{"user_id": user.ID, "role": "librarian"}).Code)
+
+	recorder := send(http.MethodGet, fmt.Sprintf("/getAuditLog?actor=user:1&entity_type=book&entity_id=%d", book.ID), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response handlers.AuditLogResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, int64(3), response.TotalEntries)
+	if assert.Len(t, response.Entries, 3) {
+		assert.Equal(t, "book.create", response.Entries[0].Action)
+		assert.Equal(t, "null", string(response.Entries[0].Before))
+
+		// В изменении сохраняются только измененные поля
+		update := response.Entries[1]
+		assert.Equal(t, "book.update", update.Action)
+		assert.JSONEq(t, `{"title": "Старое название"}`, string(update.Before))
+		assert.JSONEq(t, `{"title": "Новое название"}`, string(update.After))
+		assert.Equal(t, "192.0.2.10", update.IP)
+		assert.Equal(t, "req-1", update.RequestID)
+
+		assert.Equal(t, "book.delete", response.Entries[2].Action)
+		assert.Equal(t, "null", string(response.Entries[2].After))
+	}
+
+	// Пароль пользователя не попадает в журнал
+	recorder = send(http.MethodGet, "/exportAuditLog?entity_type=user&from="+time.Now().Add(-time.Hour).Format(time.RFC3339), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/x-ndjson", recorder.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if assert.Len(t, lines, 1) {
+		var entry audit.Entry
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, "user.set_role", entry.Action)
+		assert.JSONEq(t, `{"role": "reader"}`, string(entry.Before))
+		assert.JSONEq(t, `{"role": "librarian"}`, string(entry.After))
+	}
+	assert.NotContains(t, recorder.Body.String(), "secret-hash")
+
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/getAuditLog?from=yesterday", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/exportAuditLog?to=2024-13-01", nil).Code)
+}
+
+func TestLoginTwoFactorEnableAudit(t *testing.T) {
+	t.Setenv("JWTCoo_expires_time_sec", "60")
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Admin", Email: "admin@example.com", Role: "admin"}
+	assert.NoError(t, db.Create(&user).Error)
+	setup, err := auth.BeginTOTPSetup(db, &user)
+	assert.NoError(t, err)
+	token, err := auth.StartTwoFactorLogin(user)
+	assert.NoError(t, err)
+	code, err := auth.TOTPCode(setup.Secret, time.Now())
+	assert.NoError(t, err)
+
+	router := gin.Default()
+	router.POST("/login2FA", handlers.LoginTwoFactor(db))
+	data, _ := json.Marshal(gin.H{"two_factor_token": token, "code": code})
+	req, err := http.NewRequest(http.MethodPost, "/login2FA", bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Включение 2FA при входе записывается в журнал так же, как через /enable2FA
+	var entry models.AuditLog
+	assert.NoError(t, db.Where("action = ?", "user.enable_2fa").First(&entry).Error)
+	assert.Equal(t, fmt.Sprintf("user:%d", user.ID), entry.Actor)
+	assert.Equal(t, fmt.Sprint(user.ID), entry.EntityID)
+	assert.JSONEq(t, `{"totp_enabled": false}`, string(entry.Before))
+	assert.JSONEq(t, `{"totp_enabled": true}`, string(entry.After))
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"library/internal/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS
+// @Summary      JSON Web Key Set
+// @Description  Returns public keys for local verification of JWTs issued by the API.
+// @Description  Tokens carry the "kid" header of the key that signed them. HS256 secrets are never published.
+// @Tags         user
+// @Produce      json
+// @Success      200  {object}  auth.JWKS
+// @Router       /.well-known/jwks.json [get]
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, auth.CurrentJWKS())
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/auth"
+	"library/internal/oidc"
+	"library/logger"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// OIDCLogin
+// @Summary      Login via OpenID Connect
+// @Description  Redirects to the identity provider (authorization code flow with PKCE)
+// @Tags         user
+// @Param        device  query  string  false  "Device label of the new session"
+// @Success      302
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /oidc/login [get]
+func OIDCLogin(provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		}
+
+		redirectURL, err := provider.StartLogin(c.Query("device"))
+		if err != nil {
+			logger.ErrorLog.Println("Failed to start OIDC login\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start OIDC login"})
+			return
+		}
+		c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// OIDCCallback
+// @Summary      OpenID Connect callback
+// @Description  Exchanges the authorization code for an ID token, links the user to the external subject and creates a session.
+// @Description  Tokens are set in cookies. If a post-login redirect is configured, the user is redirected there.
+// @Description  If the user has 2FA enabled or it is mandatory for the role, responds 202 with a "two_factor_token"
+// @Description  instead, exactly like /login; the session is created by /login2FA.
+// @Tags         user
+// @Produce      json
+// @Param        code   query  string  true  "Authorization code"
+// @Param        state  query  string  true  "State"
+// @Success      200  {object}  map[string]string
+// @Success      202  {object}  TwoFactorChallengeResponse
+// @Success      302
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      502  {object}  map[string]string
+// @Router       /oidc/callback [get]
+func OIDCCallback(db *gorm.DB, provider *oidc.Provider, postLoginRedirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		}
+		if providerError := c.Query("error"); providerError != "" {
+			logger.InfoLog.Println("OIDC provider returned error:", providerError, c.Query("error_description"))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed: " + providerError})
+			return
+		}
+
+		claims, device, err := provider.FinishLogin(c.Request.Context(), c.Query("code"), c.Query("state"))
+		if err != nil {
+			switch {
+			case errors.Is(err, oidc.ErrInvalidState):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+			case errors.Is(err, oidc.ErrInvalidIDToken):
+				logger.InfoLog.Println("Rejected OIDC id token\tError:", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+			default:
+				logger.ErrorLog.Println("Failed to finish OIDC login\tError:", err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to complete login with identity provider"})
+			}
+			return
+		}
+
+		user, err := provider.LinkUser(db, claims, auditMeta(c))
+		if err != nil {
+			if errors.Is(err, oidc.ErrEmailConflict) {
+				c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists, the provider did not verify the email"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to link OIDC user", claims.Subject, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to login"})
+			return
+		}
+
+		// Провайдер не сообщает, проверил ли он второй фактор, поэтому правила 2FA те же, что и для входа по паролю
+		if auth.NeedsTwoFactor(user) {
+			startTwoFactorLogin(c, user)
+			return
+		}
+
+		if _, _, err := auth.CreateSession(c, db, user, device); err != nil {
+			logger.ErrorLog.Println("Failed to create session when logining\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
+		}
+		logger.InfoLog.Printf("User %d logged in via OIDC (%s)", user.ID, claims.Issuer)
+
+		if postLoginRedirect != "" {
+			c.Redirect(http.StatusFound, postLoginRedirect)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User authorization successfully"})
+	}
+}
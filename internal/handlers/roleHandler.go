@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/cache"
+	"library/internal/events"
+	"library/internal/models"
+	"library/internal/rbac"
+	"library/logger"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SetRolePermissionsRequest структура запроса для изменения разрешений роли
+// @Schema example={"role": "librarian", "permissions": ["book:read", "book:write"]}
+type SetRolePermissionsRequest struct {
+	Role        string   `json:"role" binding:"required" example:"librarian"`
+	Permissions []string `json:"permissions" example:"book:read,book:write"`
+}
+
+// SetUserRoleRequest структура запроса для назначения роли пользователю
+// @Schema example={"user_id": 1, "role": "librarian"}
+type SetUserRoleRequest struct {
+	UserID uint   `json:"user_id" binding:"required" example:"1"`
+	Role   string `json:"role" binding:"required" example:"librarian"`
+}
+
+// GetRoles
+// @Summary      Get roles
+// @Description  Returns all roles with their permissions
+// @Description  Requires the "user:manage" permission.
+// @Tags         role
+// @Accept       json
+// @Produce      json
+// @Success      200  {array}   models.Role
+// @Failure      500  {object}  map[string]string
+// @Router       /getRoles [get]
+func GetRoles(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var roles []models.Role
+		if err := db.Preload("Permissions").Order("id").Find(&roles).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get roles\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get roles"})
+			return
+		}
+
+		c.JSON(http.StatusOK, roles)
+	}
+}
+
+// GetPermissions
+// @Summary      Get permissions
+// @Description  Returns all permissions that can be assigned to roles
+// @Description  Requires the "user:manage" permission.
+// @Tags         role
+// @Accept       json
+// @Produce      json
+// @Success      200  {array}   models.Permission
+// @Failure      500  {object}  map[string]string
+// @Router       /getPermissions [get]
+func GetPermissions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var permissions []models.Permission
+		if err := db.Order("name").Find(&permissions).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get permissions\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get permissions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, permissions)
+	}
+}
+
+// SetRolePermissions
+// @Summary      Set role permissions
+// @Description  Replaces the permissions of the role. The role is created if it does not exist.
+// @Description  Requires the "user:manage" permission.
+// @Tags         role
+// @Accept       json
+// @Produce      json
+// @Param        role  body  SetRolePermissionsRequest  true  "Role Data"  example({"role": "librarian", "permissions": ["book:read", "book:write"]})
+// @Success      200  {object}  models.Role
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /setRolePermissions [post]
+func SetRolePermissions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request SetRolePermissionsRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var role models.Role
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var before any
+			var existing models.Role
+			err := tx.Preload("Permissions").Where("name = ?", request.Role).First(&existing).Error
+			switch {
+			case err == nil:
+				before = newRoleSnapshot(existing)
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				return err
+			}
+
+			if role, err = rbac.SetRolePermissions(tx, request.Role, request.Permissions); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "role.set_permissions", role.Name, before, newRoleSnapshot(role))
+		})
+		if err != nil {
+			if errors.Is(err, rbac.ErrUnknownPermission) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			logger.ErrorLog.Println("Failed to set permissions of role", request.Role, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set role permissions"})
+			return
+		}
+		cache.DeleteRolePermissions(role.Name)
+		logger.InfoLog.Println("Permissions of role", request.Role, "changed to", request.Permissions)
+
+		c.JSON(http.StatusOK, role)
+	}
+}
+
+// SetUserRole
+// @Summary      Set user role
+// @Description  Assigns an existing role to the user. The new role applies after the user's JWT is refreshed.
+// @Description  Requires the "user:manage" permission.
+// @Tags         role
+// @Accept       json
+// @Produce      json
+// @Param        user  body  SetUserRoleRequest  true  "User Role"  example({"user_id": 1, "role": "librarian"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /setUserRole [post]
+func SetUserRole(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request SetUserRoleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var role models.Role
+		if err := db.Where("name = ?", request.Role).First(&role).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve role"})
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, request.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+			return
+		}
+
+		before := audit.NewUserSnapshot(user)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&user).Update("role", role.Name).Error; err != nil {
+				return err
+			}
+			payload := events.UserRoleChangedPayload{UserID: user.ID, Role: user.Role, PreviousRole: before.Role}
+			if err := events.Enqueue(tx, events.UserRoleChanged, eventActor(c), user.ID, payload); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "user.set_role", user.ID, before, audit.NewUserSnapshot(user))
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to set role of user", user.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set user role"})
+			return
+		}
+		logger.InfoLog.Printf("Role of user %d changed to %s", user.ID, role.Name)
+
+		c.JSON(http.StatusOK, gin.H{"message": "User role changed successfully", "role": role.Name})
+	}
+}
+
+// roleSnapshot роль с названиями ее разрешений для журнала аудита
+type roleSnapshot struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+func newRoleSnapshot(role models.Role) roleSnapshot {
+	snapshot := roleSnapshot{Name: role.Name, Permissions: make([]string, 0, len(role.Permissions))}
+	for _, permission := range role.Permissions {
+		snapshot.Permissions = append(snapshot.Permissions, permission.Name)
+	}
+	slices.Sort(snapshot.Permissions)
+	return snapshot
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/auth"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SessionResponse информация о сессии пользователя
+type SessionResponse struct {
+	ID          uint      `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// RevokeSessionRequest структура запроса для отзыва сессии
+// @Schema example={"id": 1}
+type RevokeSessionRequest struct {
+	ID uint `json:"id" binding:"required" example:"1"`
+}
+
+// GetSessions
+// @Summary      Get active sessions
+// @Description  Returns active sessions of the current user on all devices
+// @Description  JWT authentication via cookie.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Success      200  {array}   SessionResponse
+// @Failure      401  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getSessions [get]
+func GetSessions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+			return
+		}
+		if claims.IsAPIKey() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Sessions are not available for API keys"})
+			return
+		}
+
+		var sessions []models.Session
+		if err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", claims.Subject, time.Now()).
+			Order("last_used_at desc").Find(&sessions).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get sessions of user", claims.Subject, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sessions"})
+			return
+		}
+
+		response := make([]SessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, SessionResponse{
+				ID:          session.ID,
+				DeviceLabel: session.DeviceLabel,
+				IP:          session.IP,
+				UserAgent:   session.UserAgent,
+				CreatedAt:   session.CreatedAt,
+				LastUsedAt:  session.LastUsedAt,
+				ExpiresAt:   session.ExpiresAt,
+				Current:     session.ID == claims.SessionID,
+			})
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RevokeSession
+// @Summary      Revoke session
+// @Description  Revokes one of the current user's sessions. The device is logged out when its JWT expires.
+// @Description  JWT authentication via cookie.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Param        session  body  RevokeSessionRequest  true  "Session"  example({"id": 1})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /revokeSession [post]
+func RevokeSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+			return
+		}
+		if claims.IsAPIKey() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Sessions are not available for API keys"})
+			return
+		}
+
+		var request RevokeSessionRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var session models.Session
+		if err := db.Where("id = ? AND user_id = ?", request.ID, claims.Subject).First(&session).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve session"})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return revokeSession(tx, auditMeta(c), "session.revoke", session)
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to revoke session", session.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+		auth.ForgetSessionStatus(session.ID)
+		logger.InfoLog.Printf("Session %d of user %s revoked", session.ID, claims.Subject)
+
+		if session.ID == claims.SessionID {
+			auth.ClearAuthCookies(c)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully", "id": session.ID})
+	}
+}
+
+// sessionSnapshot поля сессии, которые попадают в журнал аудита
+type sessionSnapshot struct {
+	ID          uint       `json:"id"`
+	UserID      uint       `json:"user_id"`
+	DeviceLabel string     `json:"device_label"`
+	IP          string     `json:"ip"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+func newSessionSnapshot(session models.Session) sessionSnapshot {
+	return sessionSnapshot{
+		ID:          session.ID,
+		UserID:      session.UserID,
+		DeviceLabel: session.DeviceLabel,
+		IP:          session.IP,
+		RevokedAt:   session.RevokedAt,
+	}
+}
+
+// revokeSession отзывает сессию и записывает это в журнал аудита
+func revokeSession(tx *gorm.DB, meta audit.Meta, action string, session models.Session) error {
+	if err := auth.RevokeSession(tx, session.ID); err != nil {
+		return err
+	}
+	var revoked models.Session
+	if err := tx.First(&revoked, session.ID).Error; err != nil {
+		return err
+	}
+	return audit.Record(tx, meta, action, session.ID, newSessionSnapshot(session), newSessionSnapshot(revoked))
+}
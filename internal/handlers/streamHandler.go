@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"library/internal/stream"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamCatalog
+// @Summary      Stream catalog changes
+// @Description  Server-Sent Events stream of catalog changes: "added", "updated" and "deleted" events with the book
+// @Description  as data and the event ID as the SSE id. After reconnecting, the stream continues after the
+// @Description  Last-Event-ID header (or the last_event_id query parameter) from a short server-side buffer;
+// @Description  if that event is no longer buffered, a "reset" event asks the client to reload the catalog.
+// @Description  Heartbeat comments are sent to keep the connection open.
+// @Tags         book
+// @Produce      text/event-stream
+// @Param        genre_id       query   string  false  "Comma-separated genre IDs; only books of these genres are streamed"
+// @Param        last_event_id  query   string  false  "ID of the last received event, for clients that cannot send headers"
+// @Param        Last-Event-ID  header  string  false  "ID of the last received event"
+// @Success      200  {string}  string  "event stream"
+// @Failure      400  {object}  map[string]string
+// @Router       /streamCatalog [get]
+func StreamCatalog(hub *stream.Hub, heartbeat time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var genreIDs []uint
+		for _, value := range strings.Split(c.Query("genre_id"), ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid genre_id"})
+				return
+			}
+			genreIDs = append(genreIDs, uint(id))
+		}
+		lastEventID := c.GetHeader("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("last_event_id")
+		}
+
+		subscription, backlog := hub.Subscribe(lastEventID, genreIDs)
+		defer subscription.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no") // nginx не должен буферизовать поток
+		c.Status(http.StatusOK)
+
+		fmt.Fprint(c.Writer, ": connected\n\n")
+		for _, event := range backlog {
+			writeStreamEvent(c.Writer, event)
+		}
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case event, ok := <-subscription.Events():
+				if !ok {
+					// Клиент не успевал читать события: он переподключится и продолжит с Last-Event-ID
+					return
+				}
+				writeStreamEvent(c.Writer, event)
+			case <-ticker.C:
+				fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			case <-c.Request.Context().Done():
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeStreamEvent записывает событие в формате Server-Sent Events
+func writeStreamEvent(w io.Writer, event stream.Event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
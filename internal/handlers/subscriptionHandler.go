@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/auth"
+	"library/internal/mailing"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SubscriptionRequest структура запроса для подписки на жанр или автора. Указывается ровно одно поле
+// @Schema example={"genre_id": 1}
+type SubscriptionRequest struct {
+	GenreID uint   `json:"genre_id" example:"1"`
+	Author  string `json:"author" example:"Агата Кристи"`
+}
+
+// MailingFrequencyRequest структура запроса для выбора частоты рассылки
+// @Schema example={"frequency": "daily"}
+type MailingFrequencyRequest struct {
+	Frequency string `json:"frequency" binding:"required,oneof=immediate daily weekly" example:"daily"`
+}
+
+// MailingLocaleRequest структура запроса для выбора языка писем
+// @Schema example={"locale": "en"}
+type MailingLocaleRequest struct {
+	Locale string `json:"locale" binding:"required,oneof=ru en" example:"en"`
+}
+
+// GenreSubscriptionResponse жанр, на который подписан пользователь
+type GenreSubscriptionResponse struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// SubscriptionsResponse подписки пользователя. Без подписок приходят письма обо всех новых книгах
+type SubscriptionsResponse struct {
+	Mailing   bool                        `json:"mailing"`
+	Frequency string                      `json:"frequency" example:"immediate"`
+	Locale    string                      `json:"locale" example:"ru"`
+	Genres    []GenreSubscriptionResponse `json:"genres"`
+	Authors   []string                    `json:"authors"`
+}
+
+// subscriptionUserID возвращает id пользователя из JWT. API ключам подписки недоступны
+func subscriptionUserID(c *gin.Context) (uint, bool) {
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+		return 0, false
+	}
+	if claims.IsAPIKey() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Mailing subscription is not available for API keys"})
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// bindSubscriptionRequest проверяет, что в запросе указан ровно один жанр или автор
+func bindSubscriptionRequest(c *gin.Context) (SubscriptionRequest, bool) {
+	var request SubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, false
+	}
+	request.Author = mailing.NormalizeAuthor(request.Author)
+	if (request.GenreID == 0) == (request.Author == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either genre_id or author must be set"})
+		return request, false
+	}
+	return request, true
+}
+
+// GetSubscriptions
+// @Summary      Get mailing subscriptions
+// @Description  Returns genres and authors the user is subscribed to.
+// @Description  A user without subscriptions receives emails about all new books.
+// @Tags         mailing
+// @Produce      json
+// @Success      200  {object}  SubscriptionsResponse
+// @Failure      401  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getSubscriptions [get]
+func GetSubscriptions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := subscriptionUserID(c)
+		if !ok {
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return
+		}
+
+		var genreSubscriptions []models.GenreSubscription
+		if err := db.Preload("Genre").Where("user_id = ?", userID).Order("id").Find(&genreSubscriptions).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get genre subscriptions of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriptions"})
+			return
+		}
+		var authors []string
+		if err := db.Model(&models.AuthorSubscription{}).Where("user_id = ?", userID).Order("author").Pluck("author", &authors).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get author subscriptions of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get subscriptions"})
+			return
+		}
+
+		response := SubscriptionsResponse{Mailing: user.Mailing, Frequency: user.MailingFrequency, Locale: mailing.NormalizeLocale(user.Locale), Genres: []GenreSubscriptionResponse{}, Authors: []string{}}
+		for _, subscription := range genreSubscriptions {
+			response.Genres = append(response.Genres, GenreSubscriptionResponse{ID: subscription.GenreID, Name: subscription.Genre.Name})
+		}
+		response.Authors = append(response.Authors, authors...)
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// AddSubscription
+// @Summary      Subscribe to a genre or an author
+// @Description  After the first subscription the user receives emails only about books of subscribed genres and authors
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Param        subscription  body  SubscriptionRequest  true  "Genre or author"  example({"genre_id": 1})
+// @Success      201  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /addSubscription [post]
+func AddSubscription(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := subscriptionUserID(c)
+		if !ok {
+			return
+		}
+		request, ok := bindSubscriptionRequest(c)
+		if !ok {
+			return
+		}
+
+		if request.GenreID != 0 {
+			var genre models.Genre
+			if err := db.First(&genre, request.GenreID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Genre not found"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve genre"})
+				return
+			}
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return changeMailingPreferences(tx, auditMeta(c), "user.add_subscription", userID, func() error {
+				if request.GenreID != 0 {
+					return tx.Where(models.GenreSubscription{UserID: userID, GenreID: request.GenreID}).
+						FirstOrCreate(&models.GenreSubscription{}).Error
+				}
+				return tx.Where(models.AuthorSubscription{UserID: userID, Author: request.Author}).
+					FirstOrCreate(&models.AuthorSubscription{}).Error
+			})
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to add subscription of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add subscription"})
+			return
+		}
+		logger.InfoLog.Printf("User %d subscribed to genre %d / author %q", userID, request.GenreID, request.Author)
+
+		c.JSON(http.StatusCreated, gin.H{"message": "Subscription added successfully"})
+	}
+}
+
+// RemoveSubscription
+// @Summary      Unsubscribe from a genre or an author
+// @Description  Removes the subscription. Without subscriptions the user receives emails about all new books again.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Param        subscription  body  SubscriptionRequest  true  "Genre or author"  example({"author": "Агата Кристи"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /removeSubscription [post]
+func RemoveSubscription(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := subscriptionUserID(c)
+		if !ok {
+			return
+		}
+		request, ok := bindSubscriptionRequest(c)
+		if !ok {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return changeMailingPreferences(tx, auditMeta(c), "user.remove_subscription", userID, func() error {
+				var result *gorm.DB
+				if request.GenreID != 0 {
+					result = tx.Unscoped().Where("user_id = ? AND genre_id = ?", userID, request.GenreID).Delete(&models.GenreSubscription{})
+				} else {
+					result = tx.Unscoped().Where("user_id = ? AND author = ?", userID, request.Author).Delete(&models.AuthorSubscription{})
+				}
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					return gorm.ErrRecordNotFound
+				}
+				return nil
+			})
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		if err != nil {
+			logger.ErrorLog.Println("Failed to remove subscription of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove subscription"})
+			return
+		}
+		logger.InfoLog.Printf("User %d unsubscribed from genre %d / author %q", userID, request.GenreID, request.Author)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Subscription removed successfully"})
+	}
+}
+
+// SetMailingFrequency
+// @Summary      Set mailing frequency
+// @Description  immediate - an email about every new book, daily and weekly - one digest with all new books since the previous one
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Param        frequency  body  MailingFrequencyRequest  true  "Mailing frequency"  example({"frequency": "daily"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /setMailingFrequency [post]
+func SetMailingFrequency(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := subscriptionUserID(c)
+		if !ok {
+			return
+		}
+		var request MailingFrequencyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "frequency must be one of: immediate, daily, weekly"})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return changeMailingPreferences(tx, auditMeta(c), "user.set_mailing_frequency", userID, func() error {
+				return tx.Model(&models.User{}).Where("id = ?", userID).Update("mailing_frequency", request.Frequency).Error
+			})
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to set mailing frequency of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set mailing frequency"})
+			return
+		}
+		logger.InfoLog.Printf("User %d set mailing frequency to %s", userID, request.Frequency)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Mailing frequency updated successfully"})
+	}
+}
+
+// SetMailingLocale
+// @Summary      Set email language
+// @Description  Emails are sent in the chosen language: ru or en
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Param        locale  body  MailingLocaleRequest  true  "Email language"  example({"locale": "en"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /setMailingLocale [post]
+func SetMailingLocale(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := subscriptionUserID(c)
+		if !ok {
+			return
+		}
+		var request MailingLocaleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "locale must be one of: ru, en"})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return changeMailingPreferences(tx, auditMeta(c), "user.set_mailing_locale", userID, func() error {
+				return tx.Model(&models.User{}).Where("id = ?", userID).Update("locale", request.Locale).Error
+			})
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to set email locale of user", userID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set email language"})
+			return
+		}
+		logger.InfoLog.Printf("User %d set email locale to %s", userID, request.Locale)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email language updated successfully"})
+	}
+}
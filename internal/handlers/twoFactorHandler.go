@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/auth"
+	"library/internal/models"
+	"library/logger"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// TwoFactorChallengeResponse ответ на вход по паролю, когда требуется второй фактор
+type TwoFactorChallengeResponse struct {
+	Message        string `json:"message" example:"Two-factor authentication required"`
+	TwoFactorToken string `json:"two_factor_token"`
+	// SetupRequired 2FA обязательна для роли, но еще не подключена: секрет выдается в /enroll2FA
+	// по токену подключения от администратора
+	SetupRequired bool `json:"setup_required,omitempty"`
+}
+
+// EnrollTwoFactorRequest структура запроса для подключения обязательной 2FA при входе
+// @Schema example={"two_factor_token": "5f2b...", "enrollment_token": "9c1d..."}
+type EnrollTwoFactorRequest struct {
+	TwoFactorToken  string `json:"two_factor_token" binding:"required"`
+	EnrollmentToken string `json:"enrollment_token" binding:"required"`
+}
+
+// IssueTwoFactorEnrollmentRequest структура запроса для выдачи токена подключения 2FA
+// @Schema example={"user_id": 1}
+type IssueTwoFactorEnrollmentRequest struct {
+	UserID uint `json:"user_id" binding:"required" example:"1"`
+}
+
+// TwoFactorEnrollmentResponse токен подключения 2FA. Передается пользователю по отдельному каналу
+type TwoFactorEnrollmentResponse struct {
+	EnrollmentToken string    `json:"enrollment_token"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// LoginTwoFactorRequest структура запроса для второго шага входа
+// @Schema example={"two_factor_token": "5f2b...", "code": "123456"}
+type LoginTwoFactorRequest struct {
+	TwoFactorToken string `json:"two_factor_token" binding:"required"`
+	Code           string `json:"code" binding:"required" example:"123456"` // Код TOTP или код восстановления
+	Device         string `json:"device" example:"iPhone"`
+	ReturnTokens   bool   `json:"return_tokens" example:"false"`
+}
+
+// TwoFactorCodeRequest структура запроса с кодом второго фактора
+// @Schema example={"code": "123456"}
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required" example:"123456"`
+}
+
+// RecoveryCodesResponse коды восстановления. Показываются только один раз
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// startTwoFactorLogin отвечает на вход по паролю временным токеном для второго шага. Если 2FA обязательна,
+// но не подключена, секрет не выдается: его можно получить только в /enroll2FA с токеном от администратора
+// или в /setup2FA из уже открытой сессии
+func startTwoFactorLogin(c *gin.Context, user models.User) {
+	token, err := auth.StartTwoFactorLogin(user)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to start two-factor login\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to login"})
+		return
+	}
+
+	response := TwoFactorChallengeResponse{Message: "Two-factor authentication required", TwoFactorToken: token}
+	if !user.TOTPEnabled && user.TOTPSecret == "" {
+		response.Message = "Two-factor authentication setup required"
+		response.SetupRequired = true
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// EnrollTwoFactor
+// @Summary      Set up mandatory 2FA during login
+// @Description  For users whose role requires 2FA but who have not set it up yet. Exchanges the "two_factor_token"
+// @Description  from /login and a one-time enrollment token issued by an administrator via /issue2FAEnrollment
+// @Description  for a new TOTP secret. The first code from the authenticator in /login2FA enables 2FA.
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Param        enrollment  body  EnrollTwoFactorRequest  true  "Login and enrollment tokens"
+// @Success      200  {object}  auth.TOTPSetup
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /enroll2FA [post]
+func EnrollTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request EnrollTwoFactorRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := auth.TwoFactorLoginUser(db, request.TwoFactorToken)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidTwoFactorToken) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired two-factor token"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to check two-factor token\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+			return
+		}
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": auth.ErrTwoFactorAlreadyEnabled.Error()})
+			return
+		}
+
+		if err := auth.RedeemTwoFactorEnrollment(request.EnrollmentToken, user.ID); err != nil {
+			if errors.Is(err, auth.ErrInvalidEnrollmentToken) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired enrollment token"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to redeem enrollment token of user", user.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+			return
+		}
+
+		meta := auditMeta(c)
+		meta.Actor = "user:" + strconv.FormatUint(uint64(user.ID), 10)
+		var setup auth.TOTPSetup
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if setup, err = auth.BeginTOTPSetup(tx, &user); err != nil {
+				return err
+			}
+			// Секрет не записывается в журнал
+			return audit.Record(tx, meta, "user.setup_2fa", user.ID, nil, nil)
+		})
+		if err != nil {
+			twoFactorError(c, user, err)
+			return
+		}
+		c.JSON(http.StatusOK, setup)
+	}
+}
+
+// IssueTwoFactorEnrollment
+// @Summary      Issue a 2FA enrollment token
+// @Description  Issues a one-time token, valid for 24 hours, that lets a user whose role requires 2FA set it up
+// @Description  via /enroll2FA after entering the password. Deliver it to the user over a separate channel.
+// @Description  Requires the "user:manage" permission.
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Param        user  body  IssueTwoFactorEnrollmentRequest  true  "User"  example({"user_id": 1})
+// @Success      200  {object}  TwoFactorEnrollmentResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /issue2FAEnrollment [post]
+func IssueTwoFactorEnrollment(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request IssueTwoFactorEnrollmentRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, request.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+			return
+		}
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": auth.ErrTwoFactorAlreadyEnabled.Error()})
+			return
+		}
+
+		token, expiresAt, err := auth.IssueTwoFactorEnrollment(user.ID)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to issue enrollment token for user", user.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue enrollment token"})
+			return
+		}
+		// Токен не записывается в журнал
+		if err := audit.Record(db, auditMeta(c), "user.issue_2fa_enrollment", user.ID, nil, nil); err != nil {
+			logger.ErrorLog.Println("Failed to record enrollment token of user", user.ID, "in audit log\tError:", err)
+		}
+		logger.InfoLog.Println("Two-factor enrollment token issued for user", user.ID)
+
+		c.JSON(http.StatusOK, TwoFactorEnrollmentResponse{EnrollmentToken: token, ExpiresAt: expiresAt})
+	}
+}
+
+// LoginTwoFactor
+// @Summary      Second login step
+// @Description  Exchanges the "two_factor_token" from /login and a TOTP or recovery code for a session.
+// @Description  If 2FA setup was required, the first TOTP code for the secret from /enroll2FA enables it
+// @Description  and the response contains recovery codes.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Param        user  body  LoginTwoFactorRequest  true  "Second factor"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      429  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /login2FA [post]
+func LoginTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request LoginTwoFactorRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := auth.TwoFactorLoginUser(db, request.TwoFactorToken)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidTwoFactorToken) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired two-factor token"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to check two-factor token\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to login"})
+			return
+		}
+
+		ip := c.ClientIP()
+		retryAfter, err := auth.LoginRetryAfter(user.Email, ip)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to check login attempts\tError:", err)
+		}
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, try again later"})
+			return
+		}
+
+		var recoveryCodes []string
+		if user.TOTPEnabled {
+			err = auth.VerifySecondFactor(db, &user, request.Code)
+		} else {
+			// Пользователь еще не вошел, поэтому автор записи в журнале берется из токена второго шага
+			meta := auditMeta(c)
+			meta.Actor = "user:" + strconv.FormatUint(uint64(user.ID), 10)
+			before := audit.NewUserSnapshot(user)
+			err = db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				if recoveryCodes, err = auth.EnableTOTP(tx, &user, request.Code); err != nil {
+					return err
+				}
+				return audit.Record(tx, meta, "user.enable_2fa", user.ID, before, audit.NewUserSnapshot(user))
+			})
+		}
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidTwoFactorCode) || errors.Is(err, auth.ErrTwoFactorNotSetUp) {
+				registerLoginFailure(db, user.Email, ip, &user)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to verify second factor of user", user.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to login"})
+			return
+		}
+
+		if err := auth.FinishTwoFactorLogin(request.TwoFactorToken); err != nil {
+			logger.ErrorLog.Println("Failed to delete two-factor token\tError:", err)
+		}
+		if err := auth.ResetLoginFailures(user.Email); err != nil {
+			logger.ErrorLog.Println("Failed to reset failed login attempts\tError:", err)
+		}
+
+		_, tokens, err := auth.CreateSession(c, db, user, request.Device)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to create session when logining\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
+		}
+
+		response := gin.H{"message": "User authorization successfully"}
+		if request.ReturnTokens {
+			response["tokens"] = tokens
+		}
+		if recoveryCodes != nil {
+			logger.InfoLog.Println("Two-factor authentication enabled for user", user.ID)
+			response["recovery_codes"] = recoveryCodes
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// currentUser загружает пользователя из JWT. API ключам управление 2FA недоступно
+func currentUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	var user models.User
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+		return user, false
+	}
+	if claims.IsAPIKey() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not available for API keys"})
+		return user, false
+	}
+	if err := db.First(&user, claims.Subject).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// twoFactorError отвечает на ошибки управления 2FA
+func twoFactorError(c *gin.Context, user models.User, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidTwoFactorCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+	case errors.Is(err, auth.ErrTwoFactorAlreadyEnabled),
+		errors.Is(err, auth.ErrTwoFactorNotEnabled),
+		errors.Is(err, auth.ErrTwoFactorNotSetUp):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrTwoFactorMandatory):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		logger.ErrorLog.Println("Failed to manage two-factor authentication of user", user.ID, "\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to manage two-factor authentication"})
+	}
+}
+
+// SetupTwoFactor
+// @Summary      Start 2FA setup
+// @Description  Generates a new TOTP secret and an otpauth:// URI to be shown as a QR code.
+// @Description  2FA is enabled only after confirming a code via /enable2FA.
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Success      200  {object}  auth.TOTPSetup
+// @Failure      401  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /setup2FA [post]
+func SetupTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		setup, err := auth.BeginTOTPSetup(db, &user)
+		if err != nil {
+			twoFactorError(c, user, err)
+			return
+		}
+		c.JSON(http.StatusOK, setup)
+	}
+}
+
+// EnableTwoFactor
+// @Summary      Enable 2FA
+// @Description  Confirms the secret from /setup2FA with a TOTP code and returns one-time recovery codes
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Param        code  body  TwoFactorCodeRequest  true  "TOTP code"  example({"code": "123456"})
+// @Success      200  {object}  RecoveryCodesResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /enable2FA [post]
+func EnableTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		before := audit.NewUserSnapshot(user)
+		var codes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if codes, err = auth.EnableTOTP(tx, &user, request.Code); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "user.enable_2fa", user.ID, before, audit.NewUserSnapshot(user))
+		})
+		if err != nil {
+			twoFactorError(c, user, err)
+			return
+		}
+		logger.InfoLog.Println("Two-factor authentication enabled for user", user.ID)
+
+		c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "Two-factor authentication enabled", RecoveryCodes: codes})
+	}
+}
+
+// DisableTwoFactor
+// @Summary      Disable 2FA
+// @Description  Disables 2FA after checking a TOTP or recovery code. Not allowed for roles where 2FA is mandatory.
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Param        code  body  TwoFactorCodeRequest  true  "TOTP or recovery code"  example({"code": "123456"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /disable2FA [post]
+func DisableTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		before := audit.NewUserSnapshot(user)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := auth.DisableTOTP(tx, &user, request.Code); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "user.disable_2fa", user.ID, before, audit.NewUserSnapshot(user))
+		})
+		if err != nil {
+			twoFactorError(c, user, err)
+			return
+		}
+		logger.InfoLog.Println("Two-factor authentication disabled for user", user.ID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// RegenerateRecoveryCodes
+// @Summary      Regenerate recovery codes
+// @Description  Replaces all recovery codes with new ones after checking a TOTP or recovery code
+// @Tags         2fa
+// @Accept       json
+// @Produce      json
+// @Param        code  body  TwoFactorCodeRequest  true  "TOTP or recovery code"  example({"code": "123456"})
+// @Success      200  {object}  RecoveryCodesResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /regenerateRecoveryCodes [post]
+func RegenerateRecoveryCodes(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		var codes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if codes, err = auth.RegenerateRecoveryCodes(tx, &user, request.Code); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "user.regenerate_recovery_codes", user.ID, nil, nil)
+		})
+		if err != nil {
+			twoFactorError(c, user, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "Recovery codes regenerated", RecoveryCodes: codes})
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"library/internal/auth"
+	"library/internal/mailing"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// unsubscribePage данные страницы отписки
+type unsubscribePage struct {
+	State     string // confirm, done или invalid
+	Name      string
+	Token     string
+	CSRFToken string
+}
+
+// renderPage отдает HTML страницу из шаблона
+func renderPage(c *gin.Context, status int, path string, data interface{}) {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to parse page template", path, "\tError:", err)
+		c.String(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		logger.ErrorLog.Println("Failed to render page template", path, "\tError:", err)
+		c.String(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", body.Bytes())
+}
+
+// UnsubscribePage
+// @Summary      Unsubscribe confirmation page
+// @Description  Public page opened from the unsubscribe link in an email. Does not change anything by itself,
+// @Description  because mail scanners open links; the form on the page sends POST /unsubscribe.
+// @Tags         mailing
+// @Produce      html
+// @Param        token  query  string  true  "Signed unsubscribe token"
+// @Success      200
+// @Failure      400
+// @Router       /unsubscribe [get]
+func UnsubscribePage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		user, err := mailing.UserByUnsubscribeToken(db, token)
+		if err != nil {
+			if !errors.Is(err, mailing.ErrInvalidUnsubscribeToken) {
+				logger.ErrorLog.Println("Failed to check unsubscribe token\tError:", err)
+			}
+			renderPage(c, http.StatusBadRequest, "HTML/Unsubscribe.html", unsubscribePage{State: "invalid"})
+			return
+		}
+
+		if !user.Mailing {
+			renderPage(c, http.StatusOK, "HTML/Unsubscribe.html", unsubscribePage{State: "done"})
+			return
+		}
+		renderPage(c, http.StatusOK, "HTML/Unsubscribe.html", unsubscribePage{
+			State:     "confirm",
+			Name:      user.Name,
+			Token:     token,
+			CSRFToken: auth.GetCSRFToken(c),
+		})
+	}
+}
+
+// UnsubscribeMailingLink
+// @Summary      Old unsubscribe link
+// @Description  Links in emails that were already sent lead to GET /unsubMailing. It does not unsubscribe by itself
+// @Description  and redirects the logged in user to the confirmation page of the signed link (GET /unsubscribe).
+// @Tags         user
+// @Success      303
+// @Failure      401
+// @Router       /unsubMailing [get]
+func UnsubscribeMailingLink(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
+			return
+		}
+		if claims.IsAPIKey() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Mailing subscription is not available for API keys"})
+			return
+		}
+
+		var user models.User
+		if err := db.Where("id = ?", claims.Subject).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to find user for unsubscribe link\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+			return
+		}
+
+		// Отписка меняет состояние, поэтому выполняется только формой на странице подтверждения с CSRF токеном
+		c.Redirect(http.StatusSeeOther, "/unsubscribe?token="+url.QueryEscape(mailing.UnsubscribeToken(user)))
+	}
+}
+
+// Unsubscribe
+// @Summary      One-click unsubscribe
+// @Description  Unsubscribes the recipient of the signed token without logging in.
+// @Description  Handles RFC 8058 one-click requests from mail clients (token in the query, body "List-Unsubscribe=One-Click")
+// @Description  and the form on the confirmation page (token in the "token" form field).
+// @Tags         mailing
+// @Accept       x-www-form-urlencoded
+// @Produce      html
+// @Param        token  query     string  false  "Signed unsubscribe token"
+// @Param        token  formData  string  false  "Signed unsubscribe token"
+// @Success      200
+// @Failure      400
+// @Failure      500
+// @Router       /unsubscribe [post]
+func Unsubscribe(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			token = c.PostForm("token")
+		}
+
+		user, err := mailing.UserByUnsubscribeToken(db, token)
+		if err != nil {
+			if !errors.Is(err, mailing.ErrInvalidUnsubscribeToken) {
+				logger.ErrorLog.Println("Failed to check unsubscribe token\tError:", err)
+			}
+			renderPage(c, http.StatusBadRequest, "HTML/Unsubscribe.html", unsubscribePage{State: "invalid"})
+			return
+		}
+
+		if user.Mailing {
+			// Ссылка из письма действует без входа, поэтому изменение выполняет сам владелец токена
+			meta := auditMeta(c)
+			meta.Actor = "user:" + strconv.FormatUint(uint64(user.ID), 10)
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return changeMailingPreferences(tx, meta, "user.unsubscribe_mailing", user.ID, func() error {
+					return tx.Model(&user).Update("mailing", false).Error
+				})
+			})
+			if err != nil {
+				logger.ErrorLog.Println("Failes unsubscribe from the mailing list\tError:", err)
+				c.String(http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			logger.InfoLog.Println("User unsubscribed from the mailing list by link. User ID:", user.ID)
+		}
+		renderPage(c, http.StatusOK, "HTML/Unsubscribe.html", unsubscribePage{State: "done"})
+	}
+}
@@ -2,19 +2,20 @@ package handlers
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"library/internal/audit"
 	"library/internal/auth"
+	"library/internal/events"
+	"library/internal/mailing"
 	"library/internal/models"
 	"library/logger"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"gorm.io/gorm"
 )
 
@@ -25,6 +26,7 @@ type RegisterUserRequest struct {
 	Email    string `json:"email" binding:"required,email" example:"Laminano@mail.ru"`
 	Password string `json:"password" binding:"required,min=6" example:"123456"`
 	Mailing  bool   `json:"mailing" binding:"required" example:"true"`
+	Locale   string `json:"locale" binding:"omitempty,oneof=ru en" example:"ru"` // язык писем, по умолчанию ru
 }
 
 // LoginRequest структура запроса для авторизации пользователя
@@ -32,6 +34,21 @@ type RegisterUserRequest struct {
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required" exmple:"Laminano@mail.ru"`
 	Password string `json:"password" binding:"required" example:"123456"`
+	Device   string `json:"device" example:"Laptop"` // Название устройства для списка сессий
+	// Вернуть токены в теле ответа для клиентов, которые не работают с cookie
+	ReturnTokens bool `json:"return_tokens" example:"false"`
+}
+
+// UnlockUserRequest структура запроса для снятия блокировки входа
+// @Schema example={"email": "Laminano@mail.ru"}
+type UnlockUserRequest struct {
+	Email string `json:"email" binding:"required" example:"Laminano@mail.ru"`
+}
+
+// RefreshTokenRequest структура запроса для обновления токенов клиентами без cookie
+// @Schema example={"refresh_token": "0b7c6a3e-6f1d-4c1e-9f43-3c0f8e5d2a71"}
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" example:"0b7c6a3e-6f1d-4c1e-9f43-3c0f8e5d2a71"`
 }
 
 type TokenResponse struct {
@@ -65,9 +82,19 @@ func RegisterUser(db *gorm.DB) gin.HandlerFunc {
 			Password: hasherPassword,
 			Mailing:  request.Mailing,
 			Role:     "reader",
+			Locale:   mailing.NormalizeLocale(request.Locale),
 		}
 
-		if err := db.Create(&user).Error; err != nil {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if err := events.Enqueue(tx, events.UserRegistered, eventActor(c), user.ID, events.NewUserRegisteredPayload(user)); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "user.register", user.ID, nil, audit.NewUserSnapshot(user))
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 			return
 		}
@@ -79,11 +106,18 @@ func RegisterUser(db *gorm.DB) gin.HandlerFunc {
 // LoginUser
 // @Summary      Performs user login
 // @Description  Logs in an existing user
+// @Description  Tokens are set in cookies. With "return_tokens": true they are also returned in the response body.
+// @Description  Repeated failures slow down further attempts and temporarily lock the account and the IP address.
+// @Description  If the user has two-factor authentication (or it is mandatory for the role), responds with 202 and a
+// @Description  "two_factor_token" that must be exchanged for a session via /login2FA.
 // @Tags         user
 // @Accept       json
 // @Produce      json
 // @Param        user  body  LoginRequest  true  "User Data" example({"email": "Laminano@mail.ru", "password":"123456"})
 // @Success 201 {object} map[string]string
+// @Success 202 {object} TwoFactorChallengeResponse
+// @Failure 401 {object} map[string]string
+// @Failure 429 {object} map[string]string
 // @Router       /login [post]
 func LoginUser(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -96,52 +130,175 @@ func LoginUser(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		var User models.User
-		if err := db.Where("email = ?", request.Email).First(&User).Error; err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err, "message": "email is not registered"})
+		ip := c.ClientIP()
+		retryAfter, err := auth.LoginRetryAfter(request.Email, ip)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to check login attempts\tError:", err)
+		}
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, try again later"})
 			return
 		}
 
 		hasher := sha256.New()
 		hasher.Write([]byte(request.Password))
 		hasherPassword := hex.EncodeToString(hasher.Sum(nil))
-		if hasherPassword != User.Password {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+
+		// Для незарегистрированного email и неверного пароля ответ одинаковый,
+		// чтобы по нему нельзя было узнать, зарегистрирован ли адрес
+		var User models.User
+		userErr := db.Where("email = ?", request.Email).First(&User).Error
+		if userErr != nil && !errors.Is(userErr, gorm.ErrRecordNotFound) {
+			logger.ErrorLog.Println("Failed to find user when logining\tError:", userErr)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to login"})
+			return
+		}
+		if userErr != nil || subtle.ConstantTimeCompare([]byte(hasherPassword), []byte(User.Password)) != 1 {
+			if userErr != nil {
+				registerLoginFailure(db, request.Email, ip, nil)
+			} else {
+				registerLoginFailure(db, request.Email, ip, &User)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 			return
 		}
 
-		token, err := auth.GenerateJWT(User)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		// Счетчик неудачных попыток сбрасывается только после второго фактора,
+		// иначе знание пароля позволило бы перебирать коды без ограничений
+		if auth.NeedsTwoFactor(User) {
+			startTwoFactorLogin(c, User)
 			return
 		}
 
-		timeSec, err := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
-		if err != nil {
-			logger.ErrorLog.Println("Failed get `JWTCoo_expires_time_sec` in .env when login user\tError:", err)
+		if err := auth.ResetLoginFailures(request.Email); err != nil {
+			logger.ErrorLog.Println("Failed to reset failed login attempts\tError:", err)
 		}
-		c.SetCookie("jwt", token, timeSec, "/", os.Getenv("domain"), false, true)
 
-		refreshToken := auth.GenerateRefreshToken()
-		User.RefreshToken = refreshToken
-		User.ExpiresAt = time.Now().Add(720 * time.Hour)
-		if err = db.Save(&User).Error; err != nil {
-			logger.ErrorLog.Println("Error save refresh token in db when logining\t Error:", err)
+		_, tokens, err := auth.CreateSession(c, db, User, request.Device)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to create session when logining\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
 		}
-		c.SetCookie("refreshToken", refreshToken, 2592000, "/", os.Getenv("domain"), false, true)
 
+		if request.ReturnTokens {
+			c.JSON(http.StatusOK, gin.H{"message": "User authorization successfully", "tokens": tokens})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "User authorization successfully"})
 	}
 }
 
+// registerLoginFailure учитывает неудачную попытку входа и сообщает владельцу аккаунта о блокировке
+func registerLoginFailure(db *gorm.DB, email, ip string, user *models.User) {
+	locked, err := auth.RegisterLoginFailure(email, ip)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to register failed login attempt\tError:", err)
+	}
+	if locked {
+		logger.InfoLog.Println("Login locked after repeated failures for email", email, "from IP", ip)
+		if user != nil {
+			mailing.SendAccountLockedEmail(db, *user, ip, auth.LoginLockDuration())
+		}
+	}
+}
+
+// UnlockUser
+// @Summary      Unlock user login
+// @Description  Removes the temporary lockout and resets failed login attempts for the email
+// @Description  Requires the "user:manage" permission.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Param        user  body  UnlockUserRequest  true  "User email"  example({"email": "Laminano@mail.ru"})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /unlockUser [post]
+func UnlockUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request UnlockUserRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := auth.UnlockAccount(request.Email); err != nil {
+			logger.ErrorLog.Println("Failed to unlock login for", request.Email, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+			return
+		}
+		logger.InfoLog.Println("Login unlocked for", request.Email)
+		// Блокировка хранится в Redis, поэтому запись журнала не может быть в одной транзакции с ее снятием
+		if err := audit.Record(db, auditMeta(c), "user.unlock", request.Email, nil, nil); err != nil {
+			logger.ErrorLog.Println("Failed to record unlock of", request.Email, "in audit log\tError:", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "User unlocked successfully"})
+	}
+}
+
+// RefreshToken
+// @Summary      Refresh tokens
+// @Description  Rotates the refresh token and issues a new JWT.
+// @Description  The refresh token is taken from the request body or, if it is empty, from the "refreshToken" cookie.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Param        token  body  RefreshTokenRequest  false  "Refresh token"
+// @Success      200  {object}  auth.TokenPair
+// @Failure      401  {object}  map[string]string
+// @Router       /refreshToken [post]
+func RefreshToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request RefreshTokenRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if request.RefreshToken == "" {
+			request.RefreshToken, _ = c.Cookie("refreshToken")
+		}
+		if request.RefreshToken == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": auth.ErrRefreshTokenNotFound.Error()})
+			return
+		}
+
+		tokens, err := auth.RotateRefreshToken(c, db, request.RefreshToken)
+		if err != nil {
+			logger.InfoLog.Println("Failed to refresh tokens\tError:", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// CSRFToken
+// @Summary      Get CSRF token
+// @Description  Returns the CSRF token that is also set in the "csrf_token" cookie.
+// @Description  State-changing requests authenticated with cookies must send it in the "X-CSRF-Token" header.
+// @Tags         user
+// @Produce      json
+// @Success      200  {object}  map[string]string
+// @Router       /csrfToken [get]
+func CSRFToken(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"csrf_token": auth.GetCSRFToken(c)})
+}
+
 // UnsubscribeMailing
 // @Summary      Unsubscribe mailing
 // @Description  Describes the user from the mailing list
 // @Tags         user
 // @Accept       json
 // @Produce      json
+// @Description  Cookie-authenticated requests must send the CSRF token in the "X-CSRF-Token" header.
 // @Success      200
-// @Router       /unsubMailing [get]
+// @Router       /unsubMailing [post]
 // @name         UnsubscribeMailing
 func UnsubscribeMailing(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -155,8 +312,9 @@ func UnsubscribeMailing(db *gorm.DB) gin.HandlerFunc {
 // @Tags         user
 // @Accept       json
 // @Produce      json
+// @Description  Cookie-authenticated requests must send the CSRF token in the "X-CSRF-Token" header.
 // @Success      200
-// @Router       /subMailing [get]
+// @Router       /subMailing [post]
 // @name         SubscribeMailing
 func SubscribeMailing(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -166,100 +324,106 @@ func SubscribeMailing(db *gorm.DB) gin.HandlerFunc {
 
 // Это общая функция дл двух эндпоинтов, описанных выше(иначе swagger не разделяет 2 эндпоинта)
 func handlMailing(db *gorm.DB, subscribe bool, c *gin.Context) {
-	logger.InfoLog.Println("Getting jwt token from cookies")
-	tokenString, err := c.Cookie("jwt")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
-		logger.InfoLog.Println("Error when getting jwt from cookies.\tJWT token == nil:", (tokenString == ""), "\nError:", err)
-		c.Abort()
-		return
-	}
-
-	logger.InfoLog.Println("Validating jwt token")
-	token, err := jwt.ParseWithClaims(tokenString, &auth.MyClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	// Claims уже проверены middleware аутентификации, в том числе для токена из заголовка Authorization
+	claims, ok := auth.GetClaims(c)
+	if !ok {
+		logger.InfoLog.Println("Getting jwt token from cookies")
+		tokenString, err := c.Cookie("jwt")
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
+			logger.InfoLog.Println("Error when getting jwt from cookies.\tJWT token == nil:", (tokenString == ""), "\nError:", err)
+			c.Abort()
+			return
 		}
-		return []byte(os.Getenv("jwtSecret")), nil
-	})
 
-	if err != nil || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		logger.InfoLog.Println("Error when validating jwt token.\ttoken.Valid:", token.Valid, "\tError: ", err)
+		logger.InfoLog.Println("Validating jwt token")
+		claims, err = auth.ParseJWT(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			logger.InfoLog.Println("Error when validating jwt token.\tError: ", err)
+			c.Abort()
+			return
+		}
+	}
+	if claims.IsAPIKey() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Mailing subscription is not available for API keys"})
 		c.Abort()
 		return
 	}
 
-	claims, ok := token.Claims.(*auth.MyClaims)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
-		c.Abort()
+	var user models.User
+
+	if err := db.Where("id = ?", claims.Subject).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			auth.ClearAuthCookies(c)
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		logger.ErrorLog.Println("Failed to find user when changing mailing\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
 		return
 	}
 
-	if !claims.Mailing && !subscribe {
+	// Состояние подписки берется из базы: пользователь мог отписаться по ссылке из письма,
+	// и значение в JWT устарело
+	if !user.Mailing && !subscribe {
 		c.JSON(http.StatusOK, gin.H{"message": "You have already unsubscribed from the mailing list"})
 		logger.InfoLog.Println("User already unsubscribed from the mailing list")
 		c.Abort()
 		return
 	}
 
-	if claims.Mailing && subscribe {
+	if user.Mailing && subscribe {
 		c.JSON(http.StatusOK, gin.H{"message": "You have already subscribed to the mailing list"})
 		logger.InfoLog.Println("User already subscribed to the mailing list")
 		c.Abort()
 		return
 	}
 
-	var user models.User
+	var message string
 
-	if err := db.Where("id = ?", claims.Subject).First(&user).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.SetCookie("jwt", "", -1, "/", os.Getenv("domain"), false, true)
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-			return
-		}
+	action := "user.unsubscribe_mailing"
+	if subscribe {
+		action = "user.subscribe_mailing"
+	}
+	// Claims могли быть разобраны здесь из cookie, а не сохранены middleware
+	meta := auditMeta(c)
+	meta.Actor = "user:" + claims.Subject
+	user.Mailing = subscribe
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return changeMailingPreferences(tx, meta, action, user.ID, func() error {
+			return tx.Save(&user).Error
+		})
+	})
+	if err != nil {
+		logger.ErrorLog.Println("Failed to change mailing subscription\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-
-	var message string
 
 	if !subscribe {
-		user.Mailing = false
-		if err := db.Save(&user).Error; err != nil {
-			logger.ErrorLog.Println("Failes unsubscribe from the mailing list\tError:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
 		logger.InfoLog.Println("User unsubscribed from the mailing list. User ID:", claims.Subject)
 		message = "You have unsubscribed from the mailing list"
-
 	} else {
-		user.Mailing = true
-		if err := db.Save(&user).Error; err != nil {
-			logger.ErrorLog.Println("Failes subscribe to the mailing list\tError:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
 		logger.InfoLog.Println("User subscribed to the mailing list. User ID:", claims.Subject)
 		message = "You have subscribed to the mailing list"
 	}
 	logger.InfoLog.Println("Generating new jwt token with changed mailing =", user.Mailing)
-	tokenString, err = auth.GenerateJWT(user)
+	tokenString, err := auth.GenerateSessionJWT(user, claims.SessionID)
 	if err != nil {
+		// Подписка уже сохранена, а в старом JWT поле mailing обновится при следующем обновлении токена
 		logger.ErrorLog.Println("Failing to generate new JWT token\tError:", err)
+	} else {
+		auth.SetJWTCookie(c, tokenString)
 	}
-
-	timeSec, err := strconv.Atoi(os.Getenv("JWTCoo_expires_time_sec"))
-	if err != nil {
-		logger.ErrorLog.Println("Failed get `JWTCoo_expires_time_sec` in .env when login user\tError:", err)
-	}
-	c.SetCookie("jwt", tokenString, timeSec, "/", os.Getenv("domain"), false, true)
 	c.JSON(http.StatusOK, gin.H{"message": message})
 }
 
 // LogOut
 // @Summary      Log out user
 // @Description  Log user from the api
+// @Description  The refresh token is taken from the "refreshToken" cookie or from the request body.
+// @Param        token  body  RefreshTokenRequest  false  "Refresh token"
 // @Tags         user
 // @Accept       json
 // @Produce      json
@@ -269,25 +433,38 @@ func handlMailing(db *gorm.DB, subscribe bool, c *gin.Context) {
 func LogOut(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		refreshToken, err := c.Cookie("refreshToken")
+		if err != nil {
+			var request RefreshTokenRequest
+			if c.ShouldBindJSON(&request) == nil && request.RefreshToken != "" {
+				refreshToken, err = request.RefreshToken, nil
+			}
+		}
 		if err != nil {
 			logger.InfoLog.Println("the refresh token was not found when user logout")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "User unauthorized"})
 			c.Abort()
+			return
 		}
 
-		var user models.User
-
-		if err = db.Where("refresh_token = ?", refreshToken).First(&user).Error; err != nil {
-			logger.ErrorLog.Println("failed to delete refresh token from db\t Error:", err)
-		} else {
-			user.RefreshToken = ""
-			if err = db.Save(&user).Error; err != nil {
-				logger.ErrorLog.Println("failed to save logout user in db\tError:", err)
+		session, err := auth.SessionByRefreshToken(db, refreshToken)
+		if err == nil {
+			// Выход выполняется без JWT, поэтому действие записывается от имени владельца сессии
+			meta := auditMeta(c)
+			if meta.Actor == "" {
+				meta.Actor = "user:" + strconv.FormatUint(uint64(session.UserID), 10)
 			}
+			err = db.Transaction(func(tx *gorm.DB) error {
+				return revokeSession(tx, meta, "session.logout", session)
+			})
+			if err == nil {
+				auth.ForgetSessionStatus(session.ID)
+			}
+		}
+		if err != nil {
+			logger.ErrorLog.Println("failed to revoke session when user logout\t Error:", err)
 		}
-		c.SetCookie("refreshToken", "", -1, "/", os.Getenv("domain"), false, true)
-		c.SetCookie("jwt", "", -1, "/", os.Getenv("domain"), false, true)
-		logger.InfoLog.Printf("user %d logged out", user.ID)
+		auth.ClearAuthCookies(c)
+		logger.InfoLog.Printf("session %d logged out", session.ID)
 
 		c.JSON(http.StatusOK, gin.H{"message": "Log out succesfully"})
 	}
@@ -0,0 +1,505 @@
+package handlers
+
+import (
+	"errors"
+	"library/internal/audit"
+	"library/internal/auth"
+	"library/internal/models"
+	"library/internal/webhooks"
+	"library/logger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateWebhookRequest структура запроса для создания вебхука
+// @Schema example={"url": "https://partner.example.com/hooks/library", "event_types": ["BookAdded", "BookUpdated"]}
+type CreateWebhookRequest struct {
+	URL        string   `json:"url" binding:"required,http_url" example:"https://partner.example.com/hooks/library"`
+	EventTypes []string `json:"event_types" binding:"required,min=1" example:"BookAdded,BookUpdated"`
+	Secret     string   `json:"secret" binding:"omitempty,min=16" example:""` // пусто - секрет генерируется
+}
+
+// UpdateWebhookRequest структура запроса для изменения вебхука. Пустые поля не меняются
+// @Schema example={"id": 1, "active": true}
+type UpdateWebhookRequest struct {
+	ID         uint     `json:"id" binding:"required" example:"1"`
+	URL        string   `json:"url" binding:"omitempty,http_url" example:"https://partner.example.com/hooks/library"`
+	EventTypes []string `json:"event_types" example:"BookAdded,BookUpdated,BookDeleted"`
+	Active     *bool    `json:"active" example:"true"`
+}
+
+// DeleteWebhookRequest структура запроса для удаления вебхука
+// @Schema example={"id": 1}
+type DeleteWebhookRequest struct {
+	ID uint `json:"id" binding:"required" example:"1"`
+}
+
+// RetryWebhookDeliveryRequest структура запроса для повторной доставки события
+// @Schema example={"id": 1}
+type RetryWebhookDeliveryRequest struct {
+	ID uint `json:"id" binding:"required" example:"1"`
+}
+
+// WebhookResponse информация о вебхуке без секрета
+type WebhookResponse struct {
+	ID                  uint       `json:"id"`
+	URL                 string     `json:"url"`
+	EventTypes          []string   `json:"event_types"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	CreatedByID         uint       `json:"created_by_id"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// CreateWebhookResponse ответ на создание вебхука. Секрет показывается только один раз
+type CreateWebhookResponse struct {
+	WebhookResponse
+	Secret string `json:"secret"`
+}
+
+// WebhookDeliveryResponse доставка события вебхуку без тела запроса
+type WebhookDeliveryResponse struct {
+	ID             uint       `json:"id"`
+	WebhookID      uint       `json:"webhook_id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// WebhookDeliveriesResponse страница журнала доставок
+type WebhookDeliveriesResponse struct {
+	Page            int                       `json:"page"`
+	Limit           int                       `json:"limit"`
+	TotalDeliveries int64                     `json:"total_deliveries"`
+	Deliveries      []WebhookDeliveryResponse `json:"deliveries"`
+}
+
+// WebhookDeliveryAttemptResponse одна попытка доставки
+type WebhookDeliveryAttemptResponse struct {
+	AttemptedAt     time.Time `json:"attempted_at"`
+	StatusCode      int       `json:"status_code"`
+	LatencyMs       int64     `json:"latency_ms"`
+	ResponseExcerpt string    `json:"response_excerpt"`
+	Error           string    `json:"error"`
+}
+
+func newWebhookResponse(webhook models.Webhook) WebhookResponse {
+	return WebhookResponse{
+		ID:                  webhook.ID,
+		URL:                 webhook.URL,
+		EventTypes:          webhooks.SplitEventTypes(webhook.EventTypes),
+		Active:              webhook.Active,
+		ConsecutiveFailures: webhook.ConsecutiveFailures,
+		DisabledAt:          webhook.DisabledAt,
+		CreatedByID:         webhook.CreatedByID,
+		CreatedAt:           webhook.CreatedAt,
+	}
+}
+
+// CreateWebhook
+// @Summary      Create webhook
+// @Description  Subscribes a partner URL to catalog events (BookAdded, BookUpdated, BookDeleted, GenreCreated).
+// @Description  Every delivery is a POST with the event envelope, signed with HMAC-SHA256 of "<timestamp>.<body>"
+// @Description  in the X-Library-Signature header. The secret is generated when omitted and is returned only once.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Accept       json
+// @Produce      json
+// @Param        webhook  body  CreateWebhookRequest  true  "Webhook"  example({"url": "https://partner.example.com/hooks/library", "event_types": ["BookAdded", "BookUpdated"]})
+// @Success      201  {object}  CreateWebhookResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /createWebhook [post]
+func CreateWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
+			return
+		}
+
+		var request CreateWebhookRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		eventTypes, err := webhooks.ParseEventTypes(request.EventTypes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		secret := request.Secret
+		if secret == "" {
+			if secret, err = webhooks.NewSecret(); err != nil {
+				logger.ErrorLog.Println("Failed to generate webhook secret\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+				return
+			}
+		}
+
+		webhook := models.Webhook{
+			URL:        request.URL,
+			EventTypes: eventTypes,
+			Secret:     secret,
+			Active:     true,
+		}
+		if !claims.IsAPIKey() {
+			userID, _ := strconv.ParseUint(claims.Subject, 10, 64)
+			webhook.CreatedByID = uint(userID)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&webhook).Error; err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "webhook.create", webhook.ID, nil, newWebhookResponse(webhook))
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to save webhook\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+			return
+		}
+		logger.InfoLog.Printf("Webhook %d created for %s with events %s", webhook.ID, webhook.URL, webhook.EventTypes)
+
+		c.JSON(http.StatusCreated, CreateWebhookResponse{WebhookResponse: newWebhookResponse(webhook), Secret: secret})
+	}
+}
+
+// GetWebhooks
+// @Summary      Get webhooks
+// @Description  Returns all webhooks without their secrets, including disabled ones.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Produce      json
+// @Success      200  {array}   WebhookResponse
+// @Failure      500  {object}  map[string]string
+// @Router       /getWebhooks [get]
+func GetWebhooks(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var list []models.Webhook
+		if err := db.Order("id").Find(&list).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get webhooks\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhooks"})
+			return
+		}
+
+		response := make([]WebhookResponse, 0, len(list))
+		for _, webhook := range list {
+			response = append(response, newWebhookResponse(webhook))
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// UpdateWebhook
+// @Summary      Update webhook
+// @Description  Changes the URL, the event types or the active flag of a webhook.
+// @Description  Enabling a webhook that was disabled after failed deliveries resets its failure counter.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Accept       json
+// @Produce      json
+// @Param        webhook  body  UpdateWebhookRequest  true  "Webhook"  example({"id": 1, "active": true})
+// @Success      200  {object}  WebhookResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /updateWebhook [post]
+func UpdateWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request UpdateWebhookRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var webhook models.Webhook
+		if err := db.First(&webhook, request.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook"})
+			return
+		}
+
+		updates := map[string]interface{}{}
+		if request.URL != "" {
+			updates["url"] = request.URL
+		}
+		if request.EventTypes != nil {
+			eventTypes, err := webhooks.ParseEventTypes(request.EventTypes)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			updates["event_types"] = eventTypes
+		}
+		if request.Active != nil && *request.Active != webhook.Active {
+			updates["active"] = *request.Active
+			if *request.Active {
+				updates["consecutive_failures"] = 0
+				updates["disabled_at"] = nil
+			} else {
+				updates["disabled_at"] = time.Now()
+			}
+		}
+
+		if len(updates) > 0 {
+			before := newWebhookResponse(webhook)
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&webhook).Updates(updates).Error; err != nil {
+					return err
+				}
+				return audit.Record(tx, auditMeta(c), "webhook.update", webhook.ID, before, newWebhookResponse(webhook))
+			})
+			if err != nil {
+				logger.ErrorLog.Println("Failed to update webhook", webhook.ID, "\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+				return
+			}
+			logger.InfoLog.Println("Webhook", webhook.ID, "updated")
+		}
+
+		c.JSON(http.StatusOK, newWebhookResponse(webhook))
+	}
+}
+
+// DeleteWebhook
+// @Summary      Delete webhook
+// @Description  Deletes the webhook; its pending deliveries are no longer sent.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Accept       json
+// @Produce      json
+// @Param        webhook  body  DeleteWebhookRequest  true  "Webhook"  example({"id": 1})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /deleteWebhook [delete]
+func DeleteWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request DeleteWebhookRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var webhook models.Webhook
+			if err := tx.First(&webhook, request.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&webhook).Error; err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "webhook.delete", webhook.ID, newWebhookResponse(webhook), nil)
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		if err != nil {
+			logger.ErrorLog.Println("Failed to delete webhook", request.ID, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+			return
+		}
+		logger.InfoLog.Println("Webhook", request.ID, "deleted")
+
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+	}
+}
+
+// GetWebhookDeliveries
+// @Summary      List webhook deliveries
+// @Description  Returns the delivery log with the status, attempts and last response of every delivery, newest first.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Produce      json
+// @Param        webhook_id  query  int     false  "Filter by webhook ID"
+// @Param        status      query  string  false  "Filter by status: pending, delivered or failed"
+// @Param        page        query  int     false  "Page number for pagination (default: 1)"
+// @Param        limit       query  int     false  "Number of deliveries per page (default: 20)"
+// @Success      200  {object}  WebhookDeliveriesResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getWebhookDeliveries [get]
+func GetWebhookDeliveries(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit < 1 || limit > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		query := db.Model(&models.WebhookDelivery{})
+		if webhookID := c.Query("webhook_id"); webhookID != "" {
+			id, err := strconv.ParseUint(webhookID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook_id"})
+				return
+			}
+			query = query.Where("webhook_id = ?", id)
+		}
+		switch status := c.Query("status"); status {
+		case "":
+		case models.DeliveryPending, models.DeliveryDelivered, models.DeliveryFailed:
+			query = query.Where("status = ?", status)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of: pending, delivered, failed"})
+			return
+		}
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			logger.ErrorLog.Println("Failed to count webhook deliveries\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get deliveries"})
+			return
+		}
+		var deliveries []models.WebhookDelivery
+		if err := query.Omit("payload").Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&deliveries).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get webhook deliveries\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get deliveries"})
+			return
+		}
+
+		response := WebhookDeliveriesResponse{Page: page, Limit: limit, TotalDeliveries: total, Deliveries: []WebhookDeliveryResponse{}}
+		for _, delivery := range deliveries {
+			response.Deliveries = append(response.Deliveries, WebhookDeliveryResponse{
+				ID:             delivery.ID,
+				WebhookID:      delivery.WebhookID,
+				EventID:        delivery.EventID,
+				EventType:      delivery.EventType,
+				Status:         delivery.Status,
+				Attempts:       delivery.Attempts,
+				NextAttemptAt:  delivery.NextAttemptAt,
+				LastStatusCode: delivery.LastStatusCode,
+				LastError:      delivery.LastError,
+				CreatedAt:      delivery.CreatedAt,
+				DeliveredAt:    delivery.DeliveredAt,
+			})
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// GetWebhookDeliveryAttempts
+// @Summary      List attempts of a webhook delivery
+// @Description  Returns every attempt of the delivery with its time, response status, latency and the beginning
+// @Description  of the response body, oldest first. Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Produce      json
+// @Param        delivery_id  query  int  true  "Delivery ID"
+// @Success      200  {array}   WebhookDeliveryAttemptResponse
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /getWebhookDeliveryAttempts [get]
+func GetWebhookDeliveryAttempts(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Query("delivery_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery_id"})
+			return
+		}
+
+		var delivery models.WebhookDelivery
+		if err := db.Select("id").First(&delivery, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+				return
+			}
+			logger.ErrorLog.Println("Failed to find webhook delivery", id, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get delivery attempts"})
+			return
+		}
+
+		var attempts []models.WebhookDeliveryAttempt
+		if err := db.Where("delivery_id = ?", delivery.ID).Order("id").Find(&attempts).Error; err != nil {
+			logger.ErrorLog.Println("Failed to get attempts of webhook delivery", id, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get delivery attempts"})
+			return
+		}
+
+		response := []WebhookDeliveryAttemptResponse{}
+		for _, attempt := range attempts {
+			response = append(response, WebhookDeliveryAttemptResponse{
+				AttemptedAt:     attempt.AttemptedAt,
+				StatusCode:      attempt.StatusCode,
+				LatencyMs:       attempt.LatencyMs,
+				ResponseExcerpt: attempt.ResponseExcerpt,
+				Error:           attempt.Error,
+			})
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RetryWebhookDelivery
+// @Summary      Retry a webhook delivery
+// @Description  Puts a pending or failed delivery back into the queue with a reset attempt counter.
+// @Description  Requires the "webhook:manage" permission.
+// @Tags         webhook
+// @Accept       json
+// @Produce      json
+// @Param        delivery  body  RetryWebhookDeliveryRequest  true  "Delivery ID"  example({"id": 1})
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /retryWebhookDelivery [post]
+func RetryWebhookDelivery(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request RetryWebhookDeliveryRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var before models.WebhookDelivery
+			if err := tx.Select("id", "status", "attempts").First(&before, request.ID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err := webhooks.RetryDelivery(tx, request.ID); err != nil {
+				return err
+			}
+			return audit.Record(tx, auditMeta(c), "webhook_delivery.retry", request.ID,
+				gin.H{"status": before.Status, "attempts": before.Attempts},
+				gin.H{"status": models.DeliveryPending, "attempts": 0})
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, webhooks.ErrDeliveryNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			case errors.Is(err, webhooks.ErrAlreadyDelivered):
+				c.JSON(http.StatusConflict, gin.H{"error": "Delivery already delivered"})
+			default:
+				logger.ErrorLog.Println("Failed to retry webhook delivery", request.ID, "\tError:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry delivery"})
+			}
+			return
+		}
+		logger.InfoLog.Println("Webhook delivery", request.ID, "queued for retry")
+
+		c.JSON(http.StatusOK, gin.H{"message": "Delivery queued for retry"})
+	}
+}
@@ -0,0 +1,52 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"library/internal/events"
+
+	"github.com/IBM/sarama"
+)
+
+// Bus шина событий в Kafka: события публикуются в топик и читаются в составе consumer group
+type Bus struct {
+	producer *KafkaProducer
+	consumer *KafkaConsumer
+	brokers  []string
+	topic    string
+}
+
+// NewBus подключается к Kafka. Возвращает ошибку, если брокеры недоступны
+func NewBus(cfg BusConfig) (*Bus, error) {
+	producer, err := NewKafkaProducer(cfg.Brokers, cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := NewKafkaConsumer(cfg, producer.DeadLetterQueue(cfg.DeadLetterTopic))
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return &Bus{producer: producer, consumer: consumer, brokers: cfg.Brokers, topic: cfg.Topic}, nil
+}
+
+func (b *Bus) Publish(envelope events.Envelope) error {
+	return b.producer.Publish(envelope)
+}
+
+func (b *Bus) Consume(ctx context.Context, handler events.Handler) error {
+	return b.consumer.Consume(ctx, handler)
+}
+
+func (b *Bus) Subscribe(ctx context.Context, handler events.Handler) error {
+	consumer, err := sarama.NewConsumer(b.brokers, sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	return SubscribePartitions(ctx, consumer, b.topic, handler)
+}
+
+func (b *Bus) Close() error {
+	return errors.Join(b.consumer.Close(), b.producer.Close())
+}
@@ -1,64 +1,258 @@
 package kafka
 
 import (
-	"encoding/json"
-	"library/internal/database"
-	"library/internal/mailing"
-	"library/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"library/internal/events"
 	"library/logger"
+	"strings"
+	"time"
 
 	"github.com/IBM/sarama"
 )
 
+const (
+	// reconnectDelay пауза перед повторным подключением к группе после ошибки
+	reconnectDelay = 5 * time.Second
+	// maxConsumeRetryDelay верхняя граница паузы между попытками обработки
+	maxConsumeRetryDelay = time.Minute
+)
+
+// RetryPolicy сколько раз и с какой паузой повторяется обработка сообщения
+type RetryPolicy struct {
+	MaxAttempts int
+	// Delay пауза перед первым повтором, каждая следующая вдвое длиннее
+	Delay time.Duration
+}
+
+// delay пауза перед следующей попыткой после attempts неудачных
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < attempts && delay < maxConsumeRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxConsumeRetryDelay)
+}
+
+// KafkaConsumer читает события из всех партиций топика в составе consumer group. Смещение сообщения
+// фиксируется только после успешной обработки, поэтому события, опубликованные пока приложение было остановлено,
+// обрабатываются после запуска, а несколько экземпляров приложения делят партиции между собой
 type KafkaConsumer struct {
-	consumer sarama.Consumer
-	topic    string
+	group      sarama.ConsumerGroup
+	topic      string
+	retry      RetryPolicy
+	deadLetter *DeadLetterQueue
+	dedup      *Deduplicator
+}
+
+// BusConfig настройки шины событий в Kafka
+type BusConfig struct {
+	Brokers []string
+	Topic   string
+	GroupID string
+	// DeadLetterTopic топик для событий, которые не удалось обработать
+	DeadLetterTopic string
+	// InitialOffset с какой позиции новая группа начинает чтение: oldest или newest
+	InitialOffset string
+	Retry         RetryPolicy
+	// DedupWindow сколько помнить id обработанных событий. 0 отключает дедупликацию
+	DedupWindow time.Duration
+}
+
+// ParseInitialOffset разбирает позицию, с которой новая группа начинает чтение: oldest или newest
+func ParseInitialOffset(value string) (int64, error) {
+	switch strings.ToLower(value) {
+	case "", "newest":
+		return sarama.OffsetNewest, nil
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	}
+	return 0, fmt.Errorf("unknown initial offset %q, expected oldest or newest", value)
 }
 
-func NewKafkaConsumer(brokers []string, topic string) (*KafkaConsumer, error) {
-	consumer, err := sarama.NewConsumer(brokers, nil)
+// NewKafkaConsumer подключается к группе cfg.GroupID. cfg.InitialOffset используется, только если у группы
+// еще нет зафиксированного смещения. Сообщения, которые не удалось обработать за cfg.Retry.MaxAttempts попыток,
+// отправляются в deadLetter
+func NewKafkaConsumer(cfg BusConfig, deadLetter *DeadLetterQueue) (*KafkaConsumer, error) {
+	offset, err := ParseInitialOffset(cfg.InitialOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = offset
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategySticky()}
+
+	group, err := sarama.NewConsumerGroup(cfg.Brokers, cfg.GroupID, config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &KafkaConsumer{
-		consumer: consumer,
-		topic:    topic,
+		group:      group,
+		topic:      cfg.Topic,
+		retry:      cfg.Retry,
+		deadLetter: deadLetter,
+		dedup:      NewDeduplicator(cfg.DedupWindow),
 	}, nil
 }
 
-func (c *KafkaConsumer) ConsumeMessage() {
-	partitionConsumer, err := c.consumer.ConsumePartition(c.topic, 0, sarama.OffsetNewest)
-	if err != nil {
-		logger.ErrorLog.Fatal("Failed to start consumer:", err)
+// Consume передает события handler, пока не отменен ctx или не закрыта группа. После перебалансировки группы
+// чтение продолжается с партициями, назначенными этому экземпляру
+func (c *KafkaConsumer) Consume(ctx context.Context, handler events.Handler) error {
+	go func() {
+		for err := range c.group.Errors() {
+			logger.ErrorLog.Println("Kafka consumer group error\tError:", err)
+		}
+	}()
+
+	groupHandler := GroupHandler{Handle: c.messageHandler(handler), Retry: c.retry}
+	if c.deadLetter != nil {
+		groupHandler.DeadLetter = c.deadLetter.Send
+	}
+	for {
+		if err := c.group.Consume(ctx, []string{c.topic}, groupHandler); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return nil
+			}
+			logger.ErrorLog.Println("Kafka consumer session failed\tError:", err)
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
+}
+
+func (c *KafkaConsumer) Close() error {
+	return c.group.Close()
+}
 
-	defer partitionConsumer.Close()
+// GroupHandler обрабатывает сообщения партиций, назначенных экземпляру приложения
+type GroupHandler struct {
+	// Handle обрабатывает значение сообщения. Ошибка с events.ErrUnprocessable отправляет сообщение
+	// в dead letter топик сразу, остальные ошибки повторяются согласно Retry
+	Handle func(value []byte) error
+	Retry  RetryPolicy
+	// DeadLetter сохраняет сообщение, которое не удалось обработать. Если не задан, такое сообщение пропускается
+	DeadLetter func(message *sarama.ConsumerMessage, cause error, attempts int) error
+}
 
-	for message := range partitionConsumer.Messages() {
+func (h GroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	logger.InfoLog.Printf("Kafka consumer joined group generation %d as %s, partitions: %v", session.GenerationID(), session.MemberID(), session.Claims())
+	return nil
+}
 
-		var rawMessage string
+func (h GroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	logger.InfoLog.Printf("Kafka consumer leaves group generation %d, partitions: %v", session.GenerationID(), session.Claims())
+	return nil
+}
 
-		if err := json.Unmarshal(message.Value, &rawMessage); err != nil {
-			logger.ErrorLog.Println("Failed to unmarshal Kafka message to string\nerr: ", err, "\nmessage.Value in string: ", string(message.Value))
+// ConsumeClaim обрабатывает сообщения одной партиции по порядку. Если обработка не удалась, она повторяется
+// с растущей паузой, а после последней попытки сообщение отправляется в dead letter топик.
+// Смещение фиксируется только после обработки или сохранения в dead letter топике
+func (h GroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if !h.process(session, message) {
+				// Партиция передана другому экземпляру, смещение не зафиксировано
+				return nil
+			}
+			session.MarkMessage(message, "")
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// process обрабатывает сообщение. Возвращает false, если сессия завершилась до окончания обработки.
+// Если событие сейчас обрабатывает другой экземпляр (ErrEventInProgress), это не считается неудачной попыткой:
+// обработка повторяется после паузы, пока другой экземпляр не закончит, и в dead letter топик событие не попадает
+func (h GroupHandler) process(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) bool {
+	attempts := 0
+	for {
+		err := h.Handle(message.Value)
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, ErrEventInProgress) {
+			logger.InfoLog.Printf("Kafka message %s/%d/%d is being processed by another consumer, waiting",
+				message.Topic, message.Partition, message.Offset)
+			if !wait(session.Context(), h.Retry.delay(1)) {
+				return false
+			}
 			continue
 		}
 
-		var event struct {
-			Data  models.Book `json:"data"`
-			Event string      `json:"event"`
+		attempts++
+		if errors.Is(err, events.ErrUnprocessable) || attempts >= h.Retry.MaxAttempts {
+			return h.sendDeadLetter(session, message, err, attempts)
 		}
 
-		logger.InfoLog.Println("Raw Kafka message: ", rawMessage)
-		if err := json.Unmarshal([]byte(rawMessage), &event); err != nil {
-			logger.ErrorLog.Println("Failed to pars Kafka message\nerr: ", err, "\nmessage.Value in string: ", string(message.Value), "\nevent: ", event)
-			continue
+		delay := h.Retry.delay(attempts)
+		logger.ErrorLog.Printf("Failed to handle Kafka message %s/%d/%d (attempt %d), retrying in %s\tError: %v",
+			message.Topic, message.Partition, message.Offset, attempts, delay, err)
+		if !wait(session.Context(), delay) {
+			return false
 		}
+	}
+}
 
-		logger.InfoLog.Printf("New event received: %s", event.Event)
+// sendDeadLetter сохраняет сообщение в dead letter топике. Пока это не удалось, следующие сообщения партиции ждут,
+// чтобы ни одно сообщение не было потеряно
+func (h GroupHandler) sendDeadLetter(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, cause error, attempts int) bool {
+	logger.ErrorLog.Printf("Kafka message %s/%d/%d failed after %d attempts\tError: %v",
+		message.Topic, message.Partition, message.Offset, attempts, cause)
+	if h.DeadLetter == nil {
+		return true
+	}
+	for retries := 1; ; retries++ {
+		err := h.DeadLetter(message, cause, attempts)
+		if err == nil {
+			return true
+		}
+		delay := h.Retry.delay(retries)
+		logger.ErrorLog.Printf("Failed to send Kafka message %s/%d/%d to dead letter topic, retrying in %s\tError: %v",
+			message.Topic, message.Partition, message.Offset, delay, err)
+		if !wait(session.Context(), delay) {
+			return false
+		}
+	}
+}
+
+// wait ждет delay. Возвращает false, если ctx отменен раньше
+func wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-		if event.Event == "BookAdded" {
-			go mailing.SendNewBookEmail(event.Data, database.DB)
+// messageHandler разбирает сообщение и передает событие handler, если оно еще не обработано. Сообщения,
+// которые не удалось разобрать, и события неизвестного типа или более новой версии схемы отправляются
+// в dead letter топик: после обновления приложения их можно вернуть в основной топик
+func (c *KafkaConsumer) messageHandler(handler events.Handler) func(value []byte) error {
+	return func(value []byte) error {
+		envelope, err := events.Decode(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", events.ErrUnprocessable, err)
 		}
+		return c.dedup.Process(envelope.ID, func() error {
+			return handler(envelope)
+		})
 	}
 }
@@ -0,0 +1,161 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"library/internal/events"
+	"library/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSession struct {
+	ctx    context.Context
+	marked []int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32               { return nil }
+func (s *fakeSession) MemberID() string                         { return "member" }
+func (s *fakeSession) GenerationID() int32                      { return 1 }
+func (s *fakeSession) MarkOffset(string, int32, int64, string)  {}
+func (s *fakeSession) Commit()                                  {}
+func (s *fakeSession) ResetOffset(string, int32, int64, string) {}
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+func (s *fakeSession) Context() context.Context { return s.ctx }
+
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c fakeClaim) Topic() string                            { return "library-events" }
+func (c fakeClaim) Partition() int32                         { return 0 }
+func (c fakeClaim) InitialOffset() int64                     { return 0 }
+func (c fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestGroupHandlerRetriesAndDeadLetters(t *testing.T) {
+	claim := fakeClaim{messages: make(chan *sarama.ConsumerMessage, 3)}
+	for offset := int64(0); offset < 3; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Offset: offset, Value: []byte{byte(offset)}}
+	}
+	close(claim.messages)
+
+	// Сообщение 0 обрабатывается со второй попытки, 1 не обрабатывается никогда, 2 невозможно обработать
+	attempts := map[byte]int{}
+	var deadLetters []int64
+	var deadAttempts []int
+	handler := kafka.GroupHandler{
+		Retry: kafka.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond},
+		Handle: func(value []byte) error {
+			attempts[value[0]]++
+			switch {
+			case value[0] == 0 && attempts[0] == 1, value[0] == 1:
+				return errors.New("database is unavailable")
+			case value[0] == 2:
+				return fmt.Errorf("%w: bad json", events.ErrUnprocessable)
+			}
+			return nil
+		},
+		DeadLetter: func(message *sarama.ConsumerMessage, cause error, n int) error {
+			deadLetters = append(deadLetters, message.Offset)
+			deadAttempts = append(deadAttempts, n)
+			return nil
+		},
+	}
+
+	session := &fakeSession{ctx: context.Background()}
+	require.NoError(t, handler.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{0, 1, 2}, session.marked)
+	assert.Equal(t, map[byte]int{0: 2, 1: 3, 2: 1}, attempts)
+	assert.Equal(t, []int64{1, 2}, deadLetters)
+	assert.Equal(t, []int{3, 1}, deadAttempts)
+}
+
+func TestGroupHandlerWaitsForEventInProgress(t *testing.T) {
+	claim := fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 0}
+	close(claim.messages)
+
+	// Пока событие обрабатывает другой экземпляр, попытки не расходуются и событие не уходит в dead letter топик
+	calls := 0
+	handler := kafka.GroupHandler{
+		Retry: kafka.RetryPolicy{MaxAttempts: 2, Delay: time.Millisecond},
+		Handle: func([]byte) error {
+			if calls++; calls <= 5 {
+				return kafka.ErrEventInProgress
+			}
+			return nil
+		},
+		DeadLetter: func(*sarama.ConsumerMessage, error, int) error {
+			t.Error("event in progress must not be sent to the dead letter topic")
+			return nil
+		},
+	}
+
+	session := &fakeSession{ctx: context.Background()}
+	require.NoError(t, handler.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{0}, session.marked)
+	assert.Equal(t, 6, calls)
+}
+
+func TestGroupHandlerWaitsForDeadLetterTopic(t *testing.T) {
+	claim := fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 7}
+	close(claim.messages)
+
+	sent := 0
+	handler := kafka.GroupHandler{
+		Retry:  kafka.RetryPolicy{MaxAttempts: 1, Delay: time.Millisecond},
+		Handle: func([]byte) error { return errors.New("handler failed") },
+		DeadLetter: func(*sarama.ConsumerMessage, error, int) error {
+			sent++
+			if sent < 3 {
+				return errors.New("broker is unavailable")
+			}
+			return nil
+		},
+	}
+
+	session := &fakeSession{ctx: context.Background()}
+	require.NoError(t, handler.ConsumeClaim(session, claim))
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, []int64{7}, session.marked)
+}
+
+func TestGroupHandlerStopsWithoutCommitOnRebalance(t *testing.T) {
+	claim := fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 5}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := kafka.GroupHandler{
+		Retry: kafka.RetryPolicy{MaxAttempts: 10, Delay: time.Hour},
+		Handle: func([]byte) error {
+			cancel()
+			return errors.New("database is unavailable")
+		},
+	}
+
+	session := &fakeSession{ctx: ctx}
+	require.NoError(t, handler.ConsumeClaim(session, claim))
+	assert.Empty(t, session.marked)
+}
+
+func TestParseInitialOffset(t *testing.T) {
+	offset, err := kafka.ParseInitialOffset("oldest")
+	require.NoError(t, err)
+	assert.Equal(t, sarama.OffsetOldest, offset)
+
+	offset, err = kafka.ParseInitialOffset("")
+	require.NoError(t, err)
+	assert.Equal(t, sarama.OffsetNewest, offset)
+
+	_, err = kafka.ParseInitialOffset("latest")
+	assert.Error(t, err)
+}
@@ -0,0 +1,216 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"library/logger"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Заголовки, которые добавляются к сообщению в dead letter топике
+const (
+	headerDLQError     = "dlq-error"
+	headerDLQTopic     = "dlq-original-topic"
+	headerDLQPartition = "dlq-original-partition"
+	headerDLQOffset    = "dlq-original-offset"
+	headerDLQAttempts  = "dlq-attempts"
+	headerDLQFailedAt  = "dlq-failed-at"
+	headerDLQPrefix    = "dlq-"
+)
+
+const (
+	// readIdleTimeout сколько readPartition ждет следующего сообщения, прежде чем свериться с high water mark
+	readIdleTimeout = time.Second
+	// readTimeout сколько readPartition ждет сообщений, если брокер не подтвердил, что до конца чтения их нет
+	readTimeout = 30 * time.Second
+)
+
+// DeadLetterQueue сохраняет в отдельный топик сообщения, которые не удалось обработать,
+// чтобы после исправления причины их можно было вернуть в основной топик
+type DeadLetterQueue struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewDeadLetterQueue создает dead letter очередь в топике topic
+func NewDeadLetterQueue(producer sarama.SyncProducer, topic string) *DeadLetterQueue {
+	return &DeadLetterQueue{producer: producer, topic: topic}
+}
+
+// DeadLetterQueue dead letter очередь, которая отправляет сообщения через этот producer
+func (p *KafkaProducer) DeadLetterQueue(topic string) *DeadLetterQueue {
+	return NewDeadLetterQueue(p.producer, topic)
+}
+
+// Send отправляет сообщение в dead letter топик с теми же ключом, значением и заголовками,
+// добавляя ошибку, число попыток и исходное положение сообщения
+func (q *DeadLetterQueue) Send(message *sarama.ConsumerMessage, cause error, attempts int) error {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+6)
+	for _, header := range message.Headers {
+		if header != nil {
+			headers = append(headers, *header)
+		}
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerDLQError), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(headerDLQTopic), Value: []byte(message.Topic)},
+		sarama.RecordHeader{Key: []byte(headerDLQPartition), Value: []byte(strconv.Itoa(int(message.Partition)))},
+		sarama.RecordHeader{Key: []byte(headerDLQOffset), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(headerDLQAttempts), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(headerDLQFailedAt), Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	_, _, err := q.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   q.topic,
+		Key:     sarama.ByteEncoder(message.Key),
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	})
+	return err
+}
+
+// Replay возвращает сообщение из dead letter топика в исходный топик с исходными заголовками.
+// Если исходный топик неизвестен, сообщение отправляется в fallbackTopic
+func (q *DeadLetterQueue) Replay(message *sarama.ConsumerMessage, fallbackTopic string) error {
+	topic := fallbackTopic
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers))
+	for _, header := range message.Headers {
+		if header == nil {
+			continue
+		}
+		if string(header.Key) == headerDLQTopic && len(header.Value) > 0 {
+			topic = string(header.Value)
+		}
+		if strings.HasPrefix(string(header.Key), headerDLQPrefix) {
+			continue
+		}
+		headers = append(headers, *header)
+	}
+	if topic == "" {
+		return errors.New("original topic of dead letter is unknown")
+	}
+
+	_, _, err := q.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.ByteEncoder(message.Key),
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	})
+	return err
+}
+
+// ReplayDeadLetters возвращает в основной топик все сообщения dead letter топика, которые еще не были
+// возвращены группой groupID, и возвращает их количество. Смещение фиксируется после каждой партиции,
+// поэтому повторный запуск не возвращает сообщения второй раз
+func ReplayDeadLetters(brokers []string, groupID string, queue *DeadLetterQueue, fallbackTopic string) (int, error) {
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	offsetManager, err := sarama.NewOffsetManagerFromClient(groupID, client)
+	if err != nil {
+		return 0, err
+	}
+	defer offsetManager.Close()
+
+	partitions, err := client.Partitions(queue.topic)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, partition := range partitions {
+		n, err := replayPartition(client, offsetManager, queue, partition, fallbackTopic)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// replayPartition возвращает в основной топик сообщения одной партиции, опубликованные до запуска
+func replayPartition(client sarama.Client, offsetManager sarama.OffsetManager, queue *DeadLetterQueue, partition int32, fallbackTopic string) (int, error) {
+	partitionOffsets, err := offsetManager.ManagePartition(queue.topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer partitionOffsets.Close()
+	defer offsetManager.Commit()
+
+	// Сообщения, появившиеся после запуска, ждут следующего запуска
+	end, err := client.GetOffset(queue.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	start, _ := partitionOffsets.NextOffset()
+	if start < 0 {
+		if start, err = client.GetOffset(queue.topic, partition, sarama.OffsetOldest); err != nil {
+			return 0, err
+		}
+	}
+
+	replayed := 0
+	err = readPartition(client, queue.topic, partition, start, end, func(message *sarama.ConsumerMessage) error {
+		if err := queue.Replay(message, fallbackTopic); err != nil {
+			logger.ErrorLog.Printf("Failed to replay dead letter %d/%d\tError: %v", message.Partition, message.Offset, err)
+			return err
+		}
+		partitionOffsets.MarkOffset(message.Offset+1, "")
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// readPartition передает fn сообщения партиции со смещениями от start до end, не включая end.
+// Чтение останавливается на первой ошибке fn. Смещения до end могут быть заняты маркерами транзакций
+// или удалены compaction, поэтому сообщение end-1 может не прийти: если сообщений нет readIdleTimeout,
+// а high water mark партиции уже не меньше end, читать больше нечего. Если брокер так и не ответил за readTimeout,
+// возвращается ошибка
+func readPartition(client sarama.Client, topic string, partition int32, start, end int64, fn func(message *sarama.ConsumerMessage) error) error {
+	if start >= end {
+		return nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer partitionConsumer.Close()
+
+	lastMessageAt := time.Now()
+	for {
+		select {
+		case message, ok := <-partitionConsumer.Messages():
+			if !ok || message.Offset >= end {
+				return nil
+			}
+			if err := fn(message); err != nil {
+				return err
+			}
+			if message.Offset+1 >= end {
+				return nil
+			}
+			lastMessageAt = time.Now()
+		case <-time.After(readIdleTimeout):
+			if partitionConsumer.HighWaterMarkOffset() >= end {
+				return nil
+			}
+			if time.Since(lastMessageAt) >= readTimeout {
+				return fmt.Errorf("timed out reading partition %d of %s: no messages before offset %d", partition, topic, end)
+			}
+		}
+	}
+}
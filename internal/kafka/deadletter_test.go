@@ -0,0 +1,75 @@
+package kafka_test
+
+import (
+	"errors"
+	"library/internal/kafka"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headers заголовки сообщения в виде map
+func headers(records []sarama.RecordHeader) map[string]string {
+	result := make(map[string]string, len(records))
+	for _, header := range records {
+		result[string(header.Key)] = string(header.Value)
+	}
+	return result
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+	queue := kafka.NewDeadLetterQueue(producer, "library-events.dlq")
+
+	original := &sarama.ConsumerMessage{
+		Topic:     "library-events",
+		Partition: 2,
+		Offset:    41,
+		Key:       []byte("7"),
+		Value:     []byte(`{"type":"BookAdded"}`),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("event-type"), Value: []byte("BookAdded")}},
+	}
+
+	var deadLetter *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		deadLetter = msg
+		return nil
+	})
+	require.NoError(t, queue.Send(original, errors.New("handler failed"), 5))
+
+	assert.Equal(t, "library-events.dlq", deadLetter.Topic)
+	key, _ := deadLetter.Key.Encode()
+	assert.Equal(t, "7", string(key))
+	dlqHeaders := headers(deadLetter.Headers)
+	assert.Equal(t, "BookAdded", dlqHeaders["event-type"])
+	assert.Equal(t, "handler failed", dlqHeaders["dlq-error"])
+	assert.Equal(t, "library-events", dlqHeaders["dlq-original-topic"])
+	assert.Equal(t, "2", dlqHeaders["dlq-original-partition"])
+	assert.Equal(t, "41", dlqHeaders["dlq-original-offset"])
+	assert.Equal(t, "5", dlqHeaders["dlq-attempts"])
+	assert.NotEmpty(t, dlqHeaders["dlq-failed-at"])
+
+	// Возврат в основной топик восстанавливает исходные заголовки
+	stored := &sarama.ConsumerMessage{Topic: "library-events.dlq", Key: key, Value: original.Value}
+	for i := range deadLetter.Headers {
+		stored.Headers = append(stored.Headers, &deadLetter.Headers[i])
+	}
+	var replayed *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		replayed = msg
+		return nil
+	})
+	require.NoError(t, queue.Replay(stored, "fallback"))
+
+	assert.Equal(t, "library-events", replayed.Topic)
+	value, _ := replayed.Value.Encode()
+	assert.Equal(t, original.Value, value)
+	assert.Equal(t, map[string]string{"event-type": "BookAdded"}, headers(replayed.Headers))
+
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	assert.ErrorIs(t, queue.Replay(&sarama.ConsumerMessage{}, "library-events"), sarama.ErrOutOfBrokers)
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"errors"
+	"library/internal/cache"
+	"library/logger"
+	"time"
+)
+
+const (
+	// dedupKeyPrefix префикс ключей обработанных событий в кэше
+	dedupKeyPrefix = "event_processed:"
+	// processingTTL на сколько экземпляр приложения захватывает событие на время обработки
+	processingTTL = 5 * time.Minute
+
+	eventProcessing = "processing"
+	eventProcessed  = "processed"
+)
+
+// ErrEventInProgress событие сейчас обрабатывает другой экземпляр приложения, обработку нужно повторить позже
+var ErrEventInProgress = errors.New("event is being processed by another consumer")
+
+// Deduplicator запоминает id обработанных событий, чтобы событие, доставленное повторно, не обрабатывалось
+// второй раз (например, рассылка о книге не отправлялась дважды). Id хранятся в Redis в течение окна дедупликации
+type Deduplicator struct {
+	window time.Duration
+}
+
+// NewDeduplicator создает дедупликатор с окном window. При window <= 0 дедупликация отключена
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{window: window}
+}
+
+// Process выполняет fn, если событие eventID еще не обработано, и запоминает его после успешной обработки.
+// Если fn вернула ошибку, событие не запоминается и может быть обработано повторно
+func (d *Deduplicator) Process(eventID string, fn func() error) error {
+	if d == nil || d.window <= 0 || eventID == "" {
+		return fn()
+	}
+
+	key := dedupKeyPrefix + eventID
+	claimed, err := cache.SetIfAbsent(key, eventProcessing, processingTTL)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		state, _, err := cache.GetString(key)
+		if err != nil {
+			return err
+		}
+		if state == eventProcessing {
+			return ErrEventInProgress
+		}
+		logger.InfoLog.Println("Skipping duplicate event", eventID)
+		return nil
+	}
+
+	if err := fn(); err != nil {
+		if err := cache.Delete(key); err != nil {
+			logger.ErrorLog.Println("Failed to release event", eventID, "\tError:", err)
+		}
+		return err
+	}
+	if err := cache.SetWithTTL(key, eventProcessed, d.window); err != nil {
+		// Событие обработано, но при повторной доставке после истечения processingTTL будет обработано снова
+		logger.ErrorLog.Println("Failed to remember processed event", eventID, "\tError:", err)
+	}
+	return nil
+}
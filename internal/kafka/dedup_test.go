@@ -0,0 +1,66 @@
+package kafka_test
+
+import (
+	"errors"
+	"library/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicatorSkipsProcessedEvents(t *testing.T) {
+	dedup := kafka.NewDeduplicator(time.Hour)
+	eventID := uuid.NewString()
+	calls := 0
+	handle := func() error {
+		calls++
+		return nil
+	}
+
+	assert.NoError(t, dedup.Process(eventID, handle))
+	assert.NoError(t, dedup.Process(eventID, handle))
+	assert.Equal(t, 1, calls)
+
+	assert.NoError(t, dedup.Process(uuid.NewString(), handle))
+	assert.Equal(t, 2, calls)
+}
+
+func TestDeduplicatorRetriesFailedEvents(t *testing.T) {
+	dedup := kafka.NewDeduplicator(time.Hour)
+	eventID := uuid.NewString()
+
+	failure := errors.New("database is unavailable")
+	assert.ErrorIs(t, dedup.Process(eventID, func() error { return failure }), failure)
+
+	calls := 0
+	assert.NoError(t, dedup.Process(eventID, func() error {
+		calls++
+		// Повторная доставка во время обработки не обрабатывается параллельно
+		assert.ErrorIs(t, dedup.Process(eventID, func() error { return nil }), kafka.ErrEventInProgress)
+		return nil
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	eventID := uuid.NewString()
+	calls := 0
+	handle := func() error {
+		calls++
+		return nil
+	}
+
+	// Окно 0 отключает дедупликацию
+	disabled := kafka.NewDeduplicator(0)
+	assert.NoError(t, disabled.Process(eventID, handle))
+	assert.NoError(t, disabled.Process(eventID, handle))
+	assert.Equal(t, 2, calls)
+
+	short := kafka.NewDeduplicator(10 * time.Millisecond)
+	assert.NoError(t, short.Process(eventID, handle))
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, short.Process(eventID, handle))
+	assert.Equal(t, 4, calls)
+}
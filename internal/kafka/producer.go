@@ -3,7 +3,9 @@ package kafka
 import (
 	"encoding/json"
 	"errors"
+	"library/internal/events"
 	"library/logger"
+	"strconv"
 
 	"github.com/IBM/sarama"
 )
@@ -54,6 +56,28 @@ func (p *KafkaProducer) SendMessage(data interface{}) error {
 	return nil
 }
 
+// Publish отправляет событие в топик. Ключ сообщения имеет вид "<тип сущности>:<id>" (например, "book:42"),
+// поэтому события одной сущности попадают в одну партицию и читаются в порядке публикации.
+// Порядок событий разных сущностей не гарантируется
+func (p *KafkaProducer) Publish(envelope events.Envelope) error {
+	value, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: p.topic,
+		Key:   sarama.StringEncoder(envelope.Key),
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("event-id"), Value: []byte(envelope.ID)},
+			{Key: []byte("event-type"), Value: []byte(envelope.Type)},
+			{Key: []byte("event-version"), Value: []byte(strconv.Itoa(envelope.Version))},
+		},
+	}
+	_, _, err = p.producer.SendMessage(msg)
+	return err
+}
+
 func (p *KafkaProducer) Close() error {
 	return p.producer.Close()
 }
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"library/internal/events"
+	"library/logger"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// ReplayStart позиция, с которой перечитывается топик событий
+type ReplayStart struct {
+	// Offset смещение, с которого читается каждая партиция. Смещение старше хранящихся в топике заменяется самым старым
+	Offset int64
+	// Time если задано, читаются события, опубликованные не раньше этого времени, а Offset не используется
+	Time time.Time
+}
+
+// ReplayResult итог повторного чтения топика
+type ReplayResult struct {
+	// Events сколько событий передано обработчику
+	Events int
+	// Skipped сколько сообщений пропущено, потому что их не удалось разобрать
+	Skipped int
+	// Failed сколько событий обработчик не смог обработать
+	Failed int
+}
+
+// ReplayEvents перечитывает партиции topic (все, если partitions пусто) с позиции start до последнего сообщения,
+// опубликованного до запуска, и передает события handler. Consumer group не используется и смещения не фиксируются,
+// поэтому обработка событий приложением не затрагивается. Ошибки handler пишутся в лог, и чтение продолжается
+func ReplayEvents(brokers []string, topic string, partitions []int32, start ReplayStart, handler events.Handler) (ReplayResult, error) {
+	var result ReplayResult
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	if len(partitions) == 0 {
+		if partitions, err = client.Partitions(topic); err != nil {
+			return result, err
+		}
+	}
+
+	for _, partition := range partitions {
+		// События, опубликованные после запуска, не перечитываются
+		end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return result, err
+		}
+		offset, err := replayStartOffset(client, topic, partition, start, end)
+		if err != nil {
+			return result, err
+		}
+
+		err = readPartition(client, topic, partition, offset, end, func(message *sarama.ConsumerMessage) error {
+			envelope, err := events.Decode(message.Value)
+			if err != nil {
+				logger.ErrorLog.Printf("Failed to decode event %d/%d, skipped\tError: %v", message.Partition, message.Offset, err)
+				result.Skipped++
+				return nil
+			}
+			result.Events++
+			if err := handler(envelope); err != nil {
+				logger.ErrorLog.Printf("Failed to replay event %s %s (%d/%d)\tError: %v", envelope.Type, envelope.ID, message.Partition, message.Offset, err)
+				result.Failed++
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// replayStartOffset смещение в партиции, с которого начинается повторное чтение
+func replayStartOffset(client sarama.Client, topic string, partition int32, start ReplayStart, end int64) (int64, error) {
+	if !start.Time.IsZero() {
+		offset, err := client.GetOffset(topic, partition, start.Time.UnixMilli())
+		if err != nil {
+			return 0, err
+		}
+		// Брокер возвращает -1, если после start.Time в партиции нет сообщений
+		if offset < 0 {
+			return end, nil
+		}
+		return offset, nil
+	}
+
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	return max(start.Offset, oldest), nil
+}
@@ -0,0 +1,113 @@
+package kafka_test
+
+import (
+	"encoding/json"
+	"errors"
+	"library/internal/events"
+	"library/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayEvents(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	since := time.Now().Add(-time.Hour)
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	var ids []string
+	for offset := int64(0); offset < 4; offset++ {
+		envelope, err := events.New(events.BookDeleted, "", uint(offset), events.BookDeletedPayload{ID: uint(offset)})
+		require.NoError(t, err)
+		value, err := json.Marshal(envelope)
+		require.NoError(t, err)
+		if offset == 2 {
+			value = []byte("broken")
+		}
+		ids = append(ids, envelope.ID)
+		fetch.SetMessage("library-events", 0, offset, sarama.ByteEncoder(value))
+	}
+	fetch.SetHighWaterMark("library-events", 0, 4)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("library-events", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("library-events", 0, sarama.OffsetOldest, 0).
+			SetOffset("library-events", 0, sarama.OffsetNewest, 4).
+			SetOffset("library-events", 0, since.UnixMilli(), 1),
+		"FetchRequest": fetch,
+	})
+
+	replay := func(start kafka.ReplayStart) ([]string, kafka.ReplayResult) {
+		var replayed []string
+		result, err := kafka.ReplayEvents([]string{broker.Addr()}, "library-events", nil, start, func(envelope events.Envelope) error {
+			replayed = append(replayed, envelope.ID)
+			if envelope.ID == ids[3] {
+				return errors.New("database is unavailable")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return replayed, result
+	}
+
+	// Сообщение, которое не удалось разобрать, пропускается, а ошибка обработчика не останавливает чтение
+	replayed, result := replay(kafka.ReplayStart{Offset: 0})
+	assert.Equal(t, []string{ids[0], ids[1], ids[3]}, replayed)
+	assert.Equal(t, kafka.ReplayResult{Events: 3, Skipped: 1, Failed: 1}, result)
+
+	replayed, _ = replay(kafka.ReplayStart{Time: since})
+	assert.Equal(t, []string{ids[1], ids[3]}, replayed)
+
+	replayed, result = replay(kafka.ReplayStart{Offset: 4})
+	assert.Empty(t, replayed)
+	assert.Equal(t, kafka.ReplayResult{}, result)
+}
+
+func TestReplayEventsStopsAtHighWaterMark(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	// Смещения 2 и 3 заняты маркерами транзакций, поэтому сообщения с ними не приходят
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	for offset := int64(0); offset < 2; offset++ {
+		envelope, err := events.New(events.BookDeleted, "", uint(offset), events.BookDeletedPayload{ID: uint(offset)})
+		require.NoError(t, err)
+		value, err := json.Marshal(envelope)
+		require.NoError(t, err)
+		fetch.SetMessage("library-events", 0, offset, sarama.ByteEncoder(value))
+	}
+	fetch.SetHighWaterMark("library-events", 0, 4)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("library-events", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("library-events", 0, sarama.OffsetOldest, 0).
+			SetOffset("library-events", 0, sarama.OffsetNewest, 4),
+		"FetchRequest": fetch,
+	})
+
+	done := make(chan kafka.ReplayResult)
+	go func() {
+		result, err := kafka.ReplayEvents([]string{broker.Addr()}, "library-events", nil, kafka.ReplayStart{Offset: 0}, func(events.Envelope) error {
+			return nil
+		})
+		assert.NoError(t, err)
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		assert.Equal(t, kafka.ReplayResult{Events: 2}, result)
+	case <-time.After(10 * time.Second):
+		t.Fatal("replay did not stop at the high water mark")
+	}
+}
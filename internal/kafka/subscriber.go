@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"context"
+	"library/internal/events"
+	"library/logger"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// SubscribePartitions читает все партиции topic с конца и передает handler события, опубликованные после подключения,
+// пока не отменен ctx. Consumer group не используется и смещения не фиксируются, поэтому каждый экземпляр приложения
+// получает все события. Сообщения, которые не удалось разобрать, и ошибки handler только пишутся в лог
+func SubscribePartitions(ctx context.Context, consumer sarama.Consumer, topic string, handler events.Handler) error {
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	partitionConsumers := make([]sarama.PartitionConsumer, 0, len(partitions))
+	defer func() {
+		for _, partitionConsumer := range partitionConsumers {
+			partitionConsumer.Close()
+		}
+	}()
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		partitionConsumers = append(partitionConsumers, partitionConsumer)
+	}
+
+	var wg sync.WaitGroup
+	for _, partitionConsumer := range partitionConsumers {
+		wg.Add(1)
+		go func(messages <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for {
+				select {
+				case message, ok := <-messages:
+					if !ok {
+						return
+					}
+					envelope, err := events.Decode(message.Value)
+					if err != nil {
+						logger.ErrorLog.Printf("Failed to decode event %d/%d\tError: %v", message.Partition, message.Offset, err)
+						continue
+					}
+					if err := handler(envelope); err != nil {
+						logger.ErrorLog.Printf("Subscriber failed to handle event %s %s\tError: %v", envelope.Type, envelope.ID, err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(partitionConsumer.Messages())
+	}
+	wg.Wait()
+	return ctx.Err()
+}
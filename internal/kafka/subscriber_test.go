@@ -0,0 +1,62 @@
+package kafka_test
+
+import (
+	"context"
+	"encoding/json"
+	"library/internal/events"
+	"library/internal/kafka"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribePartitions(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	consumer.SetTopicMetadata(map[string][]int32{"library-events": {0, 1}})
+	partitions := []*mocks.PartitionConsumer{
+		consumer.ExpectConsumePartition("library-events", 0, sarama.OffsetNewest),
+		consumer.ExpectConsumePartition("library-events", 1, sarama.OffsetNewest),
+	}
+
+	var ids []string
+	for i, partition := range partitions {
+		envelope, err := events.New(events.BookDeleted, "", uint(i+1), events.BookDeletedPayload{ID: uint(i + 1)})
+		require.NoError(t, err)
+		value, err := json.Marshal(envelope)
+		require.NoError(t, err)
+		ids = append(ids, envelope.ID)
+		// Сообщение, которое невозможно разобрать, пропускается
+		partition.YieldMessage(&sarama.ConsumerMessage{Value: []byte("broken")})
+		partition.YieldMessage(&sarama.ConsumerMessage{Value: value})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	var received []string
+	done := make(chan error)
+	go func() {
+		done <- kafka.SubscribePartitions(ctx, consumer, "library-events", func(envelope events.Envelope) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, envelope.ID)
+			return nil
+		})
+	}()
+
+	// События всех партиций доставляются одному подписчику
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, ids, received)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
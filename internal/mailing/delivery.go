@@ -0,0 +1,106 @@
+package mailing
+
+import (
+	"library/internal/models"
+	"library/logger"
+	"sync"
+	"time"
+)
+
+const defaultDeliveryConcurrency = 4
+
+// deliveryConcurrency сколько писем рассылки отправляется одновременно
+var deliveryConcurrency = struct {
+	sync.RWMutex
+	limit int
+}{limit: defaultDeliveryConcurrency}
+
+// SetDeliveryConcurrency ограничивает количество одновременно отправляемых писем, чтобы не упираться в лимиты SMTP сервера
+func SetDeliveryConcurrency(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	deliveryConcurrency.Lock()
+	defer deliveryConcurrency.Unlock()
+	deliveryConcurrency.limit = limit
+}
+
+func currentDeliveryConcurrency() int {
+	deliveryConcurrency.RLock()
+	defer deliveryConcurrency.RUnlock()
+	return deliveryConcurrency.limit
+}
+
+// Recipient получатель письма. Каждому получателю письмо отправляется отдельно,
+// поэтому получатели не видят адреса друг друга
+type Recipient struct {
+	UserID  uint
+	Name    string
+	Email   string
+	Locale  string
+	Headers map[string]string
+}
+
+// subscriberRecipient получатель рассылки с личными заголовками отписки
+func subscriberRecipient(user models.User) Recipient {
+	return Recipient{UserID: user.ID, Name: user.Name, Email: user.Email, Locale: user.Locale, Headers: unsubscribeHeaders(user)}
+}
+
+// DeliveryResult результат отправки письма одному получателю. Err равен nil, если письмо принято транспортом.
+// Каждое письмо в очереди отправки адресовано одному получателю, поэтому ProcessOutbox сохраняет результат
+// в его строку outbox_emails (status, sent_at, last_error, attempts)
+type DeliveryResult struct {
+	EmailID uint // id письма в очереди отправки
+	UserID  uint
+	Email   string
+	Err     error
+	SentAt  time.Time
+}
+
+// delivery письмо одному получателю
+type delivery struct {
+	EmailID uint
+	UserID  uint
+	Message Message
+}
+
+// deliver отправляет письма, не более SetDeliveryConcurrency одновременно.
+// Ошибка одного получателя не мешает отправке остальным
+func deliver(deliveries []delivery) []DeliveryResult {
+	results := make([]DeliveryResult, len(deliveries))
+	mailer, from := currentMailer()
+
+	semaphore := make(chan struct{}, currentDeliveryConcurrency())
+	var wg sync.WaitGroup
+	for i, d := range deliveries {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, d delivery) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			d.Message.From = from
+			result := DeliveryResult{EmailID: d.EmailID, UserID: d.UserID, Email: d.Message.To[0]}
+			if err := mailer.Send(d.Message); err != nil {
+				result.Err = err
+				logger.ErrorLog.Printf("Failed to send email %q to %s\tError: %v", d.Message.Subject, result.Email, err)
+			} else {
+				result.SentAt = time.Now()
+			}
+			results[i] = result
+		}(i, d)
+	}
+	wg.Wait()
+	return results
+}
+
+// countFailed возвращает количество неудачных отправок
+func countFailed(results []DeliveryResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,77 @@
+package mailing_test
+
+import (
+	"errors"
+	"library/internal/database"
+	"library/internal/mailing"
+	"library/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectingMailer отклоняет письма на один адрес и сохраняет остальные
+type rejectingMailer struct {
+	mailing.MemoryMailer
+	rejected string
+}
+
+func (m *rejectingMailer) Send(msg mailing.Message) error {
+	if msg.To[0] == m.rejected {
+		return errors.New("550 mailbox unavailable")
+	}
+	return m.MemoryMailer.Send(msg)
+}
+
+func TestSendNewBookEmailPerRecipient(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	mailer := &rejectingMailer{rejected: "broken@example.com"}
+	mailing.SetMailer(mailer, "library@example.com")
+	mailing.SetDeliveryConcurrency(2)
+	defer mailing.SetMailer(mailing.LogMailer{}, "")
+
+	users := []models.User{
+		{Name: "Анна", Email: "anna@example.com", Role: "reader", Mailing: true},
+		{Name: "Борис", Email: "boris@example.com", Role: "reader", Mailing: true},
+		{Name: "Broken", Email: "broken@example.com", Role: "reader", Mailing: true},
+		{Name: "Digest", Email: "digest@example.com", Role: "reader", Mailing: true, MailingFrequency: models.MailingDaily},
+	}
+	for i := range users {
+		require.NoError(t, db.Create(&users[i]).Error)
+	}
+	book := models.Book{Title: "Книга", Author: "Автор"}
+	require.NoError(t, db.Create(&book).Error)
+
+	require.NoError(t, mailing.SendNewBookEmail(book, db))
+	results, err := mailing.ProcessOutbox(db, time.Now())
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	failed := map[string]bool{}
+	for _, result := range results {
+		failed[result.Email] = result.Err != nil
+		if result.Err == nil {
+			assert.False(t, result.SentAt.IsZero())
+		}
+	}
+	assert.Equal(t, map[string]bool{"anna@example.com": false, "boris@example.com": false, "broken@example.com": true}, failed)
+
+	// Каждое письмо адресовано одному получателю, содержит его имя и его ссылку отписки
+	messages := mailer.Messages()
+	require.Len(t, messages, 2)
+	for _, msg := range messages {
+		require.Len(t, msg.To, 1)
+		for _, user := range users[:2] {
+			if msg.To[0] != user.Email {
+				continue
+			}
+			assert.Contains(t, msg.HTMLBody, user.Name)
+			assert.Contains(t, msg.HTMLBody, mailing.UnsubscribeToken(user))
+			assert.Equal(t, "<"+mailing.UnsubscribeLink(user)+">", msg.Headers["List-Unsubscribe"])
+		}
+	}
+}
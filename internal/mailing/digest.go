@@ -0,0 +1,143 @@
+package mailing
+
+import (
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// digestLockTTL время, на которое экземпляр приложения захватывает отправку дайджестов,
+// чтобы при нескольких экземплярах дайджест не ушел дважды
+const digestLockTTL = 5 * time.Minute
+
+// DigestData данные письма-дайджеста
+type DigestData struct {
+	Name            string
+	Frequency       string // daily или weekly
+	Books           []EmailData
+	UnsubscribeLink string
+}
+
+// digestPeriod интервал между дайджестами. Для мгновенной доставки накопленные книги отправляются сразу,
+// например, если пользователь переключился с ежедневного дайджеста
+func digestPeriod(frequency string) time.Duration {
+	switch frequency {
+	case models.MailingDaily:
+		return 24 * time.Hour
+	case models.MailingWeekly:
+		return 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// QueueDigestItem ставит книгу в очередь дайджеста пользователя. Повторное событие о той же книге игнорируется
+func QueueDigestItem(db *gorm.DB, userID, bookID uint) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DigestItem{UserID: userID, BookID: bookID}).Error
+}
+
+// RunDigestScheduler периодически отправляет дайджесты, время которых подошло
+func RunDigestScheduler(db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cache.RunLocked("digest_lock", digestLockTTL, func() {
+			if _, err := SendDueDigests(db, time.Now()); err != nil {
+				logger.ErrorLog.Println("Failed to send digests\tError:", err)
+			}
+		})
+	}
+}
+
+// SendDueDigests отправляет дайджесты пользователям, у которых прошел период с прошлого дайджеста
+// (или с первой книги в очереди, если дайджест еще не отправлялся). Возвращает количество отправленных писем
+func SendDueDigests(db *gorm.DB, now time.Time) (int, error) {
+	var userIDs []uint
+	if err := db.Model(&models.DigestItem{}).Where("sent_at IS NULL").Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, userID := range userIDs {
+		ok, err := sendDigest(db, userID, now)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to send digest to user", userID, "\tError:", err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	if sent > 0 {
+		logger.InfoLog.Println("Digests sent:", sent)
+	}
+	return sent, nil
+}
+
+func sendDigest(db *gorm.DB, userID uint, now time.Time) (bool, error) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return false, err
+	}
+
+	var items []models.DigestItem
+	if err := db.Where("user_id = ? AND sent_at IS NULL", userID).Order("created_at").Find(&items).Error; err != nil {
+		return false, err
+	}
+	if len(items) == 0 {
+		return false, nil
+	}
+
+	periodStart := items[0].CreatedAt
+	if user.LastDigestSentAt != nil {
+		periodStart = *user.LastDigestSentAt
+	}
+	if now.Before(periodStart.Add(digestPeriod(user.MailingFrequency))) {
+		return false, nil
+	}
+
+	bookIDs := make([]uint, 0, len(items))
+	itemIDs := make([]uint, 0, len(items))
+	for _, item := range items {
+		bookIDs = append(bookIDs, item.BookID)
+		itemIDs = append(itemIDs, item.ID)
+	}
+	// Удаленные с момента постановки в очередь книги в дайджест не попадают
+	var books []models.Book
+	if err := db.Preload("Genres").Where("id IN ?", bookIDs).Order("id").Find(&books).Error; err != nil {
+		return false, err
+	}
+
+	// Пользователь мог отписаться после постановки книг в очередь
+	send := user.Mailing && len(books) > 0
+	var content Content
+	if send {
+		data := DigestData{Name: user.Name, Frequency: user.MailingFrequency, UnsubscribeLink: UnsubscribeLink(user)}
+		for _, book := range books {
+			data.Books = append(data.Books, newBookEmailData(book))
+		}
+		var err error
+		if content, err = Render(TemplateDigest, user.Locale, data); err != nil {
+			return false, err
+		}
+	}
+
+	// Письмо ставится в очередь отправки вместе с отметкой об отправке книг, чтобы дайджест не ушел дважды
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if send {
+			if err := QueueEmail(tx, subscriberRecipient(user), content); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.DigestItem{}).Where("id IN ?", itemIDs).Update("sent_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("last_digest_sent_at", now).Error
+	})
+	return send && err == nil, err
+}
@@ -0,0 +1,78 @@
+package mailing_test
+
+import (
+	"library/internal/database"
+	"library/internal/mailing"
+	"library/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigest(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	daily := models.User{Name: "Daily", Email: "daily@example.com", Role: "reader", Mailing: true, MailingFrequency: models.MailingDaily}
+	weekly := models.User{Name: "Weekly", Email: "weekly@example.com", Role: "reader", Mailing: true, MailingFrequency: models.MailingWeekly}
+	for _, user := range []*models.User{&daily, &weekly} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	first := models.Book{Title: "Первая", Author: "Автор"}
+	second := models.Book{Title: "Вторая", Author: "Автор"}
+	require.NoError(t, db.Create(&first).Error)
+	require.NoError(t, db.Create(&second).Error)
+
+	for _, user := range []models.User{daily, weekly} {
+		require.NoError(t, mailing.QueueDigestItem(db, user.ID, first.ID))
+		require.NoError(t, mailing.QueueDigestItem(db, user.ID, second.ID))
+	}
+	// Повторное событие о книге не дублирует ее в дайджесте
+	require.NoError(t, mailing.QueueDigestItem(db, daily.ID, first.ID))
+	var queued int64
+	db.Model(&models.DigestItem{}).Where("user_id = ?", daily.ID).Count(&queued)
+	assert.Equal(t, int64(2), queued)
+
+	pending := func(userID uint) int64 {
+		var count int64
+		db.Model(&models.DigestItem{}).Where("user_id = ? AND sent_at IS NULL", userID).Count(&count)
+		return count
+	}
+
+	// Период еще не прошел
+	sent, err := mailing.SendDueDigests(db, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	// Через сутки дайджест уходит только ежедневному подписчику
+	now := time.Now().Add(25 * time.Hour)
+	sent, err = mailing.SendDueDigests(db, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, int64(0), pending(daily.ID))
+	assert.Equal(t, int64(2), pending(weekly.ID))
+
+	// Следующий ежедневный дайджест отсчитывается от предыдущей отправки
+	third := models.Book{Title: "Третья", Author: "Автор"}
+	require.NoError(t, db.Create(&third).Error)
+	require.NoError(t, mailing.QueueDigestItem(db, daily.ID, third.ID))
+	sent, err = mailing.SendDueDigests(db, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, int64(1), pending(daily.ID))
+
+	// Удаленная книга не попадает в дайджест, а пустой дайджест не отправляется
+	require.NoError(t, db.Delete(&third).Error)
+	sent, err = mailing.SendDueDigests(db, now.Add(25*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, int64(0), pending(daily.ID))
+
+	sent, err = mailing.SendDueDigests(db, time.Now().Add(8*24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, int64(0), pending(weekly.ID))
+}
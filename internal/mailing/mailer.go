@@ -0,0 +1,280 @@
+package mailing
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"library/logger"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Транспорты писем
+const (
+	TransportSMTP   = "smtp"
+	TransportFile   = "file"
+	TransportLog    = "log"
+	TransportMemory = "memory"
+)
+
+// Режимы шифрования SMTP соединения
+const (
+	SMTPModeTLS      = "tls"      // TLS с самого начала соединения, обычно порт 465
+	SMTPModeSTARTTLS = "starttls" // обязательный STARTTLS, обычно порт 587
+	SMTPModeNone     = "none"     // без шифрования, только для локальных релеев
+)
+
+const smtpTimeout = 30 * time.Second
+
+var ErrUnknownTransport = errors.New("unknown mail transport")
+
+// Message письмо, готовое к отправке
+type Message struct {
+	From     string
+	To       []string
+	Subject  string
+	HTMLBody string
+	TextBody string // текстовая версия письма для клиентов без HTML
+	Headers  map[string]string
+}
+
+// Mailer доставляет письма
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// MailerConfig настройки транспорта писем
+type MailerConfig struct {
+	Transport string // smtp, file, log или memory
+	From      string
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPMode     string // tls, starttls или none
+
+	// Dir каталог, в который файловый транспорт складывает .eml файлы
+	Dir string
+}
+
+// String описывает настройки без пароля, чтобы конфигурацию можно было безопасно писать в лог
+func (c MailerConfig) String() string {
+	switch c.Transport {
+	case TransportSMTP:
+		return fmt.Sprintf("smtp %s (%s, user %q)", net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort)), c.SMTPMode, c.SMTPUsername)
+	case TransportFile:
+		return "file " + c.Dir
+	default:
+		return c.Transport
+	}
+}
+
+// NewMailer создает транспорт по настройкам
+func NewMailer(cfg MailerConfig) (Mailer, error) {
+	switch cfg.Transport {
+	case TransportSMTP:
+		switch cfg.SMTPMode {
+		case SMTPModeTLS, SMTPModeSTARTTLS, SMTPModeNone:
+		default:
+			return nil, fmt.Errorf("unknown SMTP mode %q", cfg.SMTPMode)
+		}
+		if cfg.SMTPHost == "" || cfg.SMTPPort == 0 {
+			return nil, errors.New("SMTP host and port are required")
+		}
+		return &SMTPMailer{config: cfg}, nil
+	case TransportFile:
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: cfg.Dir}, nil
+	case TransportLog:
+		return LogMailer{}, nil
+	case TransportMemory:
+		return &MemoryMailer{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, cfg.Transport)
+	}
+}
+
+// mailerState транспорт и адрес отправителя, задаются при старте приложения.
+// До вызова SetMailer письма только пишутся в лог
+var mailerState = struct {
+	sync.RWMutex
+	mailer Mailer
+	from   string
+}{mailer: LogMailer{}, from: "library@localhost"}
+
+// SetMailer задает транспорт, через который отправляются все письма, и адрес отправителя
+func SetMailer(mailer Mailer, from string) {
+	mailerState.Lock()
+	defer mailerState.Unlock()
+	mailerState.mailer = mailer
+	if from != "" {
+		mailerState.from = from
+	}
+}
+
+func currentMailer() (Mailer, string) {
+	mailerState.RLock()
+	defer mailerState.RUnlock()
+	return mailerState.mailer, mailerState.from
+}
+
+// writeMessage записывает письмо в формате RFC 5322
+func writeMessage(w io.Writer, msg Message) error {
+	message := gomail.NewMessage()
+	message.SetHeader("From", msg.From)
+	message.SetHeader("To", msg.To...)
+	message.SetHeader("Subject", msg.Subject)
+	for name, value := range msg.Headers {
+		message.SetHeader(name, value)
+	}
+	message.SetDateHeader("Date", time.Now())
+	if msg.TextBody != "" {
+		message.SetBody("text/plain", msg.TextBody)
+		message.AddAlternative("text/html", msg.HTMLBody)
+	} else {
+		message.SetBody("text/html", msg.HTMLBody)
+	}
+	_, err := message.WriteTo(w)
+	return err
+}
+
+// SMTPMailer отправляет письма через SMTP сервер
+type SMTPMailer struct {
+	config MailerConfig
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	address := net.JoinHostPort(m.config.SMTPHost, strconv.Itoa(m.config.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: m.config.SMTPHost, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	var err error
+	if m.config.SMTPMode == SMTPModeTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, smtpTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.config.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.config.SMTPMode == SMTPModeSTARTTLS {
+		// Без STARTTLS письмо и пароль ушли бы открытым текстом, поэтому такой сервер считается ошибкой
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.config.SMTPUsername != "" {
+		// smtp.PlainAuth сам отказывается передавать пароль по нешифрованному соединению на удаленный сервер
+		auth := smtp.PlainAuth("", m.config.SMTPUsername, m.config.SMTPPassword, m.config.SMTPHost)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(msg.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(w, msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// FileMailer сохраняет письма в .eml файлы, которые открываются почтовым клиентом. Для локальной разработки
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405.000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	file, err := os.OpenFile(filepath.Join(m.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(file, msg); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LogMailer только пишет в лог получателей и тему письма. Используется, пока почта не настроена
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	logger.InfoLog.Printf("Email %q to %v is not sent: mail transport is not configured", msg.Subject, msg.To)
+	return nil
+}
+
+// MemoryMailer хранит отправленные письма в памяти. Для тестов
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages возвращает копию отправленных писем
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset удаляет сохраненные письма
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
@@ -0,0 +1,141 @@
+package mailing_test
+
+import (
+	"bufio"
+	"library/internal/database"
+	"library/internal/mailing"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer принимает одно письмо без шифрования и аутентификации и возвращает его через канал
+func fakeSMTPServer(t *testing.T) (string, int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 fake ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 fake")
+			case command == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return address.IP.String(), address.Port, received
+}
+
+func TestMemoryMailer(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	mailer := &mailing.MemoryMailer{}
+	mailing.SetMailer(mailer, "library@example.com")
+	defer mailing.SetMailer(mailing.LogMailer{}, "")
+
+	headers := map[string]string{"List-Unsubscribe": "<http://localhost/unsubscribe>"}
+	require.NoError(t, mailing.QueueEmail(db, mailing.Recipient{Email: "reader@example.com", Headers: headers}, mailing.Content{Subject: "Тема", HTML: "<p>Текст</p>"}))
+	results, err := mailing.ProcessOutbox(db, time.Now())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, "reader@example.com", results[0].Email)
+
+	messages := mailer.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "library@example.com", messages[0].From)
+	assert.Equal(t, []string{"reader@example.com"}, messages[0].To)
+	assert.Equal(t, "Тема", messages[0].Subject)
+	assert.Equal(t, "<http://localhost/unsubscribe>", messages[0].Headers["List-Unsubscribe"])
+
+	mailer.Reset()
+	assert.Empty(t, mailer.Messages())
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer, err := mailing.NewMailer(mailing.MailerConfig{Transport: mailing.TransportFile, Dir: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, mailer.Send(mailing.Message{From: "library@example.com", To: []string{"reader@example.com"}, Subject: "Hello", HTMLBody: "<p>Body</p>"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "To: reader@example.com")
+	assert.Contains(t, string(content), "Subject: Hello")
+	assert.Contains(t, string(content), "<p>Body</p>")
+}
+
+func TestSMTPMailer(t *testing.T) {
+	host, port, received := fakeSMTPServer(t)
+	mailer, err := mailing.NewMailer(mailing.MailerConfig{Transport: mailing.TransportSMTP, SMTPHost: host, SMTPPort: port, SMTPMode: mailing.SMTPModeNone})
+	require.NoError(t, err)
+
+	require.NoError(t, mailer.Send(mailing.Message{From: "library@example.com", To: []string{"reader@example.com"}, Subject: "Hello", HTMLBody: "<p>Body</p>"}))
+	assert.Contains(t, <-received, "Subject: Hello")
+
+	// Сервер без STARTTLS не подходит для режима starttls: письмо и пароль ушли бы открытым текстом
+	host, port, _ = fakeSMTPServer(t)
+	mailer, err = mailing.NewMailer(mailing.MailerConfig{Transport: mailing.TransportSMTP, SMTPHost: host, SMTPPort: port, SMTPMode: mailing.SMTPModeSTARTTLS})
+	require.NoError(t, err)
+	assert.ErrorContains(t, mailer.Send(mailing.Message{From: "library@example.com", To: []string{"reader@example.com"}}), "STARTTLS")
+}
+
+func TestMailerConfig(t *testing.T) {
+	config := mailing.MailerConfig{Transport: mailing.TransportSMTP, SMTPHost: "smtp.example.com", SMTPPort: 587, SMTPUsername: "library", SMTPPassword: "s3cr3t-password", SMTPMode: mailing.SMTPModeSTARTTLS}
+	assert.NotContains(t, config.String(), "s3cr3t-password")
+	assert.Contains(t, config.String(), "smtp.example.com:587")
+
+	_, err := mailing.NewMailer(mailing.MailerConfig{Transport: "pigeon"})
+	assert.ErrorIs(t, err, mailing.ErrUnknownTransport)
+	config.SMTPMode = "ssl"
+	_, err = mailing.NewMailer(config)
+	assert.Error(t, err)
+}
@@ -1,19 +1,18 @@
 package mailing
 
 import (
-	"bytes"
 	"library/internal/models"
 	"library/logger"
-	"os"
 	"strconv"
-	"text/template"
-
-	"gopkg.in/gomail.v2"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// EmailData данные письма о новой книге. Name и UnsubscribeLink заполняются для каждого получателя
 type EmailData struct {
+	Name            string
 	Title           string
 	Author          string
 	Genres          string
@@ -22,91 +21,95 @@ type EmailData struct {
 	UnsubscribeLink string
 }
 
-func SendNewBookEmail(book models.Book, db *gorm.DB) {
-	genres := book.Genres[0].Name
-	if len(book.Genres) > 1 {
-		for i, genre := range book.Genres {
-			if i == 0 {
-				continue
-			}
-			genres = genres + ", " + genre.Name
-		}
+// newBookEmailData данные книги для писем о новых книгах
+func newBookEmailData(book models.Book) EmailData {
+	genres := make([]string, 0, len(book.Genres))
+	for _, genre := range book.Genres {
+		genres = append(genres, genre.Name)
 	}
 
-	emailBook := EmailData{
-		Title:           book.Title,
-		Author:          book.Author,
-		Genres:          genres,
-		Description:     book.Description,
-		BookLink:        "http://localhost:8080/getBook?bookId=" + strconv.Itoa(int(book.ID)),
-		UnsubscribeLink: "http://localhost:8080/unsubMailing",
+	return EmailData{
+		Title:       book.Title,
+		Author:      book.Author,
+		Genres:      strings.Join(genres, ", "),
+		Description: book.Description,
+		BookLink:    PublicURL() + "/getBook?bookId=" + strconv.Itoa(int(book.ID)),
 	}
+}
+
+// SendNewBookEmail сообщает подписчикам о новой книге. Подписчикам с мгновенной доставкой письмо ставится
+// в очередь отправки, для остальных книга ставится в очередь дайджеста. Ошибка означает, что письма не поставлены
+// в очередь и рассылку можно повторить
+func SendNewBookEmail(book models.Book, db *gorm.DB) error {
+	emailBook := newBookEmailData(book)
 
-	emails, err := GetSubscribers(db)
+	subscribers, err := GetSubscribers(db, book)
 	if err != nil {
 		logger.ErrorLog.Println("Failed to get subscribers: ", err)
-		return
+		return err
 	}
 	logger.InfoLog.Println("Geting subscribers for mailing succesfully")
 
-	html, err := GenerateEmailNewBookBody(emailBook)
-	if err != nil {
-		logger.ErrorLog.Println("Failed to create html body to send email about new book: ", err)
-	}
-	logger.InfoLog.Println("Generate html body for mailing succesfully")
-
-	SendEmail(emails, "Новая книга доступна!", html)
-}
-
-func GetSubscribers(db *gorm.DB) ([]string, error) {
-	var emails []string
-	err := db.Model(&models.User{}).Where("mailing = ?", true).Pluck("email", &emails).Error
-	return emails, err
-}
+	var emails []models.OutboxEmail
+	queued := 0
+	for _, subscriber := range subscribers {
+		if subscriber.MailingFrequency != "" && subscriber.MailingFrequency != models.MailingImmediate {
+			if err := QueueDigestItem(db, subscriber.ID, book.ID); err != nil {
+				logger.ErrorLog.Println("Failed to queue digest item for user", subscriber.ID, "\tError:", err)
+				continue
+			}
+			queued++
+			continue
+		}
 
-func SendEmail(to []string, subject, body string) {
-	from := os.Getenv("SMTP_Name")
-	password := os.Getenv("SMTP_Password")
-	if (from == "") || (password == "") {
-		logger.ErrorLog.Println(`"SMTP_Name" or "SMTP_Password" empty in .env`)
-		return
+		// Письмо отправляется каждому подписчику отдельно, с его именем и личной ссылкой отписки
+		data := emailBook
+		data.Name = subscriber.Name
+		data.UnsubscribeLink = UnsubscribeLink(subscriber)
+		content, err := Render(TemplateNewBook, subscriber.Locale, data)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to render email about new book: ", err)
+			return err
+		}
+		email, err := newOutboxEmail(subscriberRecipient(subscriber), content)
+		if err != nil {
+			logger.ErrorLog.Println("Failed to create email about new book for user", subscriber.ID, "\tError:", err)
+			continue
+		}
+		emails = append(emails, email)
 	}
 
-	logger.InfoLog.Println("SMTP_Name:"+from, "\tSMTP_Password:"+password)
-
-	mailer := gomail.NewMessage()
-	mailer.SetHeader("From", from)
-	mailer.SetHeader("To", to...)
-	mailer.SetHeader("Subject", subject)
-	mailer.SetBody("text/html", body)
-	dialer := gomail.NewDialer("smtp.mail.ru", 465, from, password)
-	dialer.SSL = true
-
-	if err := dialer.DialAndSend(mailer); err != nil {
-		logger.ErrorLog.Printf("Failed to send email: %+v", err)
-		return
+	if len(emails) > 0 {
+		if err := db.CreateInBatches(&emails, outboxBatchSize).Error; err != nil {
+			logger.ErrorLog.Println("Failed to queue emails about new book\tError:", err)
+			return err
+		}
 	}
+	logger.InfoLog.Println("Mailing about new book queued for", len(emails), "subscribers, queued for digest of", queued, "subscribers")
+	return nil
+}
 
-	logger.InfoLog.Println("Email sent to: ", to)
+// AccountLockedData данные письма о блокировке входа
+type AccountLockedData struct {
+	Name        string
+	IP          string
+	LockMinutes int
 }
 
-func GenerateEmailNewBookBody(book EmailData) (string, error) {
-	html, err := os.ReadFile("HTML/NewBook.html")
+// SendAccountLockedEmail сообщает владельцу аккаунта, что вход заблокирован из-за неудачных попыток
+func SendAccountLockedEmail(db *gorm.DB, user models.User, ip string, lockDuration time.Duration) {
+	content, err := Render(TemplateAccountLocked, user.Locale, AccountLockedData{
+		Name:        user.Name,
+		IP:          ip,
+		LockMinutes: int(lockDuration.Minutes()),
+	})
 	if err != nil {
-		return "", err
+		logger.ErrorLog.Println("Failed to render email about account lockout: ", err)
+		return
 	}
 
-	emailTemplate := string(html)
-
-	tmpl, err := template.New("email").Parse(emailTemplate)
-	if err != nil {
-		return "", err
-	}
-	logger.InfoLog.Println(book)
-	var body bytes.Buffer
-	if err := tmpl.Execute(&body, book); err != nil {
-		return "", err
+	recipient := Recipient{UserID: user.ID, Name: user.Name, Email: user.Email, Locale: user.Locale}
+	if err := QueueEmail(db, recipient, content); err != nil {
+		logger.ErrorLog.Println("Failed to queue email about account lockout\tError:", err)
 	}
-
-	return body.String(), nil
 }
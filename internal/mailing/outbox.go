@@ -0,0 +1,196 @@
+package mailing
+
+import (
+	"encoding/json"
+	"errors"
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// outboxBatchSize сколько писем воркер берет из очереди за один проход
+	outboxBatchSize = 100
+	// outboxLockTTL время, на которое экземпляр приложения захватывает очередь писем
+	outboxLockTTL = 5 * time.Minute
+	// maxRetryDelay верхняя граница паузы между попытками
+	maxRetryDelay = 6 * time.Hour
+)
+
+var (
+	ErrEmailNotFound    = errors.New("email not found")
+	ErrEmailAlreadySent = errors.New("email already sent")
+)
+
+// outboxPolicy настройки повторных попыток, задаются при старте приложения из конфигурации
+var outboxPolicy = struct {
+	sync.RWMutex
+	maxAttempts int
+	retryDelay  time.Duration
+}{maxAttempts: 8, retryDelay: time.Minute}
+
+// SetOutboxPolicy задает количество попыток отправки письма и паузу перед первым повтором.
+// Каждая следующая пауза вдвое длиннее предыдущей
+func SetOutboxPolicy(maxAttempts int, retryDelay time.Duration) {
+	outboxPolicy.Lock()
+	defer outboxPolicy.Unlock()
+	if maxAttempts > 0 {
+		outboxPolicy.maxAttempts = maxAttempts
+	}
+	if retryDelay > 0 {
+		outboxPolicy.retryDelay = retryDelay
+	}
+}
+
+// retryDelay пауза перед следующей попыткой после attempts неудачных
+func retryDelay(attempts int) time.Duration {
+	outboxPolicy.RLock()
+	delay := outboxPolicy.retryDelay
+	outboxPolicy.RUnlock()
+
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+func maxAttempts() int {
+	outboxPolicy.RLock()
+	defer outboxPolicy.RUnlock()
+	return outboxPolicy.maxAttempts
+}
+
+// newOutboxEmail письмо получателю для очереди отправки
+func newOutboxEmail(recipient Recipient, content Content) (models.OutboxEmail, error) {
+	email := models.OutboxEmail{
+		UserID:        recipient.UserID,
+		Recipient:     recipient.Email,
+		Subject:       content.Subject,
+		HTMLBody:      content.HTML,
+		TextBody:      content.Text,
+		Status:        models.EmailPending,
+		NextAttemptAt: time.Now(),
+	}
+	if len(recipient.Headers) > 0 {
+		headers, err := json.Marshal(recipient.Headers)
+		if err != nil {
+			return email, err
+		}
+		email.Headers = string(headers)
+	}
+	return email, nil
+}
+
+// QueueEmail ставит письмо в очередь отправки. Письмо сохраняется в базе и не теряется,
+// если SMTP сервер недоступен или приложение перезапускается
+func QueueEmail(db *gorm.DB, recipient Recipient, content Content) error {
+	email, err := newOutboxEmail(recipient, content)
+	if err != nil {
+		return err
+	}
+	return db.Create(&email).Error
+}
+
+// RunOutboxWorker периодически отправляет письма из очереди
+func RunOutboxWorker(db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cache.RunLocked("email_outbox_lock", outboxLockTTL, func() {
+			if _, err := ProcessOutbox(db, time.Now()); err != nil {
+				logger.ErrorLog.Println("Failed to process email outbox\tError:", err)
+			}
+		})
+	}
+}
+
+// ProcessOutbox отправляет письма, время попытки которых подошло, и сохраняет результат каждой отправки.
+// Неудачная попытка откладывает письмо с растущей паузой, а после последней попытки письмо получает статус dead
+func ProcessOutbox(db *gorm.DB, now time.Time) ([]DeliveryResult, error) {
+	var emails []models.OutboxEmail
+	if err := db.Where("status = ? AND next_attempt_at <= ?", models.EmailPending, now).
+		Order("next_attempt_at, id").Limit(outboxBatchSize).Find(&emails).Error; err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	deliveries := make([]delivery, 0, len(emails))
+	for _, email := range emails {
+		var headers map[string]string
+		if email.Headers != "" {
+			if err := json.Unmarshal([]byte(email.Headers), &headers); err != nil {
+				logger.ErrorLog.Println("Failed to parse headers of email", email.ID, "\tError:", err)
+			}
+		}
+		deliveries = append(deliveries, delivery{EmailID: email.ID, UserID: email.UserID, Message: Message{
+			To:       []string{email.Recipient},
+			Subject:  email.Subject,
+			HTMLBody: email.HTMLBody,
+			TextBody: email.TextBody,
+			Headers:  headers,
+		}})
+	}
+
+	results := deliver(deliveries)
+	limit := maxAttempts()
+	for i, result := range results {
+		email := emails[i]
+		updates := map[string]interface{}{"attempts": email.Attempts + 1}
+		switch {
+		case result.Err == nil:
+			updates["status"] = models.EmailSent
+			updates["sent_at"] = result.SentAt
+			updates["last_error"] = ""
+		case email.Attempts+1 >= limit:
+			updates["status"] = models.EmailDead
+			updates["last_error"] = result.Err.Error()
+			logger.ErrorLog.Printf("Email %d to %s is dead after %d attempts\tError: %v", email.ID, email.Recipient, email.Attempts+1, result.Err)
+		default:
+			updates["next_attempt_at"] = now.Add(retryDelay(email.Attempts + 1))
+			updates["last_error"] = result.Err.Error()
+		}
+		if err := db.Model(&models.OutboxEmail{}).Where("id = ?", email.ID).Updates(updates).Error; err != nil {
+			logger.ErrorLog.Println("Failed to save delivery status of email", email.ID, "\tError:", err)
+		}
+	}
+
+	failed := countFailed(results)
+	logger.InfoLog.Println("Email outbox processed: sent", len(results)-failed, "failed", failed)
+	return results, nil
+}
+
+// RetryEmail возвращает письмо в очередь с обнуленным счетчиком попыток
+func RetryEmail(db *gorm.DB, id uint) error {
+	var email models.OutboxEmail
+	if err := db.First(&email, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrEmailNotFound
+		}
+		return err
+	}
+	if email.Status == models.EmailSent {
+		return ErrEmailAlreadySent
+	}
+	return db.Model(&email).Updates(map[string]interface{}{
+		"status":          models.EmailPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	}).Error
+}
+
+// RetryDeadEmails возвращает в очередь все письма со статусом dead и возвращает их количество
+func RetryDeadEmails(db *gorm.DB) (int64, error) {
+	result := db.Model(&models.OutboxEmail{}).Where("status = ?", models.EmailDead).Updates(map[string]interface{}{
+		"status":          models.EmailPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	return result.RowsAffected, result.Error
+}
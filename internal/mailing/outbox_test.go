@@ -0,0 +1,85 @@
+package mailing_test
+
+import (
+	"library/internal/database"
+	"library/internal/mailing"
+	"library/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	mailer := &rejectingMailer{rejected: "broken@example.com"}
+	mailing.SetMailer(mailer, "library@example.com")
+	mailing.SetOutboxPolicy(3, time.Minute)
+	defer mailing.SetMailer(mailing.LogMailer{}, "")
+
+	headers := map[string]string{"List-Unsubscribe": "<http://localhost/unsubscribe>"}
+	require.NoError(t, mailing.QueueEmail(db, mailing.Recipient{UserID: 1, Email: "reader@example.com", Headers: headers}, mailing.Content{Subject: "Hello", HTML: "<p>Body</p>"}))
+	require.NoError(t, mailing.QueueEmail(db, mailing.Recipient{Email: "broken@example.com"}, mailing.Content{Subject: "Hello", HTML: "<p>Body</p>"}))
+
+	load := func(recipient string) models.OutboxEmail {
+		var email models.OutboxEmail
+		require.NoError(t, db.Where("recipient = ?", recipient).First(&email).Error)
+		return email
+	}
+
+	now := time.Now()
+	results, err := mailing.ProcessOutbox(db, now)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	sent := load("reader@example.com")
+	assert.Equal(t, models.EmailSent, sent.Status)
+	assert.NotNil(t, sent.SentAt)
+	require.Len(t, mailer.Messages(), 1)
+	assert.Equal(t, headers, mailer.Messages()[0].Headers)
+
+	// Неудачная попытка откладывает письмо, и каждая следующая пауза вдвое длиннее
+	failed := load("broken@example.com")
+	assert.Equal(t, models.EmailPending, failed.Status)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Contains(t, failed.LastError, "550")
+	assert.WithinDuration(t, now.Add(time.Minute), failed.NextAttemptAt, time.Second)
+
+	results, err = mailing.ProcessOutbox(db, now)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	now = now.Add(time.Minute)
+	_, err = mailing.ProcessOutbox(db, now)
+	require.NoError(t, err)
+	failed = load("broken@example.com")
+	assert.Equal(t, 2, failed.Attempts)
+	assert.WithinDuration(t, now.Add(2*time.Minute), failed.NextAttemptAt, time.Second)
+
+	// После последней попытки письмо больше не отправляется
+	now = now.Add(2 * time.Minute)
+	_, err = mailing.ProcessOutbox(db, now)
+	require.NoError(t, err)
+	assert.Equal(t, models.EmailDead, load("broken@example.com").Status)
+	results, err = mailing.ProcessOutbox(db, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	// Отправленное письмо повторить нельзя, а dead письмо возвращается в очередь
+	assert.ErrorIs(t, mailing.RetryEmail(db, sent.ID), mailing.ErrEmailAlreadySent)
+	assert.ErrorIs(t, mailing.RetryEmail(db, 1000), mailing.ErrEmailNotFound)
+	retried, err := mailing.RetryDeadEmails(db)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), retried)
+
+	mailer.rejected = ""
+	results, err = mailing.ProcessOutbox(db, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, models.EmailSent, load("broken@example.com").Status)
+}
@@ -0,0 +1,38 @@
+package mailing
+
+import (
+	"library/internal/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// NormalizeAuthor приводит имя автора к виду, в котором хранятся подписки на авторов
+func NormalizeAuthor(author string) string {
+	return strings.ToLower(strings.Join(strings.Fields(author), " "))
+}
+
+// GetSubscribers возвращает подписчиков рассылки, которым интересна книга: подписанных на один из её жанров
+// или на её автора. Пользователи без подписок на жанры и авторов получают письма обо всех книгах
+func GetSubscribers(db *gorm.DB, book models.Book) ([]models.User, error) {
+	genreIDs := make([]uint, 0, len(book.Genres))
+	for _, genre := range book.Genres {
+		genreIDs = append(genreIDs, genre.ID)
+	}
+
+	anyGenre := db.Model(&models.GenreSubscription{}).Select("1").Where("genre_subscriptions.user_id = users.id")
+	anyAuthor := db.Model(&models.AuthorSubscription{}).Select("1").Where("author_subscriptions.user_id = users.id")
+	matchingGenre := db.Model(&models.GenreSubscription{}).Select("1").
+		Where("genre_subscriptions.user_id = users.id AND genre_subscriptions.genre_id IN ?", genreIDs)
+	matchingAuthor := db.Model(&models.AuthorSubscription{}).Select("1").
+		Where("author_subscriptions.user_id = users.id AND author_subscriptions.author = ?", NormalizeAuthor(book.Author))
+
+	// Пустой список жанров gorm превращает в IN (NULL), такое условие не совпадает ни с одной подпиской
+	var users []models.User
+	err := db.Where("mailing = ?", true).
+		Where(db.Where("NOT EXISTS (?) AND NOT EXISTS (?)", anyGenre, anyAuthor).
+			Or("EXISTS (?)", matchingGenre).
+			Or("EXISTS (?)", matchingAuthor)).
+		Find(&users).Error
+	return users, err
+}
@@ -0,0 +1,54 @@
+package mailing_test
+
+import (
+	"library/internal/database"
+	"library/internal/mailing"
+	"library/internal/models"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSubscribers(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	detective := models.Genre{Name: "Детектив"}
+	textbook := models.Genre{Name: "Учебная литература"}
+	require.NoError(t, db.Create(&detective).Error)
+	require.NoError(t, db.Create(&textbook).Error)
+
+	everything := models.User{Name: "Everything", Email: "everything@example.com", Role: "reader", Mailing: true}
+	detectives := models.User{Name: "Detectives", Email: "detectives@example.com", Role: "reader", Mailing: true}
+	christie := models.User{Name: "Christie", Email: "christie@example.com", Role: "reader", Mailing: true}
+	unsubscribed := models.User{Name: "Unsubscribed", Email: "unsubscribed@example.com", Role: "reader", Mailing: false}
+	for _, user := range []*models.User{&everything, &detectives, &christie, &unsubscribed} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	require.NoError(t, db.Create(&models.GenreSubscription{UserID: detectives.ID, GenreID: detective.ID}).Error)
+	require.NoError(t, db.Create(&models.GenreSubscription{UserID: unsubscribed.ID, GenreID: detective.ID}).Error)
+	require.NoError(t, db.Create(&models.AuthorSubscription{UserID: christie.ID, Author: mailing.NormalizeAuthor("Агата  Кристи")}).Error)
+
+	recipients := func(book models.Book) []string {
+		users, err := mailing.GetSubscribers(db, book)
+		require.NoError(t, err)
+		emails := []string{}
+		for _, user := range users {
+			emails = append(emails, user.Email)
+		}
+		sort.Strings(emails)
+		return emails
+	}
+
+	assert.Equal(t, []string{"detectives@example.com", "everything@example.com"},
+		recipients(models.Book{Author: "Артур Конан Дойл", Genres: []models.Genre{detective}}))
+	assert.Equal(t, []string{"christie@example.com", "detectives@example.com", "everything@example.com"},
+		recipients(models.Book{Author: "агата кристи", Genres: []models.Genre{detective}}))
+	assert.Equal(t, []string{"everything@example.com"},
+		recipients(models.Book{Author: "John Doe", Genres: []models.Genre{textbook}}))
+	assert.Equal(t, []string{"christie@example.com", "everything@example.com"},
+		recipients(models.Book{Author: "Агата Кристи"}))
+}
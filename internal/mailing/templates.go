@@ -0,0 +1,172 @@
+package mailing
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"library/internal/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Шаблоны писем встроены в бинарный файл. Для каждого письма есть HTML версия и текстовая версия,
+// в которой блок "subject" задает тему письма
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Шаблоны писем
+const (
+	TemplateNewBook       = "new_book"
+	TemplateDigest        = "digest"
+	TemplateAccountLocked = "account_locked"
+)
+
+// Языки писем. Для пользователей с другим языком письма отправляются на DefaultLocale
+const (
+	LocaleRU      = "ru"
+	LocaleEN      = "en"
+	DefaultLocale = LocaleRU
+)
+
+var (
+	TemplateNames = []string{TemplateNewBook, TemplateDigest, TemplateAccountLocked}
+	Locales       = []string{LocaleRU, LocaleEN}
+)
+
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// Content тема и текст письма
+type Content struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// templateDir каталог, шаблоны из которого заменяют встроенные
+var templateDir = struct {
+	sync.RWMutex
+	dir string
+}{}
+
+// SetTemplateDir задает каталог с шаблонами вида <dir>/<язык>/<шаблон>.html и .txt. Шаблоны из него
+// заменяют встроенные и перечитываются при каждой отправке. Отсутствующие файлы берутся из встроенных шаблонов
+func SetTemplateDir(dir string) {
+	templateDir.Lock()
+	defer templateDir.Unlock()
+	templateDir.dir = dir
+}
+
+// NormalizeLocale приводит язык вида "en-US" к поддерживаемому языку писем
+func NormalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	if slices.Contains(Locales, locale) {
+		return locale
+	}
+	return DefaultLocale
+}
+
+// readTemplate ищет файл шаблона сначала в каталоге замены, затем среди встроенных.
+// Если шаблона нет на языке пользователя, используется шаблон на DefaultLocale
+func readTemplate(name, locale, ext string) ([]byte, error) {
+	templateDir.RLock()
+	dir := templateDir.dir
+	templateDir.RUnlock()
+
+	for _, loc := range slices.Compact([]string{locale, DefaultLocale}) {
+		if dir != "" {
+			content, err := os.ReadFile(filepath.Join(dir, loc, name+ext))
+			if err == nil {
+				return content, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		content, err := embeddedTemplates.ReadFile("templates/" + loc + "/" + name + ext)
+		if err == nil {
+			return content, nil
+		}
+	}
+	return nil, ErrUnknownTemplate
+}
+
+// Render формирует тему, HTML и текстовую версию письма на языке пользователя
+func Render(name, locale string, data interface{}) (Content, error) {
+	var content Content
+	if !slices.Contains(TemplateNames, name) {
+		return content, ErrUnknownTemplate
+	}
+	locale = NormalizeLocale(locale)
+
+	source, err := readTemplate(name, locale, ".html")
+	if err != nil {
+		return content, err
+	}
+	htmlTemplate, err := htmltemplate.New(name).Parse(string(source))
+	if err != nil {
+		return content, err
+	}
+	var body bytes.Buffer
+	if err := htmlTemplate.Execute(&body, data); err != nil {
+		return content, err
+	}
+	content.HTML = body.String()
+
+	source, err = readTemplate(name, locale, ".txt")
+	if err != nil {
+		return content, err
+	}
+	textTemplate, err := texttemplate.New(name).Parse(string(source))
+	if err != nil {
+		return content, err
+	}
+	body.Reset()
+	if err := textTemplate.ExecuteTemplate(&body, "subject", data); err != nil {
+		return content, err
+	}
+	content.Subject = strings.TrimSpace(body.String())
+	body.Reset()
+	if err := textTemplate.Execute(&body, data); err != nil {
+		return content, err
+	}
+	content.Text = strings.TrimSpace(body.String()) + "\n"
+
+	return content, nil
+}
+
+// SampleData данные для предпросмотра шаблона
+func SampleData(name string) (interface{}, error) {
+	book := EmailData{
+		Name:            "Иван",
+		Title:           "Golang Basics",
+		Author:          "John Doe",
+		Genres:          "Учебная литература, Программирование",
+		Description:     "Эта книга — идеальный выбор для тех, кто хочет начать свое путешествие в программировании на языке Go.",
+		BookLink:        PublicURL() + "/getBook?bookId=1",
+		UnsubscribeLink: PublicURL() + "/unsubscribe?token=sample",
+	}
+
+	switch name {
+	case TemplateNewBook:
+		return book, nil
+	case TemplateDigest:
+		second := book
+		second.Title = "Concurrency in Go"
+		second.BookLink = PublicURL() + "/getBook?bookId=2"
+		return DigestData{Name: book.Name, Frequency: models.MailingDaily, Books: []EmailData{book, second}, UnsubscribeLink: book.UnsubscribeLink}, nil
+	case TemplateAccountLocked:
+		return AccountLockedData{Name: book.Name, IP: "203.0.113.7", LockMinutes: 15}, nil
+	default:
+		return nil, ErrUnknownTemplate
+	}
+}
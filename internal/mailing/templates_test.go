@@ -0,0 +1,61 @@
+package mailing_test
+
+import (
+	"library/internal/mailing"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	for _, name := range mailing.TemplateNames {
+		data, err := mailing.SampleData(name)
+		require.NoError(t, err)
+		for _, locale := range mailing.Locales {
+			content, err := mailing.Render(name, locale, data)
+			require.NoError(t, err, name, locale)
+			assert.NotEmpty(t, content.Subject, name, locale)
+			assert.Contains(t, content.HTML, `lang="`+locale+`"`, name)
+			assert.Contains(t, content.Text, "Иван", name, locale)
+			assert.NotContains(t, content.Text, "<", name, locale)
+		}
+	}
+
+	data, err := mailing.SampleData(mailing.TemplateNewBook)
+	require.NoError(t, err)
+	content, err := mailing.Render(mailing.TemplateNewBook, "en-US", data)
+	require.NoError(t, err)
+	assert.Equal(t, "A new book is available!", content.Subject)
+	assert.Contains(t, content.Text, "/unsubscribe?token=sample")
+
+	// Неподдерживаемый язык заменяется языком по умолчанию
+	content, err = mailing.Render(mailing.TemplateNewBook, "de", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Новая книга доступна!", content.Subject)
+
+	_, err = mailing.Render("../../main", mailing.LocaleRU, data)
+	assert.ErrorIs(t, err, mailing.ErrUnknownTemplate)
+}
+
+func TestTemplateOverrideDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, mailing.LocaleEN), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, mailing.LocaleEN, "new_book.html"), []byte(`<p>Custom {{.Title}}</p>`), 0o644))
+	mailing.SetTemplateDir(dir)
+	defer mailing.SetTemplateDir("")
+
+	data, err := mailing.SampleData(mailing.TemplateNewBook)
+	require.NoError(t, err)
+	content, err := mailing.Render(mailing.TemplateNewBook, mailing.LocaleEN, data)
+	require.NoError(t, err)
+	assert.Equal(t, "<p>Custom Golang Basics</p>", content.HTML)
+	// Текстовая версия не переопределена и берется из встроенных шаблонов
+	assert.Equal(t, "A new book is available!", content.Subject)
+
+	content, err = mailing.Render(mailing.TemplateNewBook, mailing.LocaleRU, data)
+	require.NoError(t, err)
+	assert.NotContains(t, content.HTML, "Custom")
+}
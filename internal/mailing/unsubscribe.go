@@ -0,0 +1,102 @@
+package mailing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"library/internal/models"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+	ErrNoUnsubscribeSecret     = errors.New("UNSUBSCRIBE_SECRET is not set")
+)
+
+// PublicURL адрес приложения, который используется в ссылках из писем
+func PublicURL() string {
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// unsubscribeSecret ключ подписи ссылок отписки. Он отделен от ключей JWT, чтобы смена способа подписи
+// токенов не оставила ссылки без ключа
+func unsubscribeSecret() []byte {
+	return []byte(os.Getenv("UNSUBSCRIBE_SECRET"))
+}
+
+// CheckUnsubscribeSecret проверяет, что ключ подписи ссылок отписки задан. Без него ссылку мог бы подделать кто угодно
+func CheckUnsubscribeSecret() error {
+	if len(unsubscribeSecret()) == 0 {
+		return ErrNoUnsubscribeSecret
+	}
+	return nil
+}
+
+// unsubscribeSignature подписывает id и email получателя. После смены email старые ссылки перестают работать
+func unsubscribeSignature(userID uint, email string) []byte {
+	mac := hmac.New(sha256.New, unsubscribeSecret())
+	fmt.Fprintf(mac, "unsubscribe:%d:%s", userID, strings.ToLower(email))
+	return mac.Sum(nil)
+}
+
+// UnsubscribeToken возвращает подписанный токен отписки получателя. Токен не истекает,
+// чтобы ссылка работала и в старых письмах
+func UnsubscribeToken(user models.User) string {
+	return strconv.FormatUint(uint64(user.ID), 10) + "." +
+		base64.RawURLEncoding.EncodeToString(unsubscribeSignature(user.ID, user.Email))
+}
+
+// UnsubscribeLink возвращает ссылку на страницу отписки получателя
+func UnsubscribeLink(user models.User) string {
+	return PublicURL() + "/unsubscribe?token=" + url.QueryEscape(UnsubscribeToken(user))
+}
+
+// UserByUnsubscribeToken проверяет подпись токена и возвращает получателя
+func UserByUnsubscribeToken(db *gorm.DB, token string) (models.User, error) {
+	var user models.User
+	if CheckUnsubscribeSecret() != nil {
+		return user, ErrInvalidUnsubscribeToken
+	}
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return user, ErrInvalidUnsubscribeToken
+	}
+	userID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return user, ErrInvalidUnsubscribeToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return user, ErrInvalidUnsubscribeToken
+	}
+
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, ErrInvalidUnsubscribeToken
+		}
+		return user, err
+	}
+	if !hmac.Equal(sig, unsubscribeSignature(user.ID, user.Email)) {
+		return user, ErrInvalidUnsubscribeToken
+	}
+	return user, nil
+}
+
+// unsubscribeHeaders заголовки RFC 2369 и RFC 8058, по которым почтовый клиент показывает кнопку отписки
+// и отписывает получателя одним POST запросом без открытия браузера
+func unsubscribeHeaders(user models.User) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + UnsubscribeLink(user) + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
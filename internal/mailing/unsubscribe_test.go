@@ -0,0 +1,59 @@
+package mailing_test
+
+import (
+	"library/internal/database"
+	"library/internal/mailing"
+	"library/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	t.Setenv("UNSUBSCRIBE_SECRET", "test-secret")
+	t.Setenv("PUBLIC_URL", "https://library.example.com/")
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	user := models.User{Name: "Reader", Email: "reader@example.com", Role: "reader", Mailing: true}
+	require.NoError(t, db.Create(&user).Error)
+	other := models.User{Name: "Other", Email: "other@example.com", Role: "reader", Mailing: true}
+	require.NoError(t, db.Create(&other).Error)
+
+	token := mailing.UnsubscribeToken(user)
+	assert.True(t, strings.HasPrefix(mailing.UnsubscribeLink(user), "https://library.example.com/unsubscribe?token="))
+
+	found, err := mailing.UserByUnsubscribeToken(db, token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Подпись одного получателя не подходит для другого
+	_, signature, _ := strings.Cut(token, ".")
+	_, err = mailing.UserByUnsubscribeToken(db, "2."+signature)
+	assert.ErrorIs(t, err, mailing.ErrInvalidUnsubscribeToken)
+
+	for _, invalid := range []string{"", "garbage", "1.", "x." + signature, "999." + signature} {
+		_, err = mailing.UserByUnsubscribeToken(db, invalid)
+		assert.ErrorIs(t, err, mailing.ErrInvalidUnsubscribeToken, invalid)
+	}
+
+	// После смены email старые ссылки перестают работать
+	require.NoError(t, db.Model(&user).Update("email", "new@example.com").Error)
+	_, err = mailing.UserByUnsubscribeToken(db, token)
+	assert.ErrorIs(t, err, mailing.ErrInvalidUnsubscribeToken)
+
+	// Токен, подписанный другим секретом, не принимается
+	otherToken := mailing.UnsubscribeToken(other)
+	t.Setenv("UNSUBSCRIBE_SECRET", "another-secret")
+	_, err = mailing.UserByUnsubscribeToken(db, otherToken)
+	assert.ErrorIs(t, err, mailing.ErrInvalidUnsubscribeToken)
+
+	// Без ключа токены не принимаются, даже подписанные пустым ключом
+	t.Setenv("UNSUBSCRIBE_SECRET", "")
+	assert.ErrorIs(t, mailing.CheckUnsubscribeSecret(), mailing.ErrNoUnsubscribeSecret)
+	_, err = mailing.UserByUnsubscribeToken(db, mailing.UnsubscribeToken(other))
+	assert.ErrorIs(t, err, mailing.ErrInvalidUnsubscribeToken)
+}
@@ -1,13 +1,15 @@
 package middleware
 
 import (
-	"fmt"
+	"errors"
 	"library/internal/auth"
+	"library/internal/rbac"
+	"library/logger"
 	"net/http"
-	"os"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"gorm.io/gorm"
 )
 
@@ -36,55 +38,134 @@ import (
 // 	}
 // }
 
-func RoleMiddleware(db *gorm.DB, allowedRoles ...string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		tokenString, err := c.Cookie("jwt")
+// bearerToken возвращает токен из заголовка Authorization. Принимается только схема Bearer,
+// для остальных схем и заголовка без схемы возвращается пустая строка
+func bearerToken(c *gin.Context) string {
+	header := strings.TrimSpace(c.GetHeader("Authorization"))
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authenticate проверяет API ключ или JWT из заголовка Authorization, а если заголовка нет - JWT из cookie,
+// при необходимости обновляя его по refresh токену.
+// В случае ошибки отправляет ответ 401 и прерывает обработку запроса
+func authenticate(c *gin.Context, db *gorm.DB) (*auth.MyClaims, bool) {
+	if token := bearerToken(c); token != "" {
+		var claims *auth.MyClaims
+		var err error
+		if auth.IsAPIKey(token) {
+			claims, err = auth.AuthenticateAPIKey(db, token)
+		} else {
+			claims, err = auth.ParseJWT(token)
+		}
 		if err != nil {
-			tokenString, err = auth.UpdateJWTToken(c, db)
-			if err != nil {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
-				c.Abort()
-				return
-			}
+			logger.InfoLog.Println("Failed to authenticate by Authorization header\tError:", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return nil, false
 		}
+		if !checkSession(c, db, claims) {
+			return nil, false
+		}
+		auth.SetClaims(c, claims)
+		return claims, true
+	}
 
-		token, _ := jwt.ParseWithClaims(tokenString, &auth.MyClaims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(os.Getenv("jwtSecret")), nil
-		})
-
-		if err != nil || !token.Valid {
-			tokenString, err = auth.UpdateJWTToken(c, db)
-			if err != nil {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-				c.Abort()
-				return
-			}
-			token, _ = jwt.ParseWithClaims(tokenString, &auth.MyClaims{}, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return []byte(os.Getenv("jwtSecret")), nil
-			})
+	tokenString, err := c.Cookie("jwt")
+	if err != nil {
+		tokenString, err = auth.UpdateJWTToken(c, db)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
+			c.Abort()
+			return nil, false
 		}
+	}
 
-		claims, ok := token.Claims.(*auth.MyClaims)
-		if !ok {
+	claims, err := auth.ParseJWT(tokenString)
+	if err != nil {
+		tokenString, err = auth.UpdateJWTToken(c, db)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return nil, false
+		}
+		claims, err = auth.ParseJWT(tokenString)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Claims"})
 			c.Abort()
+			return nil, false
+		}
+	}
+
+	if !checkSession(c, db, claims) {
+		return nil, false
+	}
+	auth.SetClaims(c, claims)
+	return claims, true
+}
+
+// checkSession отклоняет JWT отозванной сессии: сам токен действителен до истечения срока, поэтому без этой
+// проверки отзыв сессии или выход не действовали бы на уже выданные токены. У API ключей и токенов без sid
+// сессии нет. В случае ошибки отправляет ответ и прерывает обработку запроса
+func checkSession(c *gin.Context, db *gorm.DB, claims *auth.MyClaims) bool {
+	if claims.IsAPIKey() || claims.SessionID == 0 {
+		return true
+	}
+	err := auth.CheckSession(db, claims.SessionID)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, auth.ErrSessionRevoked) {
+		logger.InfoLog.Println("Rejected token of revoked session", claims.SessionID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+	} else {
+		logger.ErrorLog.Println("Failed to check session", claims.SessionID, "\tError:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+	}
+	c.Abort()
+	return false
+}
+
+// Authenticated пропускает любого пользователя с действительным JWT
+func Authenticated(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authenticate(c, db); !ok {
 			return
 		}
+		c.Next()
+	}
+}
 
-		for _, allowedRole := range allowedRoles {
-			if claims.Role == allowedRole {
-				c.Next()
-				return
-			}
+// RequirePermission пропускает запрос, только если роль пользователя (или API ключ) имеет указанное разрешение.
+// Разрешения ролей берутся из базы данных и кэшируются в Redis
+func RequirePermission(db *gorm.DB, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := authenticate(c, db)
+		if !ok {
+			return
+		}
+
+		var allowed bool
+		var err error
+		if claims.IsAPIKey() {
+			allowed = slices.Contains(claims.Scopes, permission)
+		} else {
+			allowed, err = rbac.HasPermission(db, claims.Role, permission)
+		}
+		if err != nil {
+			logger.ErrorLog.Println("Failed to check permission", permission, "for role", claims.Role, "\tError:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			c.Abort()
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this resource"})
+			c.Abort()
+			return
 		}
 
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this resource"})
-		c.Abort()
+		c.Next()
 	}
 }
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"library/internal/auth"
+	"library/logger"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSRF защищает от подделки межсайтовых запросов по схеме double-submit cookie: в cookie csrf_token
+// выдается случайный токен, и каждый изменяющий состояние запрос, аутентифицированный cookie,
+// должен повторить его в заголовке X-CSRF-Token или в поле формы csrf_token. Чужой сайт не может
+// прочитать cookie, поэтому не может подставить токен.
+// Запросы с Bearer токеном в заголовке Authorization не проверяются: браузер не добавляет его к запросам сам
+func CSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cookieToken, err := c.Cookie(auth.CSRFCookieName)
+		if err != nil || cookieToken == "" {
+			token, err := auth.GenerateCSRFToken()
+			if err != nil {
+				logger.ErrorLog.Println("Failed to generate CSRF token\tError:", err)
+			} else {
+				auth.SetCSRFCookie(c, token)
+			}
+		}
+		c.Header(auth.CSRFHeaderName, auth.GetCSRFToken(c))
+
+		if isSafeMethod(c.Request.Method) || bearerToken(c) != "" || !hasAuthCookie(c) {
+			c.Next()
+			return
+		}
+
+		requestToken := c.GetHeader(auth.CSRFHeaderName)
+		if requestToken == "" && strings.HasPrefix(c.ContentType(), "application/x-www-form-urlencoded") {
+			requestToken = c.PostForm(auth.CSRFFormField)
+		}
+		if cookieToken == "" || subtle.ConstantTimeCompare([]byte(requestToken), []byte(cookieToken)) != 1 {
+			logger.InfoLog.Println("Rejected request without valid CSRF token:", c.Request.Method, c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// hasAuthCookie проверяет, аутентифицирован ли запрос cookie
+func hasAuthCookie(c *gin.Context) bool {
+	for _, name := range []string{"jwt", "refreshToken"} {
+		if value, err := c.Cookie(name); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
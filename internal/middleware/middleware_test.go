@@ -2,9 +2,13 @@ package middleware_test
 
 import (
 	"fmt"
+	"library/internal/audit"
 	"library/internal/auth"
+	"library/internal/cache"
 	"library/internal/database"
 	"library/internal/middleware"
+	"library/internal/models"
+	"library/internal/rbac"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -61,63 +65,280 @@ import (
 // 	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
 // }
 
-func TestRoleMiddleware(t *testing.T) {
-	expirationTime := time.Now().Add(time.Minute)
+func TestAuthenticated(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
 
 	claims := &auth.MyClaims{
-		Role: "testRole",
+		Role: "reader",
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   fmt.Sprintf("%d", 2),
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
 		},
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(os.Getenv("jwtSecret")))
+	signedToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("jwtSecret")))
 	assert.NoError(t, err)
 
 	router := gin.Default()
-	router.GET("/test", middleware.RoleMiddleware(database.TestDB, "testRole"), func(c *gin.Context) {
+	router.GET("/test", middleware.Authenticated(database.TestDB), func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "Success"})
 	})
 
-	req, err := http.NewRequest(http.MethodGet, "/test", nil)
+	request := func(cookie string) int {
+		req, err := http.NewRequest(http.MethodGet, "/test", nil)
+		assert.NoError(t, err)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: cookie})
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Любая роль с действительным токеном проходит, без токена или с испорченным токеном – нет
+	assert.Equal(t, http.StatusOK, request(signedToken))
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	assert.Equal(t, http.StatusUnauthorized, request("invalid.toke.value"))
+}
+
+func TestRequirePermission(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	assert.NoError(t, rbac.SeedRoles(database.TestDB))
+
+	signedToken := func(role string) string {
+		claims := &auth.MyClaims{
+			Role: role,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   fmt.Sprintf("%d", 2),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("jwtSecret")))
+		assert.NoError(t, err)
+		return token
+	}
+
+	router := gin.Default()
+	router.GET("/books", middleware.RequirePermission(database.TestDB, rbac.PermBookWrite), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+	router.GET("/users", middleware.RequirePermission(database.TestDB, rbac.PermUserManage), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+
+	cases := []struct {
+		path string
+		role string
+		code int
+	}{
+		{"/books", "admin", http.StatusOK},
+		{"/users", "admin", http.StatusOK},
+		{"/books", "librarian", http.StatusOK},
+		{"/users", "librarian", http.StatusForbidden},
+		{"/books", "reader", http.StatusForbidden},
+		{"/books", "unknown", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "jwt", Value: signedToken(tc.role)})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, tc.code, recorder.Code, "role %s on %s", tc.role, tc.path)
+	}
+
+	_, err := rbac.SetRolePermissions(database.TestDB, "reader", []string{rbac.PermBookRead, rbac.PermBookWrite})
 	assert.NoError(t, err)
-	req.Header.Set("Authorization", signedToken)
+	cache.DeleteRolePermissions("reader")
+	req, err := http.NewRequest(http.MethodGet, "/books", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: signedToken("reader")})
 	recorder := httptest.NewRecorder()
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	claims = &auth.MyClaims{
-		Role: "Role",
+	_, err = rbac.SetRolePermissions(database.TestDB, "reader", []string{"book:fly"})
+	assert.ErrorIs(t, err, rbac.ErrUnknownPermission)
+}
+
+func TestRequirePermissionBearerAndAPIKey(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+	assert.NoError(t, rbac.SeedRoles(db))
+
+	key, err := auth.GenerateAPIKey()
+	assert.NoError(t, err)
+	apiKey := models.APIKey{Name: "script", Prefix: key[:12], KeyHash: auth.HashToken(key), Scopes: rbac.PermBookRead}
+	assert.NoError(t, db.Create(&apiKey).Error)
+
+	router := gin.Default()
+	router.GET("/read", middleware.RequirePermission(db, rbac.PermBookRead), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+	router.GET("/write", middleware.RequirePermission(db, rbac.PermBookWrite), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+
+	request := func(path, authorization string) int {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/read", "Bearer "+key))
+	assert.Equal(t, http.StatusForbidden, request("/write", "Bearer "+key))
+	assert.Equal(t, http.StatusUnauthorized, request("/read", "Bearer "+auth.APIKeyPrefix+"unknown"))
+
+	var used models.APIKey
+	assert.NoError(t, db.First(&used, apiKey.ID).Error)
+	assert.NotNil(t, used.LastUsedAt)
+
+	assert.NoError(t, db.Model(&apiKey).Update("revoked_at", time.Now()).Error)
+	assert.Equal(t, http.StatusUnauthorized, request("/read", "Bearer "+key))
+
+	claims := &auth.MyClaims{
+		Role: "librarian",
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   fmt.Sprintf("%d", 2),
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
 		},
 	}
-	token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err = token.SignedString([]byte(os.Getenv("jwtSecret")))
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("jwtSecret")))
 	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request("/write", "Bearer "+token))
+	// Токен без схемы Bearer не принимается
+	assert.Equal(t, http.StatusUnauthorized, request("/write", token))
+}
 
-	req, err = http.NewRequest(http.MethodGet, "/test", nil)
-	assert.NoError(t, err)
-	req.Header.Set("Authorization", signedToken)
-	recorder = httptest.NewRecorder()
-	router.ServeHTTP(recorder, req)
-	assert.Equal(t, http.StatusForbidden, recorder.Code)
+func TestCSRF(t *testing.T) {
+	router := gin.New()
+	router.Use(middleware.CSRF())
+	router.GET("/test", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+	router.POST("/test", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
 
-	req, err = http.NewRequest(http.MethodGet, "/test", nil)
-	assert.NoError(t, err)
-	recorder = httptest.NewRecorder()
-	router.ServeHTTP(recorder, req)
-	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	// GET выдает CSRF токен в cookie
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var csrfCookie *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == auth.CSRFCookieName {
+			csrfCookie = cookie
+		}
+	}
+	if !assert.NotNil(t, csrfCookie) {
+		return
+	}
+	assert.False(t, csrfCookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, csrfCookie.SameSite)
+
+	post := func(header string, withAuthCookie bool, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/test", nil)
+		req.AddCookie(csrfCookie)
+		if withAuthCookie {
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: "token"})
+		}
+		if header != "" {
+			req.Header.Set(auth.CSRFHeaderName, header)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Запрос с cookie аутентификации без токена или с чужим токеном отклоняется
+	assert.Equal(t, http.StatusForbidden, post("", true, ""))
+	assert.Equal(t, http.StatusForbidden, post("forged", true, ""))
+	assert.Equal(t, http.StatusOK, post(csrfCookie.Value, true, ""))
+
+	// Запросы без cookie аутентификации и с заголовком Authorization не проверяются
+	assert.Equal(t, http.StatusOK, post("", false, ""))
+	assert.Equal(t, http.StatusOK, post("", true, "Bearer token"))
+	// Другие схемы не заменяют cookie, поэтому такой запрос проверяется
+	assert.Equal(t, http.StatusForbidden, post("", true, "Basic dXNlcjpwYXNz"))
+}
+
+func TestRequestID(t *testing.T) {
+	router := gin.New()
+	router.Use(middleware.RequestID())
+	router.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, audit.GetRequestID(c))
+	})
 
-	invalidToken := "invalid.toke.value"
-	req, err = http.NewRequest(http.MethodGet, "/test", nil)
+	get := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		if requestID != "" {
+			req.Header.Set(audit.RequestIDHeader, requestID)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Идентификатор от прокси сохраняется
+	recorder := get("edge-42")
+	assert.Equal(t, "edge-42", recorder.Body.String())
+	assert.Equal(t, "edge-42", recorder.Header().Get(audit.RequestIDHeader))
+
+	// Без заголовка или с недопустимым значением создается новый идентификатор
+	for _, requestID := range []string{"", "bad id\r\nX-Injected: 1"} {
+		recorder = get(requestID)
+		assert.Len(t, recorder.Body.String(), 36)
+		assert.Equal(t, recorder.Body.String(), recorder.Header().Get(audit.RequestIDHeader))
+	}
+}
+
+func TestRevokedSession(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+	assert.NoError(t, rbac.SeedRoles(db))
+
+	user := models.User{Name: "Reader", Email: "reader@example.com", Role: "reader"}
+	assert.NoError(t, db.Create(&user).Error)
+	session := models.Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	assert.NoError(t, db.Create(&session).Error)
+	claims := &auth.MyClaims{
+		Role:      user.Role,
+		SessionID: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   fmt.Sprint(user.ID),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("jwtSecret")))
 	assert.NoError(t, err)
-	req.Header.Set("Authorization", invalidToken)
 
-	recorder = httptest.NewRecorder()
-	router.ServeHTTP(recorder, req)
-	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	router := gin.Default()
+	router.GET("/read", middleware.RequirePermission(db, rbac.PermBookRead), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Success"})
+	})
+	request := func() int {
+		req, err := http.NewRequest(http.MethodGet, "/read", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request())
+
+	// Статус сессии закэширован, поэтому отзыв действует после сброса кэша
+	assert.NoError(t, auth.RevokeSession(db, session.ID))
+	assert.Equal(t, http.StatusOK, request())
+	auth.ForgetSessionStatus(session.ID)
+	assert.Equal(t, http.StatusUnauthorized, request())
 }
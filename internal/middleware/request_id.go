@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"library/internal/audit"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// validRequestID идентификатор от клиента или прокси принимается, только если он короткий и без управляющих символов
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// RequestID присваивает запросу идентификатор: берет его из заголовка X-Request-ID или создает новый.
+// Идентификатор возвращается в том же заголовке ответа и попадает в журнал аудита
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(audit.RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		audit.SetRequestID(c, id)
+		c.Header(audit.RequestIDHeader, id)
+		c.Next()
+	}
+}
@@ -23,16 +23,224 @@ type Genre struct {
 }
 
 type User struct {
+	gorm.Model       `swaggerignore:"true"`
+	Name             string     `gorm:"size:100" json:"name" binding:"required"`
+	Email            string     `gorm:"unique; not null" json:"email" binding:"required,email"`
+	Role             string     `gorm:"not null" json:"role"`
+	Mailing          bool       `gorm:"not null" json:"mailing" binding:"required"`
+	Password         string     `json:"-"`
+	TOTPSecret       string     `json:"-"` // Пока TOTPEnabled false, секрет ожидает подтверждения первым кодом
+	TOTPEnabled      bool       `gorm:"not null; default:false" json:"-"`
+	MailingFrequency string     `gorm:"size:16; not null; default:immediate" json:"mailing_frequency"` // immediate, daily или weekly
+	LastDigestSentAt *time.Time `json:"-"`
+	Locale           string     `gorm:"size:8; not null; default:ru" json:"locale"` // язык писем: ru или en
+}
+
+// Частота писем о новых книгах
+const (
+	MailingImmediate = "immediate"
+	MailingDaily     = "daily"
+	MailingWeekly    = "weekly"
+)
+
+// DigestItem книга, ожидающая отправки пользователю в ежедневном или еженедельном дайджесте
+type DigestItem struct {
+	gorm.Model `swaggerignore:"true"`
+	UserID     uint `gorm:"uniqueIndex:idx_digest_item; not null"`
+	BookID     uint `gorm:"uniqueIndex:idx_digest_item; not null"`
+	SentAt     *time.Time
+}
+
+// Статусы письма в очереди отправки
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// OutboxEmail письмо в очереди отправки. Пока письмо не отправлено, воркер повторяет попытки с растущей паузой,
+// а после исчерпания попыток письмо переходит в статус dead и ждет ручного повтора
+type OutboxEmail struct {
+	gorm.Model    `swaggerignore:"true"`
+	UserID        uint      `gorm:"index"` // 0 для писем не пользователям
+	Recipient     string    `gorm:"not null"`
+	Subject       string    `gorm:"not null"`
+	HTMLBody      string    `gorm:"type:text; not null"`
+	TextBody      string    `gorm:"type:text"`
+	Headers       string    `gorm:"type:text"` // JSON объект дополнительных заголовков
+	Status        string    `gorm:"size:16; index:idx_outbox_due; not null; default:pending"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_due"`
+	Attempts      int       `gorm:"not null; default:0"`
+	LastError     string
+	SentAt        *time.Time
+}
+
+// Статусы события в outbox
+const (
+	EventPending = "pending"
+	EventSent    = "sent"
+)
+
+// OutboxEvent событие, сохраненное в одной транзакции с изменением, которое его вызвало.
+// Relay публикует события в порядке id и помечает отправленными, поэтому событие не теряется, если Kafka недоступна
+type OutboxEvent struct {
+	ID            uint      `gorm:"primarykey"`
+	EventID       string    `gorm:"size:36; uniqueIndex; not null"`
+	Type          string    `gorm:"size:64; not null"`
+	Version       int       `gorm:"not null"`
+	Key           string    `gorm:"size:64; not null"`
+	Actor         string    `gorm:"size:64"`
+	Payload       string    `gorm:"type:text; not null"`
+	OccurredAt    time.Time `gorm:"not null"`
+	Status        string    `gorm:"size:16; index:idx_event_outbox_due; not null; default:pending"`
+	NextAttemptAt time.Time `gorm:"index:idx_event_outbox_due"`
+	Attempts      int       `gorm:"not null; default:0"`
+	LastError     string
+	SentAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// Webhook подписка внешней системы на события каталога. После серии неудачных доставок подряд вебхук
+// отключается (Active = false) и не получает событий, пока администратор не включит его снова
+type Webhook struct {
+	gorm.Model          `swaggerignore:"true"`
+	URL                 string `gorm:"not null"`
+	EventTypes          string `gorm:"not null"` // типы событий через запятую
+	Secret              string `gorm:"not null"`
+	Active              bool   `gorm:"not null; default:true"`
+	ConsecutiveFailures int    `gorm:"not null; default:0"`
+	DisabledAt          *time.Time
+	CreatedByID         uint
+}
+
+// Статусы доставки вебхука
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery доставка одного события одному вебхуку и результат последней попытки
+type WebhookDelivery struct {
+	ID             uint      `gorm:"primarykey"`
+	WebhookID      uint      `gorm:"uniqueIndex:idx_webhook_delivery_event; not null"`
+	EventID        string    `gorm:"size:36; uniqueIndex:idx_webhook_delivery_event; not null"`
+	EventType      string    `gorm:"size:64; not null"`
+	Payload        string    `gorm:"type:text; not null"`
+	Status         string    `gorm:"size:16; index:idx_webhook_delivery_due; not null; default:pending"`
+	NextAttemptAt  time.Time `gorm:"index:idx_webhook_delivery_due"`
+	Attempts       int       `gorm:"not null; default:0"`
+	LastStatusCode int
+	LastError      string
+	DeliveredAt    *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// WebhookDeliveryAttempt одна попытка доставки события вебхуку
+type WebhookDeliveryAttempt struct {
+	ID              uint      `gorm:"primarykey"`
+	DeliveryID      uint      `gorm:"index; not null"`
+	AttemptedAt     time.Time `gorm:"not null"`
+	StatusCode      int       // 0, если ответ не получен
+	LatencyMs       int64     `gorm:"not null"`
+	ResponseExcerpt string    `gorm:"type:text"` // начало тела ответа
+	Error           string
+}
+
+// AuditLog запись журнала аудита: кто, когда и откуда изменил сущность. Записи только добавляются,
+// в Postgres изменение и удаление записей запрещены триггером
+type AuditLog struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time `gorm:"index; not null" json:"created_at"`
+	Actor      string    `gorm:"size:64; index" json:"actor"`     // "user:<id>", "apikey:<id>" или пусто для анонимных запросов
+	Action     string    `gorm:"size:64; not null" json:"action"` // например book.delete
+	EntityType string    `gorm:"size:32; index:idx_audit_entity; not null" json:"entity_type"`
+	EntityID   string    `gorm:"size:64; index:idx_audit_entity" json:"entity_id"`
+	Before     string    `gorm:"type:text" json:"-"` // измененные поля до изменения в JSON
+	After      string    `gorm:"type:text" json:"-"` // измененные поля после изменения в JSON
+	IP         string    `gorm:"size:45" json:"ip"`
+	RequestID  string    `gorm:"size:64" json:"request_id"`
+}
+
+// GenreSubscription подписка пользователя на новые книги жанра
+type GenreSubscription struct {
+	gorm.Model `swaggerignore:"true"`
+	UserID     uint `gorm:"uniqueIndex:idx_genre_subscription; not null"`
+	GenreID    uint `gorm:"uniqueIndex:idx_genre_subscription; not null"`
+	Genre      Genre
+}
+
+// AuthorSubscription подписка пользователя на новые книги автора. Author хранится в нижнем регистре
+type AuthorSubscription struct {
+	gorm.Model `swaggerignore:"true"`
+	UserID     uint   `gorm:"uniqueIndex:idx_author_subscription; not null"`
+	Author     string `gorm:"uniqueIndex:idx_author_subscription; not null"`
+}
+
+// RecoveryCode хэш одноразового кода восстановления для входа без приложения-аутентификатора
+type RecoveryCode struct {
 	gorm.Model `swaggerignore:"true"`
-	Name       string `gorm:"size:100" json:"name" binding:"required"`
-	Email      string `gorm:"unique; not null" json:"email" binding:"required,email"`
-	Role       string `gorm:"not null" json:"role"`
-	Mailing    bool   `gorm:"not null" json:"mailing" binding:"required"`
-	Password   string `json:"-"`
-
-	// Поля сессии
-	RefreshToken string    `gorm:"not null" json:"refresh_token"`
-	ExpiresAt    time.Time `json:"expires_at"`
+	UserID     uint   `gorm:"index; not null"`
+	CodeHash   string `gorm:"size:64; not null"`
+	UsedAt     *time.Time
+}
+
+// ExternalIdentity связь пользователя с аккаунтом во внешнем провайдере OpenID Connect
+type ExternalIdentity struct {
+	gorm.Model `swaggerignore:"true"`
+	UserID     uint   `gorm:"index; not null"`
+	Issuer     string `gorm:"uniqueIndex:idx_external_identity; not null"`
+	Subject    string `gorm:"uniqueIndex:idx_external_identity; not null"`
+}
+
+// Session сессия пользователя на отдельном устройстве. Все refresh токены сессии образуют одно семейство
+type Session struct {
+	gorm.Model  `swaggerignore:"true"`
+	UserID      uint   `gorm:"index; not null"`
+	DeviceLabel string `gorm:"size:100"`
+	IP          string `gorm:"size:45"`
+	UserAgent   string `gorm:"size:255"`
+	LastUsedAt  time.Time
+	ExpiresAt   time.Time
+	RevokedAt   *time.Time
+}
+
+// RefreshToken хэш выданного refresh токена. После ротации токен помечается использованным,
+// и его повторное предъявление отзывает всю сессию
+type RefreshToken struct {
+	gorm.Model `swaggerignore:"true"`
+	SessionID  uint   `gorm:"index; not null"`
+	TokenHash  string `gorm:"uniqueIndex; size:64; not null"`
+	RotatedAt  *time.Time
+}
+
+// Role роль пользователя с набором разрешений
+type Role struct {
+	gorm.Model  `swaggerignore:"true"`
+	Name        string       `gorm:"unique; not null" json:"name"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions"`
+}
+
+// Permission именованное разрешение, например "book:write"
+type Permission struct {
+	gorm.Model  `swaggerignore:"true"`
+	Name        string `gorm:"unique; not null" json:"name"`
+	Description string `json:"description"`
+}
+
+// APIKey долгоживущий ключ для скриптов и интеграций. Хранится только хэш ключа,
+// а Scopes содержит разрешения через запятую
+type APIKey struct {
+	gorm.Model  `swaggerignore:"true"`
+	Name        string `gorm:"size:100; not null"`
+	Prefix      string `gorm:"size:16; not null"`
+	KeyHash     string `gorm:"uniqueIndex; size:64; not null"`
+	Scopes      string `gorm:"not null"`
+	CreatedByID uint
+	LastUsedAt  *time.Time
+	ExpiresAt   *time.Time
+	RevokedAt   *time.Time
 }
 
 type GenreFroGetBooks struct {
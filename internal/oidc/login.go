@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"library/internal/audit"
+	"library/internal/cache"
+	"library/internal/events"
+	"library/internal/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// loginStateTTL время, за которое пользователь должен вернуться от провайдера
+const loginStateTTL = 10 * time.Minute
+
+var (
+	ErrInvalidState  = errors.New("invalid or expired OIDC state")
+	ErrEmailConflict = errors.New("email is already used by another account")
+)
+
+// loginState данные, сохраняемые между перенаправлением к провайдеру и callback
+type loginState struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	Device       string `json:"device"`
+}
+
+func stateKey(state string) string { return "oidc_state:" + state }
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// codeChallenge возвращает PKCE code_challenge для метода S256 (RFC 7636)
+func codeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// StartLogin сохраняет state, nonce и PKCE verifier и возвращает адрес страницы входа провайдера
+func (p *Provider) StartLogin(device string) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(loginState{Nonce: nonce, CodeVerifier: verifier, Device: device})
+	if err != nil {
+		return "", err
+	}
+	if err := cache.SetWithTTL(stateKey(state), string(data), loginStateTTL); err != nil {
+		return "", err
+	}
+	return p.AuthCodeURL(state, nonce, codeChallenge(verifier)), nil
+}
+
+// FinishLogin проверяет state, обменивает code на ID токен и возвращает проверенные claims и устройство входа.
+// State одноразовый и удаляется при первом же использовании
+func (p *Provider) FinishLogin(ctx context.Context, code, state string) (*Claims, string, error) {
+	data, ok, err := cache.GetString(stateKey(state))
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok || state == "" {
+		return nil, "", ErrInvalidState
+	}
+	if err := cache.Delete(stateKey(state)); err != nil {
+		return nil, "", err
+	}
+
+	var saved loginState
+	if err := json.Unmarshal([]byte(data), &saved); err != nil {
+		return nil, "", ErrInvalidState
+	}
+
+	idToken, err := p.Exchange(ctx, code, saved.CodeVerifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := p.VerifyIDToken(ctx, idToken, saved.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, saved.Device, nil
+}
+
+// LinkUser находит пользователя по внешнему subject или создает его. Существующий аккаунт с тем же email
+// привязывается только если провайдер подтвердил email, иначе владелец чужого email смог бы войти в аккаунт.
+// Если в провайдере настроено сопоставление ролей, роль пользователя обновляется при каждом входе.
+// Создание пользователя, привязка и смена роли записываются в журнал аудита, а события о них – в outbox
+// в той же транзакции
+func (p *Provider) LinkUser(db *gorm.DB, claims *Claims, meta audit.Meta) (models.User, error) {
+	var user models.User
+	role, syncRole := p.MapRole(claims)
+
+	updateRole := func(tx *gorm.DB) error {
+		if !syncRole || user.Role == role {
+			return nil
+		}
+		before := audit.NewUserSnapshot(user)
+		if err := tx.Model(&user).Update("role", role).Error; err != nil {
+			return err
+		}
+		payload := events.UserRoleChangedPayload{UserID: user.ID, Role: user.Role, PreviousRole: before.Role}
+		if err := events.Enqueue(tx, events.UserRoleChanged, meta.Actor, user.ID, payload); err != nil {
+			return err
+		}
+		return audit.Record(tx, meta, "user.sync_role", user.ID, before, audit.NewUserSnapshot(user))
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var identity models.ExternalIdentity
+		err := tx.Where("issuer = ? AND subject = ?", claims.Issuer, claims.Subject).First(&identity).Error
+		if err == nil {
+			if err := tx.First(&user, identity.UserID).Error; err != nil {
+				return err
+			}
+			return updateRole(tx)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := strings.ToLower(strings.TrimSpace(claims.Email))
+		err = tx.Where("LOWER(email) = ?", email).First(&user).Error
+		switch {
+		case err == nil && email != "":
+			if !claims.EmailVerified {
+				return ErrEmailConflict
+			}
+			if err := updateRole(tx); err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound) || email == "":
+			name := claims.Name
+			if name == "" {
+				name = email
+			}
+			if email == "" {
+				// email обязателен и уникален, поэтому без него используется служебный адрес
+				email = claims.Subject + "@" + hostOf(claims.Issuer)
+			}
+			// Пароль пустой: хэш любого пароля с ним не совпадет, поэтому вход возможен только через провайдера
+			user = models.User{Name: name, Email: email, Role: role}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if err := events.Enqueue(tx, events.UserRegistered, meta.Actor, user.ID, events.NewUserRegisteredPayload(user)); err != nil {
+				return err
+			}
+			if err := audit.Record(tx, meta, "user.register", user.ID, nil, audit.NewUserSnapshot(user)); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		identity = models.ExternalIdentity{UserID: user.ID, Issuer: claims.Issuer, Subject: claims.Subject}
+		if err := tx.Create(&identity).Error; err != nil {
+			return err
+		}
+		return audit.Record(tx, meta, "user.link_identity", user.ID, nil, map[string]string{"issuer": identity.Issuer, "subject": identity.Subject})
+	})
+	return user, err
+}
+
+func hostOf(issuer string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(issuer, "https://"), "http://")
+	if i := strings.IndexAny(host, "/:"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// ParseRoleMapping разбирает сопоставление ролей вида "library-admins=admin,library-staff=librarian"
+func ParseRoleMapping(value string) ([]RoleMapping, error) {
+	var mappings []RoleMapping
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		claimValue, role, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(claimValue) == "" || strings.TrimSpace(role) == "" {
+			return nil, errors.New("invalid role mapping " + pair + ", expected value=role")
+		}
+		mappings = append(mappings, RoleMapping{Value: strings.TrimSpace(claimValue), Role: strings.TrimSpace(role)})
+	}
+	return mappings, nil
+}
@@ -0,0 +1,283 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"library/internal/audit"
+	"library/internal/database"
+	"library/internal/events"
+	"library/internal/models"
+	"library/internal/oidc"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClientID     = "library"
+	testClientSecret = "secret"
+	testRedirectURL  = "http://localhost:8080/oidc/callback"
+)
+
+// stubProvider минимальный провайдер OpenID Connect для тестов
+type stubProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+	// claims добавляются в следующий выданный ID токен
+	claims jwt.MapClaims
+	// audience ID токена, по умолчанию testClientID
+	audience string
+	codes    map[string]authorization
+}
+
+type authorization struct {
+	nonce     string
+	challenge string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	stub := &stubProvider{key: key, codes: map[string]authorization{}, audience: testClientID}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.server.URL,
+			"authorization_endpoint": stub.server.URL + "/authorize",
+			"token_endpoint":         stub.server.URL + "/token",
+			"jwks_uri":               stub.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", stub.authorize)
+	mux.HandleFunc("/token", stub.token)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+// authorize сразу "аутентифицирует" пользователя и возвращает code на redirect_uri
+func (s *stubProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString([]byte(query.Get("state")))
+
+	s.mu.Lock()
+	s.codes[code] = authorization{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	s.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *stubProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || clientSecret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	auth, found := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	claims := jwt.MapClaims{}
+	for name, value := range s.claims {
+		claims[name] = value
+	}
+	audience := s.audience
+	s.mu.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != auth.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims["iss"] = s.server.URL
+	claims["aud"] = audience
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["nonce"] = auth.nonce
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "stub-key"
+	idToken, _ := token.SignedString(s.key)
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+}
+
+func (s *stubProvider) setClaims(claims jwt.MapClaims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.claims = claims
+}
+
+func newTestProvider(t *testing.T, stub *stubProvider) *oidc.Provider {
+	provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:       stub.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		RoleClaim:    "groups",
+		RoleMapping:  []oidc.RoleMapping{{Value: "library-admins", Role: "admin"}, {Value: "library-staff", Role: "librarian"}},
+		DefaultRole:  "reader",
+	}, stub.server.Client())
+	require.NoError(t, err)
+	return provider
+}
+
+// login проходит вход у провайдера и возвращает code и state, пришедшие на redirect_uri
+func login(t *testing.T, provider *oidc.Provider, stub *stubProvider) (string, string) {
+	authURL, err := provider.StartLogin("laptop")
+	require.NoError(t, err)
+
+	client := stub.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	stub := newStubProvider(t)
+	provider := newTestProvider(t, stub)
+
+	stub.setClaims(jwt.MapClaims{"sub": "user-1", "email": "Reader@Example.com", "email_verified": true, "name": "Reader", "groups": []string{"library-staff"}})
+	code, state := login(t, provider, stub)
+	claims, device, err := provider.FinishLogin(context.Background(), code, state)
+	require.NoError(t, err)
+	assert.Equal(t, "laptop", device)
+	assert.Equal(t, "user-1", claims.Subject)
+
+	user, err := provider.LinkUser(db, claims, audit.Meta{IP: "10.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, "librarian", user.Role)
+	assert.Equal(t, "reader@example.com", user.Email)
+
+	// State одноразовый
+	_, _, err = provider.FinishLogin(context.Background(), code, state)
+	assert.ErrorIs(t, err, oidc.ErrInvalidState)
+
+	// Повторный вход находит того же пользователя и обновляет роль по группам
+	stub.setClaims(jwt.MapClaims{"sub": "user-1", "email": "reader@example.com", "groups": []string{"library-admins", "library-staff"}})
+	code, state = login(t, provider, stub)
+	claims, _, err = provider.FinishLogin(context.Background(), code, state)
+	require.NoError(t, err)
+	again, err := provider.LinkUser(db, claims, audit.Meta{IP: "10.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, again.ID)
+	assert.Equal(t, "admin", again.Role)
+
+	var identities int64
+	db.Model(&models.ExternalIdentity{}).Count(&identities)
+	assert.Equal(t, int64(1), identities)
+
+	// Создание, привязка и смена роли записаны в журнал аудита
+	var actions []string
+	require.NoError(t, db.Model(&models.AuditLog{}).Where("entity_id = ?", strconv.FormatUint(uint64(user.ID), 10)).Order("id").Pluck("action", &actions).Error)
+	assert.Equal(t, []string{"user.register", "user.link_identity", "user.sync_role"}, actions)
+
+	// События о регистрации и смене роли сохранены в outbox
+	var types []string
+	require.NoError(t, db.Model(&models.OutboxEvent{}).Order("id").Pluck("type", &types).Error)
+	assert.Equal(t, []string{events.UserRegistered, events.UserRoleChanged}, types)
+}
+
+func TestOIDCLinkExistingEmail(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	stub := newStubProvider(t)
+	provider := newTestProvider(t, stub)
+
+	existing := models.User{Name: "Existing", Email: "existing@example.com", Role: "reader", Password: "hash"}
+	require.NoError(t, db.Create(&existing).Error)
+
+	// Неподтвержденный email не привязывается к существующему аккаунту
+	stub.setClaims(jwt.MapClaims{"sub": "user-2", "email": "existing@example.com", "email_verified": false})
+	code, state := login(t, provider, stub)
+	claims, _, err := provider.FinishLogin(context.Background(), code, state)
+	require.NoError(t, err)
+	_, err = provider.LinkUser(db, claims, audit.Meta{IP: "10.0.0.1"})
+	assert.ErrorIs(t, err, oidc.ErrEmailConflict)
+
+	stub.setClaims(jwt.MapClaims{"sub": "user-2", "email": "existing@example.com", "email_verified": true})
+	code, state = login(t, provider, stub)
+	claims, _, err = provider.FinishLogin(context.Background(), code, state)
+	require.NoError(t, err)
+	user, err := provider.LinkUser(db, claims, audit.Meta{IP: "10.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, existing.ID, user.ID)
+	assert.Equal(t, "reader", user.Role)
+
+	var actions []string
+	require.NoError(t, db.Model(&models.AuditLog{}).Order("id").Pluck("action", &actions).Error)
+	assert.Equal(t, []string{"user.link_identity"}, actions)
+}
+
+func TestOIDCRejectsInvalidIDToken(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := newTestProvider(t, stub)
+
+	// ID токен, выданный другому клиенту
+	stub.audience = "another-client"
+	stub.setClaims(jwt.MapClaims{"sub": "user-3"})
+	code, state := login(t, provider, stub)
+	_, _, err := provider.FinishLogin(context.Background(), code, state)
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+
+	// Code без правильного PKCE verifier не обменивается на токены
+	stub.audience = testClientID
+	code, _ = login(t, provider, stub)
+	_, err = provider.Exchange(context.Background(), code, "wrong-verifier")
+	assert.Error(t, err)
+}
+
+func TestParseRoleMapping(t *testing.T) {
+	mappings, err := oidc.ParseRoleMapping("library-admins=admin, library-staff=librarian")
+	require.NoError(t, err)
+	assert.Equal(t, []oidc.RoleMapping{{Value: "library-admins", Role: "admin"}, {Value: "library-staff", Role: "librarian"}}, mappings)
+
+	_, err = oidc.ParseRoleMapping("library-admins")
+	assert.Error(t, err)
+}
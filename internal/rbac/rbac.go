@@ -0,0 +1,168 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Разрешения, которые проверяются в middleware.RequirePermission
+const (
+	PermBookRead         = "book:read"
+	PermBookWrite        = "book:write"
+	PermMailingSubscribe = "mailing:subscribe"
+	PermMailingSend      = "mailing:send"
+	PermUserManage       = "user:manage"
+	PermAPIKeyManage     = "apikey:manage"
+	PermWebhookManage    = "webhook:manage"
+	PermAuditRead        = "audit:read"
+)
+
+// permissionsCacheTTL время жизни закэшированных разрешений роли
+const permissionsCacheTTL = 10 * time.Minute
+
+var ErrUnknownPermission = errors.New("unknown permission")
+
+// Permissions описания всех известных разрешений
+var Permissions = map[string]string{
+	PermBookRead:         "View detailed information about books",
+	PermBookWrite:        "Add, modify and delete books",
+	PermMailingSubscribe: "Subscribe to and unsubscribe from the mailing list",
+	PermMailingSend:      "Send emails to subscribers",
+	PermUserManage:       "Manage users, roles and their permissions",
+	PermAPIKeyManage:     "Create, list and revoke API keys",
+	PermWebhookManage:    "Manage webhook subscriptions and view their deliveries",
+	PermAuditRead:        "View and export the audit log",
+}
+
+// DefaultRoles роли, которые создаются при первом запуске
+var DefaultRoles = map[string][]string{
+	"admin":     {PermBookRead, PermBookWrite, PermMailingSubscribe, PermMailingSend, PermUserManage, PermAPIKeyManage, PermWebhookManage, PermAuditRead},
+	"librarian": {PermBookRead, PermBookWrite, PermMailingSubscribe},
+	"reader":    {PermBookRead, PermMailingSubscribe},
+}
+
+// SeedRoles создает недостающие разрешения и роли по умолчанию.
+// Уже существующие роли не пересоздаются, чтобы не затирать правки администратора,
+// но впервые появившиеся разрешения добавляются в те роли по умолчанию, которым они положены
+func SeedRoles(db *gorm.DB) error {
+	created := map[string]models.Permission{}
+	for name, description := range Permissions {
+		permission := models.Permission{Name: name}
+		result := db.Where(models.Permission{Name: name}).Attrs(models.Permission{Description: description}).FirstOrCreate(&permission)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			created[name] = permission
+		}
+	}
+
+	for name, permissions := range DefaultRoles {
+		var role models.Role
+		err := db.Where("name = ?", name).First(&role).Error
+		if err == nil {
+			for _, permissionName := range permissions {
+				permission, ok := created[permissionName]
+				if !ok {
+					continue
+				}
+				if err := db.Model(&role).Association("Permissions").Append(&permission); err != nil {
+					return err
+				}
+				cache.DeleteRolePermissions(name)
+				logger.InfoLog.Println("New permission", permissionName, "granted to role", name)
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if _, err := SetRolePermissions(db, name, permissions); err != nil {
+			return err
+		}
+		cache.DeleteRolePermissions(name)
+		logger.InfoLog.Println("Role", name, "created with permissions", permissions)
+	}
+	return nil
+}
+
+// SetRolePermissions заменяет набор разрешений роли, создавая роль при необходимости. Кэш разрешений роли
+// вызывающий сбрасывает через cache.DeleteRolePermissions после фиксации транзакции, иначе параллельный запрос
+// успеет снова закэшировать старые разрешения
+func SetRolePermissions(db *gorm.DB, roleName string, permissionNames []string) (models.Role, error) {
+	var role models.Role
+
+	var permissions []models.Permission
+	if len(permissionNames) > 0 {
+		if err := db.Where("name IN ?", permissionNames).Find(&permissions).Error; err != nil {
+			return role, err
+		}
+	}
+	for _, name := range permissionNames {
+		found := false
+		for _, permission := range permissions {
+			if permission.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return role, fmt.Errorf("%w: %s", ErrUnknownPermission, name)
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(models.Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+		return tx.Model(&role).Association("Permissions").Replace(permissions)
+	})
+	if err != nil {
+		return role, err
+	}
+	role.Permissions = permissions
+	return role, nil
+}
+
+// RolePermissions возвращает названия разрешений роли, сначала пытаясь взять их из кэша
+func RolePermissions(db *gorm.DB, roleName string) ([]string, error) {
+	if permissions, ok := cache.GetRolePermissions(roleName); ok {
+		return permissions, nil
+	}
+
+	var role models.Role
+	if err := db.Preload("Permissions").Where("name = ?", roleName).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			cache.SetRolePermissions(roleName, []string{}, permissionsCacheTTL)
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	permissions := make([]string, 0, len(role.Permissions))
+	for _, permission := range role.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+	cache.SetRolePermissions(roleName, permissions, permissionsCacheTTL)
+	return permissions, nil
+}
+
+// HasPermission проверяет, есть ли у роли указанное разрешение
+func HasPermission(db *gorm.DB, roleName, permission string) (bool, error) {
+	permissions, err := RolePermissions(db, roleName)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range permissions {
+		if p == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
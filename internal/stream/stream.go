@@ -0,0 +1,188 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"library/internal/events"
+	"slices"
+	"sync"
+)
+
+// Типы событий потока каталога
+const (
+	EventAdded   = "added"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// EventReset клиент пропустил события, которых уже нет в буфере, и должен заново загрузить каталог
+	EventReset = "reset"
+)
+
+// subscriptionBuffer сколько событий ждут отправки клиенту. Клиент, который не успевает их читать, отключается
+// и продолжает с Last-Event-ID после переподключения
+const subscriptionBuffer = 64
+
+// Event событие потока каталога. ID совпадает с id события в шине событий. Буфер хранит события в порядке,
+// в котором их получил этот экземпляр: события разных партиций Kafka на разных экземплярах могут идти в разном
+// порядке, поэтому продолжение с Last-Event-ID точно только на том же экземпляре (или при одной партиции)
+type Event struct {
+	ID       string
+	Type     string
+	Data     []byte // payload события в JSON
+	GenreIDs []uint
+}
+
+// Hub хранит последние события каталога и рассылает новые подписчикам
+type Hub struct {
+	mu          sync.Mutex
+	size        int
+	buffer      []Event
+	subscribers map[*Subscription]struct{}
+}
+
+// NewHub создает Hub, который хранит size последних событий для продолжения чтения после переподключения
+func NewHub(size int) *Hub {
+	return &Hub{size: max(size, 1), subscribers: map[*Subscription]struct{}{}}
+}
+
+// Subscription подписка клиента на события каталога
+type Subscription struct {
+	hub      *Hub
+	genreIDs []uint
+	events   chan Event
+}
+
+// Events канал новых событий. Канал закрывается, если клиент не успевает читать события
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close отменяет подписку
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// matches подходит ли событие под фильтр по жанрам. Удаление книги, жанры которой неизвестны
+// (событие опубликовано до их добавления в payload), передается всем
+func (s *Subscription) matches(event Event) bool {
+	if len(s.genreIDs) == 0 || event.Type == EventReset {
+		return true
+	}
+	if event.Type == EventDeleted && len(event.GenreIDs) == 0 {
+		return true
+	}
+	for _, id := range event.GenreIDs {
+		if slices.Contains(s.genreIDs, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle обработчик событий шины: события о книгах сохраняются в буфер и рассылаются подписчикам.
+// Повторно доставленные события пропускаются
+func (h *Hub) Handle(envelope events.Envelope) error {
+	event, ok, err := newEvent(envelope)
+	if err != nil || !ok {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if slices.ContainsFunc(h.buffer, func(e Event) bool { return e.ID == event.ID }) {
+		return nil
+	}
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > h.size {
+		h.buffer = h.buffer[len(h.buffer)-h.size:]
+	}
+
+	for subscription := range h.subscribers {
+		if !subscription.matches(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			h.remove(subscription)
+		}
+	}
+	return nil
+}
+
+// Subscribe подписывает клиента на события жанров genreIDs (пусто – на все) и возвращает события из буфера,
+// опубликованные после lastEventID. Если lastEventID уже нет в буфере, вместо них возвращается событие reset
+func (h *Hub) Subscribe(lastEventID string, genreIDs []uint) (*Subscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscription := &Subscription{hub: h, genreIDs: genreIDs, events: make(chan Event, subscriptionBuffer)}
+	h.subscribers[subscription] = struct{}{}
+	if lastEventID == "" {
+		return subscription, nil
+	}
+
+	i := slices.IndexFunc(h.buffer, func(e Event) bool { return e.ID == lastEventID })
+	if i < 0 {
+		reset := Event{Type: EventReset, Data: []byte("{}")}
+		if len(h.buffer) > 0 {
+			reset.ID = h.buffer[len(h.buffer)-1].ID
+		}
+		return subscription, []Event{reset}
+	}
+
+	var backlog []Event
+	for _, event := range h.buffer[i+1:] {
+		if subscription.matches(event) {
+			backlog = append(backlog, event)
+		}
+	}
+	return subscription, backlog
+}
+
+// remove удаляет подписку и закрывает ее канал. Вызывается под h.mu
+func (h *Hub) remove(subscription *Subscription) {
+	if _, ok := h.subscribers[subscription]; ok {
+		delete(h.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// newEvent событие потока из события шины. ok = false для событий, которые не передаются в поток
+func newEvent(envelope events.Envelope) (event Event, ok bool, err error) {
+	event = Event{ID: envelope.ID}
+	var genres []events.GenrePayload
+	switch envelope.Type {
+	case events.BookAdded, events.BookUpdated:
+		event.Type = EventAdded
+		if envelope.Type == events.BookUpdated {
+			event.Type = EventUpdated
+		}
+		var payload events.BookPayload
+		err = envelope.DecodePayload(&payload)
+		genres = payload.Genres
+	case events.BookDeleted:
+		event.Type = EventDeleted
+		var payload events.BookDeletedPayload
+		err = envelope.DecodePayload(&payload)
+		genres = payload.Genres
+	default:
+		return event, false, nil
+	}
+	if err != nil {
+		return event, false, fmt.Errorf("%w: payload of event %s: %v", events.ErrUnprocessable, envelope.ID, err)
+	}
+
+	// Данные SSE события должны помещаться в одну строку
+	var data bytes.Buffer
+	if err := json.Compact(&data, envelope.Payload); err != nil {
+		return event, false, fmt.Errorf("%w: payload of event %s: %v", events.ErrUnprocessable, envelope.ID, err)
+	}
+	event.Data = data.Bytes()
+	for _, genre := range genres {
+		event.GenreIDs = append(event.GenreIDs, genre.ID)
+	}
+	return event, true, nil
+}
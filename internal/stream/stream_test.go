@@ -0,0 +1,109 @@
+package stream_test
+
+import (
+	"library/internal/events"
+	"library/internal/stream"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bookEvent(t *testing.T, eventType string, id uint, genreIDs ...uint) events.Envelope {
+	payload := events.BookPayload{ID: id, Title: "Книга"}
+	for _, genreID := range genreIDs {
+		payload.Genres = append(payload.Genres, events.GenrePayload{ID: genreID})
+	}
+	var envelope events.Envelope
+	var err error
+	if eventType == events.BookDeleted {
+		envelope, err = events.New(eventType, "", id, events.BookDeletedPayload{ID: id, Title: payload.Title, Genres: payload.Genres})
+	} else {
+		envelope, err = events.New(eventType, "", id, payload)
+	}
+	require.NoError(t, err)
+	return envelope
+}
+
+// ids id событий
+func ids(list []stream.Event) []string {
+	result := []string{}
+	for _, event := range list {
+		result = append(result, event.ID)
+	}
+	return result
+}
+
+func TestHub(t *testing.T) {
+	hub := stream.NewHub(3)
+
+	all, backlog := hub.Subscribe("", nil)
+	defer all.Close()
+	assert.Empty(t, backlog)
+	fantasy, _ := hub.Subscribe("", []uint{1})
+	defer fantasy.Close()
+
+	added := bookEvent(t, events.BookAdded, 1, 1, 2)
+	updated := bookEvent(t, events.BookUpdated, 2, 3)
+	deleted := bookEvent(t, events.BookDeleted, 1, 1)
+	for _, envelope := range []events.Envelope{added, updated, deleted} {
+		require.NoError(t, hub.Handle(envelope))
+	}
+	// Повторно доставленные события и события не о книгах в поток не попадают
+	require.NoError(t, hub.Handle(added))
+	genre, err := events.New(events.GenreCreated, "", 1, events.GenrePayload{ID: 1, Name: "Фэнтези"})
+	require.NoError(t, err)
+	require.NoError(t, hub.Handle(genre))
+
+	event := <-all.Events()
+	assert.Equal(t, added.ID, event.ID)
+	assert.Equal(t, stream.EventAdded, event.Type)
+	assert.JSONEq(t, string(added.Payload), string(event.Data))
+	assert.Equal(t, stream.EventUpdated, (<-all.Events()).Type)
+	assert.Equal(t, stream.EventDeleted, (<-all.Events()).Type)
+	assert.Empty(t, all.Events())
+
+	// Подписчик на жанр получает только события книг этого жанра
+	assert.Equal(t, added.ID, (<-fantasy.Events()).ID)
+	assert.Equal(t, deleted.ID, (<-fantasy.Events()).ID)
+	assert.Empty(t, fantasy.Events())
+
+	// После переподключения чтение продолжается после Last-Event-ID
+	resumed, backlog := hub.Subscribe(added.ID, nil)
+	resumed.Close()
+	assert.Equal(t, []string{updated.ID, deleted.ID}, ids(backlog))
+	resumed, backlog = hub.Subscribe(added.ID, []uint{1})
+	resumed.Close()
+	assert.Equal(t, []string{deleted.ID}, ids(backlog))
+
+	// Событие, вытесненное из буфера, продолжить нельзя: клиент получает reset
+	require.NoError(t, hub.Handle(bookEvent(t, events.BookAdded, 3)))
+	resumed, backlog = hub.Subscribe(added.ID, []uint{1})
+	resumed.Close()
+	require.Len(t, backlog, 1)
+	assert.Equal(t, stream.EventReset, backlog[0].Type)
+	assert.NotEmpty(t, backlog[0].ID)
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	hub := stream.NewHub(1000)
+	slow, _ := hub.Subscribe("", nil)
+	defer slow.Close()
+
+	for i := uint(1); i <= 100; i++ {
+		require.NoError(t, hub.Handle(bookEvent(t, events.BookAdded, i)))
+	}
+
+	// Канал закрывается после событий, которые успели поставить в очередь
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	assert.Less(t, received, 100)
+}
+
+func TestHubRejectsBrokenPayload(t *testing.T) {
+	hub := stream.NewHub(10)
+	err := hub.Handle(events.Envelope{ID: "1", Type: events.BookAdded, Version: 1, Payload: []byte(`"not an object"`)})
+	assert.ErrorIs(t, err, events.ErrUnprocessable)
+}
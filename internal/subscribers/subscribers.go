@@ -0,0 +1,43 @@
+package subscribers
+
+import (
+	"fmt"
+	"library/internal/events"
+	"library/internal/mailing"
+	"library/internal/webhooks"
+	"library/logger"
+
+	"gorm.io/gorm"
+)
+
+// Replay возвращает обработчик для повторного чтения топика командой replay-events: он ставит в очередь
+// доставки события, которых вебхуки еще не получали (например, вебхуку, созданному после публикации события).
+// Другого состояния, которое строится из событий, нет: кэш и поиск книг читают базу, поэтому повторно
+// запускать для них нечего, а рассылка писем не повторяется. Обработчик идемпотентен
+func Replay(db *gorm.DB) events.Handler {
+	return func(envelope events.Envelope) error {
+		return webhooks.Enqueue(db, envelope)
+	}
+}
+
+// Handler возвращает обработчик событий каталога: ставит события в очередь доставки вебхукам и рассылает
+// письма о новых книгах. Ошибка обработчика означает, что событие нужно обработать повторно
+func Handler(db *gorm.DB) events.Handler {
+	return func(envelope events.Envelope) error {
+		logger.InfoLog.Printf("New event received: %s v%d (%s)", envelope.Type, envelope.Version, envelope.ID)
+
+		if err := webhooks.Enqueue(db, envelope); err != nil {
+			return err
+		}
+
+		switch envelope.Type {
+		case events.BookAdded:
+			var payload events.BookPayload
+			if err := envelope.DecodePayload(&payload); err != nil {
+				return fmt.Errorf("%w: payload of event %s: %v", events.ErrUnprocessable, envelope.ID, err)
+			}
+			return mailing.SendNewBookEmail(payload.Book(), db)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,119 @@
+package subscribers_test
+
+import (
+	"context"
+	"library/internal/database"
+	"library/internal/events"
+	"library/internal/models"
+	"library/internal/subscribers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBookAddedQueuesEmails(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	require.NoError(t, db.Create(&models.User{Name: "Анна", Email: "anna@example.com", Role: "reader", Mailing: true}).Error)
+	book := models.Book{Title: "Книга", Author: "Автор"}
+	require.NoError(t, db.Create(&book).Error)
+
+	bus := events.NewMemoryBus()
+	events.SetPublisher(bus)
+	defer events.SetPublisher(nil)
+	defer bus.Close()
+
+	handled := make(chan string, 1)
+	handler := subscribers.Handler(db)
+	go bus.Consume(context.Background(), func(envelope events.Envelope) error {
+		err := handler(envelope)
+		handled <- envelope.Type
+		return err
+	})
+
+	require.NoError(t, events.Enqueue(db, events.BookAdded, "user:1", book.ID, events.NewBookPayload(book)))
+	published, err := events.Relay(db, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, published)
+
+	select {
+	case eventType := <-handled:
+		assert.Equal(t, events.BookAdded, eventType)
+	case <-time.After(time.Second):
+		t.Fatal("event was not handled")
+	}
+
+	var emails []models.OutboxEmail
+	require.NoError(t, db.Find(&emails).Error)
+	require.Len(t, emails, 1)
+	assert.Equal(t, "anna@example.com", emails[0].Recipient)
+}
+
+func TestHandlerRejectsBrokenPayload(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	handler := subscribers.Handler(database.TestDB)
+
+	envelope := events.Envelope{ID: "1", Type: events.BookAdded, Version: 1, Payload: []byte(`"not an object"`)}
+	assert.ErrorIs(t, handler(envelope), events.ErrUnprocessable)
+
+	// События без обработчиков и вебхуков просто подтверждаются
+	assert.NoError(t, handler(events.Envelope{ID: "2", Type: events.GenreCreated, Version: 1}))
+}
+
+func TestEventsQueuedForWebhooks(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	webhook := models.Webhook{URL: "https://partner.example.com/hook", EventTypes: "BookAdded,BookDeleted", Secret: "secret", Active: true}
+	require.NoError(t, db.Create(&webhook).Error)
+	book := models.Book{Title: "Книга", Author: "Автор"}
+	require.NoError(t, db.Create(&book).Error)
+
+	handler := subscribers.Handler(db)
+	added, err := events.New(events.BookAdded, "user:1", book.ID, events.NewBookPayload(book))
+	require.NoError(t, err)
+	updated, err := events.New(events.BookUpdated, "user:1", book.ID, events.NewBookPayload(book))
+	require.NoError(t, err)
+	require.NoError(t, handler(added))
+	require.NoError(t, handler(updated))
+	// Повторно доставленное событие не создает второй доставки
+	require.NoError(t, handler(added))
+
+	var deliveries []models.WebhookDelivery
+	require.NoError(t, db.Find(&deliveries).Error)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, added.ID, deliveries[0].EventID)
+	assert.Equal(t, webhook.ID, deliveries[0].WebhookID)
+	assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+}
+
+func TestReplayDoesNotSendEmails(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	require.NoError(t, db.Create(&models.User{Name: "Анна", Email: "anna@example.com", Role: "reader", Mailing: true}).Error)
+	webhook := models.Webhook{URL: "https://partner.example.com/hook", EventTypes: "BookAdded", Secret: "secret", Active: true}
+	require.NoError(t, db.Create(&webhook).Error)
+	book := models.Book{Title: "Книга", Author: "Автор"}
+	require.NoError(t, db.Create(&book).Error)
+	envelope, err := events.New(events.BookAdded, "user:1", book.ID, events.NewBookPayload(book))
+	require.NoError(t, err)
+
+	replay := subscribers.Replay(db)
+	require.NoError(t, replay(envelope))
+	require.NoError(t, replay(envelope))
+
+	// Вебхук получает событие один раз, письма не ставятся в очередь
+	var deliveries, emails int64
+	require.NoError(t, db.Model(&models.WebhookDelivery{}).Count(&deliveries).Error)
+	require.NoError(t, db.Model(&models.OutboxEmail{}).Count(&emails).Error)
+	assert.Equal(t, int64(1), deliveries)
+	assert.Equal(t, int64(0), emails)
+}
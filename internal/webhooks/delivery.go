@@ -0,0 +1,240 @@
+package webhooks
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"library/internal/cache"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var errUnexpectedStatus = errors.New("unexpected response status")
+
+// Result результат попытки доставки
+type Result struct {
+	DeliveryID  uint
+	WebhookID   uint
+	EventID     string
+	StatusCode  int
+	Err         error
+	AttemptedAt time.Time
+	Latency     time.Duration
+	Response    string // начало тела ответа
+}
+
+// RunWorker периодически доставляет события вебхукам
+func RunWorker(db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cache.RunLocked("webhook_delivery_lock", deliveryLockTTL, func() {
+			if _, err := ProcessDeliveries(db, time.Now()); err != nil {
+				logger.ErrorLog.Println("Failed to process webhook deliveries\tError:", err)
+			}
+		})
+	}
+}
+
+// ProcessDeliveries отправляет доставки активным вебхукам, время попытки которых подошло, и сохраняет результат.
+// Вебхуки обслуживаются параллельно, а доставки одному вебхуку – по порядку: пока отложенная доставка ждет повтора,
+// следующие за ней тоже ждут. Неудачная доставка откладывается с растущей паузой и после последней попытки
+// получает статус failed, а вебхук, у которого подряд не удалось слишком много доставок, отключается
+func ProcessDeliveries(db *gorm.DB, now time.Time) ([]Result, error) {
+	var deliveries []models.WebhookDelivery
+	if err := db.Joins("JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id AND webhooks.deleted_at IS NULL").
+		Where("webhooks.active = ? AND webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ?",
+			true, models.DeliveryPending, now).
+		Where("NOT EXISTS (SELECT 1 FROM webhook_deliveries AS earlier WHERE earlier.webhook_id = webhook_deliveries.webhook_id"+
+			" AND earlier.id < webhook_deliveries.id AND earlier.status = ? AND earlier.next_attempt_at > ?)", models.DeliveryPending, now).
+		Order("webhook_deliveries.id").Limit(deliveryBatchSize).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+
+	queues := map[uint][]models.WebhookDelivery{}
+	for _, delivery := range deliveries {
+		queues[delivery.WebhookID] = append(queues[delivery.WebhookID], delivery)
+	}
+	ids := make([]uint, 0, len(queues))
+	for id := range queues {
+		ids = append(ids, id)
+	}
+	var webhooks []models.Webhook
+	if err := db.Where("id IN ?", ids).Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+
+	client, maxAttempts, disableAfter := currentPolicy()
+	// Доставки одному вебхуку идут по очереди, и каждая может ждать ответа до таймаута,
+	// поэтому остаток очереди откладывается до следующего прохода, чтобы он уложился в блокировку
+	perWebhook := max(1, int(deliveryLockTTL/2/client.Timeout))
+	for id, queue := range queues {
+		if len(queue) > perWebhook {
+			queues[id] = queue[:perWebhook]
+		}
+	}
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []Result
+	)
+	for _, webhook := range webhooks {
+		wg.Add(1)
+		go func(webhook models.Webhook, queue []models.WebhookDelivery) {
+			defer wg.Done()
+			for _, delivery := range queue {
+				result := send(client, webhook, delivery)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+				if result.Err != nil {
+					return
+				}
+			}
+		}(webhook, queues[webhook.ID])
+	}
+	wg.Wait()
+	slices.SortFunc(results, func(a, b Result) int { return cmp.Compare(a.DeliveryID, b.DeliveryID) })
+
+	attempts := map[uint]int{}
+	for _, delivery := range deliveries {
+		attempts[delivery.ID] = delivery.Attempts + 1
+	}
+	failed := 0
+	for _, result := range results {
+		updates := map[string]interface{}{"attempts": attempts[result.DeliveryID], "last_status_code": result.StatusCode}
+		switch {
+		case result.Err == nil:
+			updates["status"] = models.DeliveryDelivered
+			updates["delivered_at"] = time.Now()
+			updates["last_error"] = ""
+		case attempts[result.DeliveryID] >= maxAttempts:
+			updates["status"] = models.DeliveryFailed
+			updates["last_error"] = result.Err.Error()
+			logger.ErrorLog.Printf("Webhook %d failed to receive event %s after %d attempts\tError: %v", result.WebhookID, result.EventID, attempts[result.DeliveryID], result.Err)
+		default:
+			updates["next_attempt_at"] = now.Add(retryDelay(attempts[result.DeliveryID]))
+			updates["last_error"] = result.Err.Error()
+		}
+		attempt := models.WebhookDeliveryAttempt{
+			DeliveryID:      result.DeliveryID,
+			AttemptedAt:     result.AttemptedAt,
+			StatusCode:      result.StatusCode,
+			LatencyMs:       result.Latency.Milliseconds(),
+			ResponseExcerpt: result.Response,
+		}
+		if result.Err != nil {
+			attempt.Error = result.Err.Error()
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&attempt).Error; err != nil {
+				return err
+			}
+			return tx.Model(&models.WebhookDelivery{}).Where("id = ?", result.DeliveryID).Updates(updates).Error
+		})
+		if err != nil {
+			logger.ErrorLog.Println("Failed to save status of webhook delivery", result.DeliveryID, "\tError:", err)
+		}
+		if result.Err != nil {
+			failed++
+		}
+		if err := recordResult(db, result, disableAfter); err != nil {
+			logger.ErrorLog.Println("Failed to save failures of webhook", result.WebhookID, "\tError:", err)
+		}
+	}
+
+	logger.InfoLog.Println("Webhook deliveries processed: delivered", len(results)-failed, "failed", failed)
+	return results, nil
+}
+
+// recordResult обновляет счетчик неудачных доставок подряд и отключает вебхук, когда он достигает disableAfter
+func recordResult(db *gorm.DB, result Result, disableAfter int) error {
+	if result.Err == nil {
+		return db.Model(&models.Webhook{}).Where("id = ?", result.WebhookID).Update("consecutive_failures", 0).Error
+	}
+	if err := db.Model(&models.Webhook{}).Where("id = ?", result.WebhookID).
+		Update("consecutive_failures", gorm.Expr("consecutive_failures + 1")).Error; err != nil {
+		return err
+	}
+	disabled := db.Model(&models.Webhook{}).
+		Where("id = ? AND active = ? AND consecutive_failures >= ?", result.WebhookID, true, disableAfter).
+		Updates(map[string]interface{}{"active": false, "disabled_at": time.Now()})
+	if disabled.Error != nil {
+		return disabled.Error
+	}
+	if disabled.RowsAffected > 0 {
+		logger.ErrorLog.Println("Webhook", result.WebhookID, "disabled after", disableAfter, "failed deliveries in a row")
+	}
+	return nil
+}
+
+// send выполняет одну попытку доставки и запоминает время, длительность и начало ответа для журнала попыток.
+// Успешной считается доставка с ответом 2xx
+func send(client *http.Client, webhook models.Webhook, delivery models.WebhookDelivery) (result Result) {
+	result = Result{DeliveryID: delivery.ID, WebhookID: webhook.ID, EventID: delivery.EventID, AttemptedAt: time.Now()}
+	defer func() {
+		result.Latency = time.Since(result.AttemptedAt)
+	}()
+
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, delivery.EventType)
+	request.Header.Set(HeaderEventID, delivery.EventID)
+	request.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	response, err := client.Do(request)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	data, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBodySize))
+	result.Response = strings.ToValidUTF8(strings.TrimSpace(string(data)), "")
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		result.Err = fmt.Errorf("%w %d: %s", errUnexpectedStatus, response.StatusCode, result.Response)
+	}
+	return result
+}
+
+// RetryDelivery возвращает доставку в очередь с обнуленным счетчиком попыток
+func RetryDelivery(db *gorm.DB, id uint) error {
+	var delivery models.WebhookDelivery
+	if err := db.First(&delivery, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrDeliveryNotFound
+		}
+		return err
+	}
+	if delivery.Status == models.DeliveryDelivered {
+		return ErrAlreadyDelivered
+	}
+	return db.Model(&delivery).Updates(map[string]interface{}{
+		"status":          models.DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	}).Error
+}
@@ -0,0 +1,201 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"library/internal/events"
+	"library/internal/models"
+	"library/logger"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// deliveryBatchSize сколько доставок воркер берет из очереди за один проход
+	deliveryBatchSize = 100
+	// deliveryLockTTL время, на которое экземпляр приложения захватывает очередь доставок. Проход должен
+	// закончиться раньше, иначе очередь захватит другой экземпляр, поэтому число доставок одному вебхуку
+	// за проход ограничено половиной этого времени, деленной на таймаут запроса
+	deliveryLockTTL = 5 * time.Minute
+	// maxRetryDelay верхняя граница паузы между попытками
+	maxRetryDelay = 6 * time.Hour
+	// maxErrorBodySize сколько байт ответа партнера сохраняется в ошибке доставки и в журнале попыток
+	maxErrorBodySize = 512
+	// SecretPrefix префикс сгенерированных секретов
+	SecretPrefix = "whsec_"
+)
+
+// Заголовки запроса доставки
+const (
+	HeaderEvent     = "X-Library-Event"
+	HeaderEventID   = "X-Library-Event-ID"
+	HeaderDelivery  = "X-Library-Delivery"
+	HeaderTimestamp = "X-Library-Timestamp"
+	HeaderSignature = "X-Library-Signature"
+)
+
+// EventTypes типы событий, на которые можно подписать вебхук. События пользователей партнерам не отправляются
+var EventTypes = []string{events.BookAdded, events.BookUpdated, events.BookDeleted, events.GenreCreated}
+
+var (
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrAlreadyDelivered = errors.New("webhook delivery already delivered")
+	ErrUnknownEventType = errors.New("unknown webhook event type")
+	ErrNoEventTypes     = errors.New("webhook must be subscribed to at least one event type")
+)
+
+// policy настройки доставки, задаются при старте приложения из конфигурации
+var policy = struct {
+	sync.RWMutex
+	maxAttempts  int
+	retryDelay   time.Duration
+	disableAfter int
+	client       *http.Client
+}{maxAttempts: 8, retryDelay: 30 * time.Second, disableAfter: 20, client: newClient(10 * time.Second)}
+
+// SetPolicy задает количество попыток доставки события, паузу перед первым повтором (каждая следующая вдвое длиннее),
+// число неудачных доставок подряд, после которого вебхук отключается, и таймаут запроса
+func SetPolicy(maxAttempts int, retryDelay time.Duration, disableAfter int, timeout time.Duration) {
+	policy.Lock()
+	defer policy.Unlock()
+	if maxAttempts > 0 {
+		policy.maxAttempts = maxAttempts
+	}
+	if retryDelay > 0 {
+		policy.retryDelay = retryDelay
+	}
+	if disableAfter > 0 {
+		policy.disableAfter = disableAfter
+	}
+	if timeout > 0 {
+		policy.client = newClient(timeout)
+	}
+}
+
+// newClient HTTP клиент для доставок. Редиректы не выполняются: POST после редиректа превратился бы в GET,
+// поэтому ответ 3xx считается неудачной доставкой
+func newClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func currentPolicy() (client *http.Client, maxAttempts, disableAfter int) {
+	policy.RLock()
+	defer policy.RUnlock()
+	return policy.client, policy.maxAttempts, policy.disableAfter
+}
+
+// retryDelay пауза перед следующей попыткой после attempts неудачных
+func retryDelay(attempts int) time.Duration {
+	policy.RLock()
+	delay := policy.retryDelay
+	policy.RUnlock()
+
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// NewSecret генерирует секрет для подписи доставок
+func NewSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return SecretPrefix + hex.EncodeToString(buf), nil
+}
+
+// ParseEventTypes проверяет типы событий и возвращает их в виде, в котором они хранятся в базе
+func ParseEventTypes(eventTypes []string) (string, error) {
+	result := make([]string, 0, len(eventTypes))
+	for _, eventType := range eventTypes {
+		eventType = strings.TrimSpace(eventType)
+		if !slices.Contains(EventTypes, eventType) {
+			return "", fmt.Errorf("%w: %q", ErrUnknownEventType, eventType)
+		}
+		if !slices.Contains(result, eventType) {
+			result = append(result, eventType)
+		}
+	}
+	if len(result) == 0 {
+		return "", ErrNoEventTypes
+	}
+	return strings.Join(result, ","), nil
+}
+
+// SplitEventTypes типы событий вебхука
+func SplitEventTypes(eventTypes string) []string {
+	result := []string{}
+	for _, eventType := range strings.Split(eventTypes, ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			result = append(result, eventType)
+		}
+	}
+	return result
+}
+
+// Sign подпись тела запроса: hex HMAC-SHA256 от "<timestamp>.<body>" с секретом вебхука.
+// Метка времени входит в подпись, чтобы перехваченный запрос нельзя было повторить позже
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Enqueue ставит событие в очередь доставки каждому активному вебхуку, подписанному на его тип.
+// Повторно полученное событие не создает новых доставок
+func Enqueue(db *gorm.DB, envelope events.Envelope) error {
+	if !slices.Contains(EventTypes, envelope.Type) {
+		return nil
+	}
+
+	var webhooks []models.Webhook
+	if err := db.Where("active = ?", true).Find(&webhooks).Error; err != nil {
+		return err
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []models.WebhookDelivery
+	for _, webhook := range webhooks {
+		if !slices.Contains(SplitEventTypes(webhook.EventTypes), envelope.Type) {
+			continue
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       envelope.ID,
+			EventType:     envelope.Type,
+			Payload:       string(body),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error; err != nil {
+		return err
+	}
+	logger.InfoLog.Println("Event", envelope.ID, "queued for delivery to", len(deliveries), "webhooks")
+	return nil
+}
@@ -0,0 +1,207 @@
+package webhooks_test
+
+import (
+	"encoding/json"
+	"io"
+	"library/internal/database"
+	"library/internal/events"
+	"library/internal/models"
+	"library/internal/webhooks"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBookAdded(t *testing.T) events.Envelope {
+	envelope, err := events.New(events.BookAdded, "user:1", 7, events.BookPayload{ID: 7, Title: "Книга", Author: "Автор"})
+	require.NoError(t, err)
+	return envelope
+}
+
+func TestParseEventTypes(t *testing.T) {
+	eventTypes, err := webhooks.ParseEventTypes([]string{"BookAdded", " BookDeleted", "BookAdded"})
+	require.NoError(t, err)
+	assert.Equal(t, "BookAdded,BookDeleted", eventTypes)
+	assert.Equal(t, []string{"BookAdded", "BookDeleted"}, webhooks.SplitEventTypes(eventTypes))
+
+	_, err = webhooks.ParseEventTypes([]string{"UserRegistered"})
+	assert.ErrorIs(t, err, webhooks.ErrUnknownEventType)
+	_, err = webhooks.ParseEventTypes(nil)
+	assert.ErrorIs(t, err, webhooks.ErrNoEventTypes)
+}
+
+func TestSignedDelivery(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	webhook := models.Webhook{URL: server.URL, EventTypes: "BookAdded", Secret: "partner-secret", Active: true}
+	require.NoError(t, db.Create(&webhook).Error)
+	envelope := newBookAdded(t)
+	require.NoError(t, webhooks.Enqueue(db, envelope))
+
+	results, err := webhooks.ProcessDeliveries(db, time.Now())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, http.StatusNoContent, results[0].StatusCode)
+
+	// Партнер проверяет подпись тем же секретом
+	timestamp := request.Header.Get(webhooks.HeaderTimestamp)
+	assert.NotEmpty(t, timestamp)
+	assert.Equal(t, webhooks.Sign("partner-secret", timestamp, body), request.Header.Get(webhooks.HeaderSignature))
+	assert.NotEqual(t, webhooks.Sign("other-secret", timestamp, body), request.Header.Get(webhooks.HeaderSignature))
+	assert.Equal(t, events.BookAdded, request.Header.Get(webhooks.HeaderEvent))
+	assert.Equal(t, envelope.ID, request.Header.Get(webhooks.HeaderEventID))
+
+	var received events.Envelope
+	require.NoError(t, json.Unmarshal(body, &received))
+	assert.Equal(t, envelope.ID, received.ID)
+	var payload events.BookPayload
+	require.NoError(t, received.DecodePayload(&payload))
+	assert.Equal(t, "Книга", payload.Title)
+
+	var delivery models.WebhookDelivery
+	require.NoError(t, db.First(&delivery).Error)
+	assert.Equal(t, models.DeliveryDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.NotNil(t, delivery.DeliveredAt)
+	assert.ErrorIs(t, webhooks.RetryDelivery(db, delivery.ID), webhooks.ErrAlreadyDelivered)
+
+	// Вебхуки, не подписанные на тип события, его не получают
+	updated, err := events.New(events.BookUpdated, "user:1", 7, events.BookPayload{ID: 7})
+	require.NoError(t, err)
+	require.NoError(t, webhooks.Enqueue(db, updated))
+	var count int64
+	require.NoError(t, db.Model(&models.WebhookDelivery{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestFailedDeliveriesDisableWebhook(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	webhooks.SetPolicy(2, time.Minute, 3, time.Second)
+	defer webhooks.SetPolicy(8, 30*time.Second, 20, 10*time.Second)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	webhook := models.Webhook{URL: server.URL, EventTypes: "BookAdded", Secret: "secret", Active: true}
+	require.NoError(t, db.Create(&webhook).Error)
+	first, second := newBookAdded(t), newBookAdded(t)
+	require.NoError(t, webhooks.Enqueue(db, first))
+	require.NoError(t, webhooks.Enqueue(db, second))
+
+	// Пока первая доставка ждет повтора, следующая за ней тоже ждет
+	now := time.Now()
+	results, err := webhooks.ProcessDeliveries(db, now)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	assert.Equal(t, http.StatusServiceUnavailable, results[0].StatusCode)
+
+	var delivery models.WebhookDelivery
+	require.NoError(t, db.First(&delivery, results[0].DeliveryID).Error)
+	assert.Equal(t, models.DeliveryPending, delivery.Status)
+	assert.Contains(t, delivery.LastError, "maintenance")
+	assert.Equal(t, 503, delivery.LastStatusCode)
+	assert.WithinDuration(t, now.Add(time.Minute), delivery.NextAttemptAt, time.Second)
+
+	// Каждая попытка сохраняется в журнал вместе с началом ответа
+	var attempts []models.WebhookDeliveryAttempt
+	require.NoError(t, db.Where("delivery_id = ?", delivery.ID).Find(&attempts).Error)
+	require.Len(t, attempts, 1)
+	assert.Equal(t, 503, attempts[0].StatusCode)
+	assert.Equal(t, "maintenance", attempts[0].ResponseExcerpt)
+	assert.Contains(t, attempts[0].Error, "maintenance")
+	assert.WithinDuration(t, now, attempts[0].AttemptedAt, time.Second)
+
+	// Повтор еще не наступил
+	results, err = webhooks.ProcessDeliveries(db, now.Add(30*time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	// Вторая попытка последняя: доставка получает статус failed, а третья неудача подряд отключает вебхук
+	_, err = webhooks.ProcessDeliveries(db, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, db.First(&delivery, delivery.ID).Error)
+	assert.Equal(t, models.DeliveryFailed, delivery.Status)
+	_, err = webhooks.ProcessDeliveries(db, now.Add(time.Minute))
+	require.NoError(t, err)
+
+	require.NoError(t, db.First(&webhook, webhook.ID).Error)
+	assert.False(t, webhook.Active)
+	assert.NotNil(t, webhook.DisabledAt)
+	assert.Equal(t, 3, webhook.ConsecutiveFailures)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Отключенный вебхук не получает ни новых событий, ни отложенных доставок
+	require.NoError(t, webhooks.Enqueue(db, newBookAdded(t)))
+	results, err = webhooks.ProcessDeliveries(db, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	var count int64
+	require.NoError(t, db.Model(&models.WebhookDelivery{}).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+
+	require.NoError(t, db.Model(&models.WebhookDeliveryAttempt{}).Where("delivery_id = ?", delivery.ID).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+
+	// Доставку со статусом failed можно вернуть в очередь
+	require.NoError(t, webhooks.RetryDelivery(db, delivery.ID))
+	require.NoError(t, db.First(&delivery, delivery.ID).Error)
+	assert.Equal(t, models.DeliveryPending, delivery.Status)
+	assert.Equal(t, 0, delivery.Attempts)
+	assert.ErrorIs(t, webhooks.RetryDelivery(db, 999), webhooks.ErrDeliveryNotFound)
+}
+
+func TestDeliveriesPerPassFitLock(t *testing.T) {
+	database.InitTestDB()
+	defer database.CleanupTestDB()
+	db := database.TestDB
+
+	// С таким таймаутом за время блокировки успевает только одна доставка вебхуку
+	webhooks.SetPolicy(8, 30*time.Second, 20, 3*time.Minute)
+	defer webhooks.SetPolicy(8, 30*time.Second, 20, 10*time.Second)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	webhook := models.Webhook{URL: server.URL, EventTypes: "BookAdded", Secret: "secret", Active: true}
+	require.NoError(t, db.Create(&webhook).Error)
+	require.NoError(t, webhooks.Enqueue(db, newBookAdded(t)))
+	require.NoError(t, webhooks.Enqueue(db, newBookAdded(t)))
+
+	// Остаток очереди доставляется следующим проходом
+	for range 2 {
+		results, err := webhooks.ProcessDeliveries(db, time.Now())
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.NoError(t, results[0].Err)
+	}
+	var pending int64
+	require.NoError(t, db.Model(&models.WebhookDelivery{}).Where("status = ?", models.DeliveryPending).Count(&pending).Error)
+	assert.Equal(t, int64(0), pending)
+}
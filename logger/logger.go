@@ -5,9 +5,10 @@ import (
 	"os"
 )
 
+// До вызова InitLog логи пишутся в stdout, чтобы пакеты можно было использовать в тестах
 var (
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	InfoLog  = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	logFile  *os.File
 )
 
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	config "library/configs"
 	_ "library/docs"
+	"library/internal/auth"
 	"library/internal/cache"
 	"library/internal/database"
 	"library/internal/handlers"
 	"library/logger"
+	"os"
+	"strings"
 	"time"
 
+	"library/internal/events"
 	"library/internal/kafka"
+	"library/internal/mailing"
 	"library/internal/middleware"
+	"library/internal/oidc"
+	"library/internal/rbac"
+	"library/internal/stream"
+	"library/internal/subscribers"
+	"library/internal/webhooks"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
@@ -34,6 +45,25 @@ func main() {
 
 	cfg := config.LoadConfig()
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+
+	if err := auth.LoadKeys(); err != nil {
+		logger.ErrorLog.Panicln("Failed to load JWT keys: " + err.Error())
+	}
+	if err := mailing.CheckUnsubscribeSecret(); err != nil {
+		logger.ErrorLog.Panicln("Failed to check unsubscribe links key: " + err.Error())
+	}
+
+	if cfg.AdminTwoFactorRequired {
+		auth.SetTwoFactorPolicy(cfg.TOTPIssuer, "admin")
+	} else {
+		auth.SetTwoFactorPolicy(cfg.TOTPIssuer)
+	}
+
+	setupMailer(cfg)
+
 	if err := database.ConnectWithRetry(6, time.Second); err != nil {
 		logger.ErrorLog.Println("Failed connect to database with retry: " + err.Error())
 	}
@@ -44,46 +74,232 @@ func main() {
 	if err := database.Migrate(); err != nil {
 		logger.ErrorLog.Panicln("Failed to migrate database: " + err.Error())
 	}
+	if err := rbac.SeedRoles(database.DB); err != nil {
+		logger.ErrorLog.Panicln("Failed to seed roles: " + err.Error())
+	}
 	if err := database.CreateTrgmIndexes(database.DB); err != nil {
 		logger.ErrorLog.Println("Failed to create index for trgm in db\tError:", err)
 	}
-
-	producer, err := kafka.NewKafkaProducer([]string{"kafka:9092"}, "library-events")
-	if err != nil {
-		logger.ErrorLog.Panicln("Failed to create kafke producer: " + err.Error())
+	if err := database.ProtectAuditLog(database.DB); err != nil {
+		logger.ErrorLog.Println("Failed to protect audit log from changes\tError:", err)
 	}
-	defer func() {
-		if producer != nil {
-			producer.Close()
-		}
-	}()
 
-	consumer, err := kafka.NewKafkaConsumer([]string{"kafka:9092"}, "library-events")
-	if err != nil {
-		logger.ErrorLog.Panicln("Failed to create kafka consumer: " + err.Error())
-	}
-	go consumer.ConsumeMessage()
+	catalogStream := stream.NewHub(cfg.StreamBufferSize)
+	startEventBus(context.Background(), cfg, catalogStream.Handle)
+	go events.RunRelay(database.DB, cfg.EventOutboxInterval, cfg.EventOutboxRetention)
+	go mailing.RunDigestScheduler(database.DB, cfg.DigestCheckInterval)
+	go mailing.RunOutboxWorker(database.DB, cfg.EmailOutboxInterval)
+	webhooks.SetPolicy(cfg.WebhookMaxAttempts, cfg.WebhookRetryDelay, cfg.WebhookDisableAfter, cfg.WebhookTimeout)
+	go webhooks.RunWorker(database.DB, cfg.WebhookInterval)
+
+	oidcProvider := newOIDCProvider(cfg)
 
 	router := gin.Default()
+	router.Use(middleware.RequestID())
+	router.Use(middleware.CSRF())
 
 	router.Static("/docs", "./docs")
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	router.StaticFile("/favicon.ico", "./static/favicon.ico")
 
 	router.GET("/", handlers.Welcome)
+	router.GET("/.well-known/jwks.json", handlers.JWKS)
 	router.GET("/getBooks", handlers.GetBooks(database.DB))
-	router.GET("/getBook", middleware.RoleMiddleware(database.DB, "admin", "reader"), handlers.GetBook(database.DB))
-	router.GET("/unsubMailing", middleware.RoleMiddleware(database.DB, "admin", "reader"), handlers.UnsubscribeMailing(database.DB)) //	При POST запросе не работает отписка в письме на почте
-	router.GET("/subMailing", middleware.RoleMiddleware(database.DB, "admin", "reader"), handlers.SubscribeMailing(database.DB))     //	GET за компанию	¯\_(ツ)_/¯
+	router.GET("/getBook", middleware.RequirePermission(database.DB, rbac.PermBookRead), handlers.GetBook(database.DB))
+	router.GET("/csrfToken", handlers.CSRFToken)
+	router.GET("/unsubMailing", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.UnsubscribeMailingLink(database.DB)) //	GET только перенаправляет на подтверждение отписки для ссылок в уже отправленных письмах
+	router.POST("/unsubMailing", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.UnsubscribeMailing(database.DB))
+	router.GET("/unsubscribe", handlers.UnsubscribePage(database.DB))
+	router.POST("/unsubscribe", handlers.Unsubscribe(database.DB))
+	router.POST("/subMailing", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.SubscribeMailing(database.DB))
+	router.GET("/getSubscriptions", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.GetSubscriptions(database.DB))
+	router.POST("/addSubscription", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.AddSubscription(database.DB))
+	router.POST("/removeSubscription", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.RemoveSubscription(database.DB))
+	router.POST("/setMailingLocale", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.SetMailingLocale(database.DB))
+	router.POST("/setMailingFrequency", middleware.RequirePermission(database.DB, rbac.PermMailingSubscribe), handlers.SetMailingFrequency(database.DB))
+	router.GET("/getOutboxEmails", middleware.RequirePermission(database.DB, rbac.PermMailingSend), handlers.GetOutboxEmails(database.DB))
+	router.POST("/retryOutboxEmail", middleware.RequirePermission(database.DB, rbac.PermMailingSend), handlers.RetryOutboxEmail(database.DB))
+	router.POST("/retryDeadOutboxEmails", middleware.RequirePermission(database.DB, rbac.PermMailingSend), handlers.RetryDeadOutboxEmails(database.DB))
+	router.GET("/previewEmailTemplate", middleware.RequirePermission(database.DB, rbac.PermMailingSend), handlers.PreviewEmailTemplate)
+	router.GET("/streamCatalog", handlers.StreamCatalog(catalogStream, cfg.StreamHeartbeatInterval))
 	router.GET("/SearchBooks", handlers.SearchBooksHandler(database.DB))
-	router.POST("/modifyingBook", middleware.RoleMiddleware(database.DB, "admin"), handlers.ModifyingBook(database.DB))
+	router.POST("/modifyingBook", middleware.RequirePermission(database.DB, rbac.PermBookWrite), handlers.ModifyingBook(database.DB))
 	router.POST("/register", handlers.RegisterUser(database.DB))
 	router.POST("/login", handlers.LoginUser(database.DB))
+	router.GET("/oidc/login", handlers.OIDCLogin(oidcProvider))
+	router.GET("/oidc/callback", handlers.OIDCCallback(database.DB, oidcProvider, cfg.OIDCPostLoginRedirect))
+	router.POST("/login2FA", handlers.LoginTwoFactor(database.DB))
+	router.POST("/enroll2FA", handlers.EnrollTwoFactor(database.DB))
+	router.POST("/setup2FA", middleware.Authenticated(database.DB), handlers.SetupTwoFactor(database.DB))
+	router.POST("/enable2FA", middleware.Authenticated(database.DB), handlers.EnableTwoFactor(database.DB))
+	router.POST("/disable2FA", middleware.Authenticated(database.DB), handlers.DisableTwoFactor(database.DB))
+	router.POST("/regenerateRecoveryCodes", middleware.Authenticated(database.DB), handlers.RegenerateRecoveryCodes(database.DB))
 	router.POST("/logOut", handlers.LogOut(database.DB))
-	router.POST("/addBook", middleware.RoleMiddleware(database.DB, "admin"), handlers.AddBook(database.DB, producer))
-	router.DELETE("/deleteBook", middleware.RoleMiddleware(database.DB, "admin"), handlers.DeleteBook(database.DB))
+	router.POST("/refreshToken", handlers.RefreshToken(database.DB))
+	router.POST("/addBook", middleware.RequirePermission(database.DB, rbac.PermBookWrite), handlers.AddBook(database.DB))
+	router.DELETE("/deleteBook", middleware.RequirePermission(database.DB, rbac.PermBookWrite), handlers.DeleteBook(database.DB))
+	router.GET("/getSessions", middleware.Authenticated(database.DB), handlers.GetSessions(database.DB))
+	router.POST("/revokeSession", middleware.Authenticated(database.DB), handlers.RevokeSession(database.DB))
+	router.POST("/createApiKey", middleware.RequirePermission(database.DB, rbac.PermAPIKeyManage), handlers.CreateAPIKey(database.DB))
+	router.GET("/getApiKeys", middleware.RequirePermission(database.DB, rbac.PermAPIKeyManage), handlers.GetAPIKeys(database.DB))
+	router.POST("/revokeApiKey", middleware.RequirePermission(database.DB, rbac.PermAPIKeyManage), handlers.RevokeAPIKey(database.DB))
+	router.POST("/createWebhook", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.CreateWebhook(database.DB))
+	router.GET("/getWebhooks", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.GetWebhooks(database.DB))
+	router.POST("/updateWebhook", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.UpdateWebhook(database.DB))
+	router.DELETE("/deleteWebhook", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.DeleteWebhook(database.DB))
+	router.GET("/getWebhookDeliveries", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.GetWebhookDeliveries(database.DB))
+	router.GET("/getWebhookDeliveryAttempts", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.GetWebhookDeliveryAttempts(database.DB))
+	router.POST("/retryWebhookDelivery", middleware.RequirePermission(database.DB, rbac.PermWebhookManage), handlers.RetryWebhookDelivery(database.DB))
+	router.GET("/getAuditLog", middleware.RequirePermission(database.DB, rbac.PermAuditRead), handlers.GetAuditLog(database.DB))
+	router.GET("/exportAuditLog", middleware.RequirePermission(database.DB, rbac.PermAuditRead), handlers.ExportAuditLog(database.DB))
+	router.GET("/getRoles", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.GetRoles(database.DB))
+	router.GET("/getPermissions", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.GetPermissions(database.DB))
+	router.POST("/setRolePermissions", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.SetRolePermissions(database.DB))
+	router.POST("/issue2FAEnrollment", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.IssueTwoFactorEnrollment(database.DB))
+	router.POST("/unlockUser", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.UnlockUser(database.DB))
+	router.POST("/setUserRole", middleware.RequirePermission(database.DB, rbac.PermUserManage), handlers.SetUserRole(database.DB))
 
 	if err := router.Run(":" + cfg.ServerPort); err != nil {
 		panic(err)
 	}
 }
+
+// setupMailer настраивает транспорт писем. При ошибке в настройках письма только пишутся в лог
+func setupMailer(cfg config.Config) {
+	mailing.SetDeliveryConcurrency(cfg.MailConcurrency)
+	mailing.SetOutboxPolicy(cfg.EmailMaxAttempts, cfg.EmailRetryDelay)
+	mailing.SetTemplateDir(cfg.EmailTemplateDir)
+
+	mailerConfig := mailing.MailerConfig{
+		Transport:    cfg.MailTransport,
+		From:         cfg.MailFrom,
+		SMTPHost:     cfg.SMTPHost,
+		SMTPPort:     cfg.SMTPPort,
+		SMTPUsername: cfg.SMTPUsername,
+		SMTPPassword: cfg.SMTPPassword,
+		SMTPMode:     cfg.SMTPMode,
+		Dir:          cfg.MailDir,
+	}
+	if mailerConfig.Transport == mailing.TransportSMTP && mailerConfig.From == "" {
+		logger.ErrorLog.Println(`"MAIL_FROM" and "SMTP_Name" are empty, emails are only logged`)
+		return
+	}
+
+	mailer, err := mailing.NewMailer(mailerConfig)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to configure mail transport, emails are only logged\tError:", err)
+		return
+	}
+	mailing.SetMailer(mailer, mailerConfig.From)
+	logger.InfoLog.Println("Mail transport:", mailerConfig)
+}
+
+// kafkaBusConfig настройки шины событий в Kafka
+func kafkaBusConfig(cfg config.Config) kafka.BusConfig {
+	return kafka.BusConfig{
+		Brokers:         cfg.KafkaBrokers,
+		Topic:           cfg.KafkaTopic,
+		GroupID:         cfg.KafkaConsumerGroup,
+		DeadLetterTopic: cfg.KafkaDeadLetterTopic,
+		InitialOffset:   cfg.KafkaInitialOffset,
+		Retry:           kafka.RetryPolicy{MaxAttempts: cfg.KafkaMaxAttempts, Delay: cfg.KafkaRetryDelay},
+		DedupWindow:     cfg.KafkaDedupWindow,
+	}
+}
+
+// startEventBus подключает шину событий, выбранную в EVENT_BUS, и запускает обработку событий.
+// subscriber получает все события на каждом экземпляре приложения, например для потока событий каталога.
+// Если Kafka недоступна, подключение повторяется в фоне, а события тем временем копятся в outbox
+func startEventBus(ctx context.Context, cfg config.Config, subscriber events.Handler) {
+	handler := subscribers.Handler(database.DB)
+
+	switch cfg.EventBus {
+	case "kafka":
+	case "memory":
+		bus := events.NewMemoryBus()
+		events.SetPublisher(bus)
+		go bus.Consume(ctx, handler)
+		go bus.Subscribe(ctx, subscriber)
+		logger.InfoLog.Println("Event bus: memory")
+		return
+	default:
+		logger.ErrorLog.Printf("Unknown EVENT_BUS %q, using kafka", cfg.EventBus)
+	}
+
+	go func() {
+		delay := time.Second
+		for {
+			bus, err := kafka.NewBus(kafkaBusConfig(cfg))
+			if err == nil {
+				defer bus.Close()
+				events.SetPublisher(bus)
+				logger.InfoLog.Println("Event bus: kafka", cfg.KafkaBrokers)
+				go subscribeWithRetry(ctx, bus, subscriber)
+				if err := bus.Consume(ctx, handler); err != nil && ctx.Err() == nil {
+					logger.ErrorLog.Println("Kafka consumer stopped\tError:", err)
+				}
+				return
+			}
+
+			logger.ErrorLog.Printf("Failed to connect to Kafka %v, retrying in %s\tError: %v", cfg.KafkaBrokers, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, time.Minute)
+		}
+	}()
+}
+
+// subscribeRetryDelay пауза перед повторной подпиской на шину событий
+const subscribeRetryDelay = 5 * time.Second
+
+// subscribeWithRetry подписывает subscriber на шину событий и переподписывает его, если чтение прервалось с ошибкой
+func subscribeWithRetry(ctx context.Context, bus events.Bus, subscriber events.Handler) {
+	for {
+		err := bus.Subscribe(ctx, subscriber)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.ErrorLog.Printf("Event subscription stopped, resubscribing in %s\tError: %v", subscribeRetryDelay, err)
+		select {
+		case <-time.After(subscribeRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newOIDCProvider подключается к провайдеру OpenID Connect. Если он не настроен или недоступен,
+// вход через OIDC отключается, а вход по паролю продолжает работать
+func newOIDCProvider(cfg config.Config) *oidc.Provider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+
+	roleMapping, err := oidc.ParseRoleMapping(cfg.OIDCRoleMapping)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to parse OIDC_ROLE_MAPPING, OIDC login disabled\tError:", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, oidc.Config{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		Scopes:       strings.Fields(cfg.OIDCScopes),
+		RoleClaim:    cfg.OIDCRoleClaim,
+		RoleMapping:  roleMapping,
+		DefaultRole:  cfg.OIDCDefaultRole,
+	}, nil)
+	if err != nil {
+		logger.ErrorLog.Println("Failed to connect to OIDC provider, OIDC login disabled\tError:", err)
+		return nil
+	}
+	logger.InfoLog.Println("OIDC login enabled with provider", cfg.OIDCIssuer)
+	return provider
+}